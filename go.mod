@@ -1,12 +1,14 @@
 module github.com/x5iu/goturbo
 
-go 1.19
+go 1.22.0
 
 require (
 	github.com/spf13/cobra v1.8.0
 	github.com/x5iu/genx v0.6.2
 	github.com/x5iu/visc v0.6.3
-	golang.org/x/tools v0.21.0
+	golang.org/x/mod v0.23.0
+	golang.org/x/tools v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -15,6 +17,6 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
@@ -0,0 +1,278 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var apiDiffCommand = &cobra.Command{
+	Use:   "diff",
+	Short: "Print the changes to the exported API, grouped by package.",
+	Long: "Print the exported declarations added, removed and changed since --from (HEAD by default), grouped by " +
+		"package, with the old and new declarations side by side.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if outputFormat != formatText && outputFormat != formatJSON {
+			return fmt.Errorf("unknown format %q, supported formats are %q and %q", outputFormat, formatText, formatJSON)
+		}
+		if oldSpec != "" || newSpec != "" {
+			return errors.New("--old and --new are not supported by diff")
+		}
+		opts := &detectOptions{From: from, To: to, Include: include, Exclude: exclude}
+		if moduleDir != "" {
+			modules, err := findModules(".")
+			if err != nil {
+				return err
+			}
+			if opts.Module, err = selectModule(modules, moduleDir); err != nil {
+				return err
+			}
+		}
+		pkgs, err := apiDiff(opts)
+		if err != nil {
+			return err
+		}
+		if outputFormat == formatJSON {
+			return writeJSON(cmd.OutOrStdout(), pkgs)
+		}
+		return writeAPIDiff(cmd.OutOrStdout(), pkgs)
+	},
+}
+
+func init() {
+	Command.AddCommand(apiDiffCommand)
+}
+
+// The changes of a declaration in an API diff.
+const (
+	declAdded   = "added"
+	declRemoved = "removed"
+	declChanged = "changed"
+)
+
+// declDiff is the change of a single exported declaration, Old and New are the
+// declarations formatted on a single line, without bodies, doc comments and unexported
+// struct fields.
+type declDiff struct {
+	Symbol string `json:"symbol"`
+	Change string `json:"change"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// packageAPIDiff holds the changed declarations of a package.
+type packageAPIDiff struct {
+	Dir   string      `json:"dir"`
+	Decls []*declDiff `json:"decls"`
+}
+
+// apiDiff lists the changes to the exported declarations of the packages changed between
+// the sources compared by opts; packages whose exported declarations are the same are
+// omitted.
+func apiDiff(opts *detectOptions) ([]*packageAPIDiff, error) {
+	dirs, dirFileMap, oldSrc, newSrc, err := changedPackages(opts)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []*packageAPIDiff{}
+	for _, dir := range dirs {
+		if isInternal(dir) {
+			continue
+		}
+		oldDecls, newDecls, err := loadDecls(dirFileMap[dir], oldSrc, newSrc)
+		if err != nil {
+			return nil, err
+		}
+		if decls := diffDeclTexts(oldDecls, newDecls); len(decls) > 0 {
+			pkgs = append(pkgs, &packageAPIDiff{Dir: dir, Decls: decls})
+		}
+	}
+	return pkgs, nil
+}
+
+// diffDeclTexts compares the formatted declarations in the maps of inspectDecls, ordered
+// by symbol.
+func diffDeclTexts(oldDecls, newDecls *declSet) []*declDiff {
+	var (
+		oldTexts = oldDecls.declTexts()
+		newTexts = newDecls.declTexts()
+		decls    []*declDiff
+	)
+	for key, old := range oldTexts {
+		next, ok := newTexts[key]
+		switch {
+		case !ok:
+			decls = append(decls, &declDiff{Symbol: old.Symbol, Change: declRemoved, Old: old.Text})
+		case old.Text != next.Text:
+			decls = append(decls, &declDiff{Symbol: next.Symbol, Change: declChanged, Old: old.Text, New: next.Text})
+		}
+	}
+	for key, next := range newTexts {
+		if _, ok := oldTexts[key]; !ok {
+			decls = append(decls, &declDiff{Symbol: next.Symbol, Change: declAdded, New: next.Text})
+		}
+	}
+	sort.Slice(decls, func(i, j int) bool {
+		if decls[i].Symbol != decls[j].Symbol {
+			return decls[i].Symbol < decls[j].Symbol
+		}
+		return decls[i].Change < decls[j].Change
+	})
+	return decls
+}
+
+// declText is an exported declaration formatted by formatDecl.
+type declText struct {
+	Symbol string
+	Text   string
+}
+
+// declTexts formats the declarations of ds, by the keys of inspectDecls; the keys of the
+// different kinds of declarations are prefixed to keep them apart.
+func (ds *declSet) declTexts() map[string]declText {
+	texts := make(map[string]declText)
+	for key, typeSpec := range ds.Types {
+		spec := *typeSpec
+		spec.Doc, spec.Comment = nil, nil
+		texts["type "+key] = declText{
+			Symbol: typeSpec.Name.Name,
+			Text:   formatDecl(ds.Fset, &ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{&spec}}),
+		}
+	}
+	var (
+		types    = newTypeInferrer(ds.packageFiles())
+		explicit = explicitConsts(ds.Files)
+	)
+	for key, valueSpec := range ds.Vars {
+		ident := valueIdent(key, valueSpec)
+		spec := &ast.ValueSpec{Names: []*ast.Ident{ident}, Type: valueSpec.Type}
+		tok := token.VAR
+		if valueKind(ident) == "const" {
+			tok = token.CONST
+			// Constants without an expression, such as those following an iota, are printed
+			// with the type and value they get from the previous specs of the block.
+			values := valueSpec.Values
+			if explicitSpec, ok := explicit[valueSpec]; ok {
+				spec.Type, values = explicitSpec.Type, explicitSpec.Values
+			}
+			for i, name := range valueSpec.Names {
+				if name == ident && i < len(values) {
+					// Only the first spec of a block is not made explicit, its iota is 0.
+					spec.Values = []ast.Expr{replaceIota(values[i], 0)}
+				}
+			}
+		} else if spec.Type == nil {
+			// The initializers of vars are implementation details, only their types are
+			// part of the API.
+			spec.Type = types.typeOf(ident.Name)
+		}
+		texts["value "+key] = declText{
+			Symbol: ident.Name,
+			Text:   formatDecl(ds.Fset, &ast.GenDecl{Tok: tok, Specs: []ast.Spec{spec}}),
+		}
+	}
+	for key, funcDecl := range ds.Funcs {
+		decl := *funcDecl
+		decl.Doc, decl.Body = nil, nil
+		texts["func "+key] = declText{Symbol: funcName(funcDecl), Text: formatDecl(ds.Fset, &decl)}
+	}
+	return texts
+}
+
+// formatDecl formats decl on a single line, leaving out the unexported fields of structs.
+func formatDecl(fset *token.FileSet, decl ast.Decl) string {
+	// The fields of structs are replaced below, decl shares them with the parsed files.
+	decl = cloneNode(decl)
+	ast.Inspect(decl, func(node ast.Node) bool {
+		if structType, ok := node.(*ast.StructType); ok && structType.Fields != nil {
+			var fields []*ast.Field
+			for _, field := range structType.Fields.List {
+				if field.Names == nil {
+					fields = append(fields, field)
+					continue
+				}
+				var names []*ast.Ident
+				for _, name := range field.Names {
+					if name.IsExported() {
+						names = append(names, name)
+					}
+				}
+				if len(names) > 0 {
+					exported := *field
+					exported.Names, exported.Doc, exported.Comment = names, nil, nil
+					fields = append(fields, &exported)
+				}
+			}
+			structType.Fields = &ast.FieldList{Opening: structType.Fields.Opening, List: fields, Closing: structType.Fields.Closing}
+		}
+		return true
+	})
+	// Without alignment, the cells of struct fields are separated by tabs instead of padding.
+	var buf strings.Builder
+	(&printer.Config{Mode: printer.RawFormat, Tabwidth: 8}).Fprint(&buf, fset, decl)
+	// Join the lines of structs, interfaces and long parameter lists, for example
+	// "struct {\n\tX int\n\tY int\n}" becomes "struct { X int; Y int }".
+	lines := strings.Split(buf.String(), "\n")
+	text := strings.TrimSpace(lines[0])
+	for _, line := range lines[1:] {
+		cells := strings.FieldsFunc(line, func(ch rune) bool { return ch == '\t' })
+		switch line = strings.TrimSpace(strings.Join(cells, " ")); {
+		case line == "":
+		case strings.HasSuffix(text, "("):
+			text += line
+		case strings.HasPrefix(line, ")"):
+			text = strings.TrimSuffix(text, ",") + line
+		case strings.HasSuffix(text, "{"), strings.HasSuffix(text, ","), strings.HasPrefix(line, "}"):
+			text += " " + line
+		default:
+			text += "; " + line
+		}
+	}
+	return text
+}
+
+// writeAPIDiff writes the changed declarations of each package, the removed ones marked by
+// "-", the added ones by "+", and the changed ones by "~", with the old and new
+// declarations in two columns.
+func writeAPIDiff(w io.Writer, pkgs []*packageAPIDiff) error {
+	// The cells of removed declarations are terminated so that the columns stay aligned
+	// across the lines of a package, the padding they leave is trimmed afterwards.
+	var buf strings.Builder
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	for i, pkg := range pkgs {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s\n", pkg.Dir)
+		for _, decl := range pkg.Decls {
+			switch decl.Change {
+			case declAdded:
+				fmt.Fprintf(tw, "  +\t\t%s\n", decl.New)
+			case declRemoved:
+				fmt.Fprintf(tw, "  -\t%s\t\n", decl.Old)
+			default:
+				fmt.Fprintf(tw, "  ~\t%s\t%s\n", decl.Old, decl.New)
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
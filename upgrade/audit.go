@@ -0,0 +1,161 @@
+package upgrade
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"slices"
+)
+
+var auditCommand = &cobra.Command{
+	Use:   "audit",
+	Short: "Check that past version tags match the changes to the exported API.",
+	Long: "Compare the exported API at each pair of consecutive semantic version tags, and report the tags that " +
+		"understated the upgrade the changes required, such as a removed func in a patch release.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if outputFormat != formatText && outputFormat != formatJSON {
+			return fmt.Errorf("unknown format %q, supported formats are %q and %q", outputFormat, formatText, formatJSON)
+		}
+		pol, err := loadPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+		platforms, err := parsePlatforms(platformSpecs)
+		if err != nil {
+			return err
+		}
+		modules, err := findModules(".")
+		if err != nil {
+			return err
+		}
+		if moduleDir != "" {
+			m, err := selectModule(modules, moduleDir)
+			if err != nil {
+				return err
+			}
+			modules = []*module{m}
+		}
+		if len(modules) == 0 {
+			modules = []*module{nil}
+		}
+		var violations []*auditEntry
+		for _, m := range modules {
+			entries, err := auditModule(m, revisionOrHead(to), &detectOptions{
+				TypeCheck:   typecheck,
+				Include:     include,
+				Exclude:     exclude,
+				Module:      m,
+				Platforms:   platforms,
+				ConstValues: constValues,
+				Policy:      pol,
+			})
+			if err != nil {
+				return err
+			}
+			violations = append(violations, entries...)
+		}
+		if outputFormat == formatJSON {
+			if violations == nil {
+				violations = []*auditEntry{}
+			}
+			if err = writeJSON(cmd.OutOrStdout(), violations); err != nil {
+				return err
+			}
+		} else {
+			for _, entry := range violations {
+				if err = entry.writeText(cmd.OutOrStdout()); err != nil {
+					return err
+				}
+			}
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("%d version tags understated the changes to the API", len(violations))
+		}
+		return nil
+	},
+}
+
+func init() {
+	Command.AddCommand(auditCommand)
+}
+
+// auditEntry is an upgrade between two consecutive version tags of a module which required
+// a higher level of change than the versions allow.
+type auditEntry struct {
+	Module *module `json:"module,omitempty"`
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Change change  `json:"change"`
+	// Allowed is the highest level of change allowed from From to To, see allowedChange.
+	Allowed change `json:"allowed"`
+	// Required is the version the changes required instead of To.
+	Required SemanticVersion `json:"required"`
+	Packages []*packageDiff  `json:"packages"`
+}
+
+func (entry *auditEntry) writeText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s -> %s: %s change, but only %s allowed, expected %s%s\n", entry.From, entry.To,
+		entry.Change, entry.Allowed, entry.Module.tagPrefix(), entry.Required)
+	if err != nil || !explain {
+		return err
+	}
+	for _, pkg := range entry.Packages {
+		for _, f := range pkg.Findings {
+			if f.Change > entry.Allowed {
+				if _, err = fmt.Fprintf(w, "\t%s\n", f); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// auditModule compares the exported API of m between each pair of consecutive version
+// tags reachable from rev, ordered by precedence, and returns the upgrades which required a
+// higher level of change than allowed. The comparison is configured by opts, whose From and
+// To are set to the tags.
+func auditModule(m *module, rev string, opts *detectOptions) ([]*auditEntry, error) {
+	tags, err := gitTags(rev)
+	if err != nil {
+		return nil, err
+	}
+	type versionTag struct {
+		Tag     string
+		Version SemanticVersion
+	}
+	var versionTags []versionTag
+	for _, tag := range tags {
+		if sv, ok := parseTag(tag, m.tagPrefix()); ok {
+			versionTags = append(versionTags, versionTag{Tag: tag, Version: sv})
+		}
+	}
+	slices.SortStableFunc(versionTags, func(x, y versionTag) int { return x.Version.Compare(y.Version) })
+	var violations []*auditEntry
+	for i := 1; i < len(versionTags); i++ {
+		old, next := versionTags[i-1], versionTags[i]
+		if old.Version.Compare(next.Version) == 0 {
+			// Tags of the same version with different build metadata, such as v1.0.0
+			// and v1.0.0+build, are not upgrades.
+			continue
+		}
+		opts.From, opts.To = old.Tag, next.Tag
+		rep, err := detectChange(opts)
+		if err != nil {
+			return nil, fmt.Errorf("comparing %s with %s: %w", old.Tag, next.Tag, err)
+		}
+		if allowed := allowedChange(old.Version, next.Version); rep.Change > allowed {
+			violations = append(violations, &auditEntry{
+				Module:   m,
+				From:     old.Tag,
+				To:       next.Tag,
+				Change:   rep.Change,
+				Allowed:  allowed,
+				Required: old.Version.Next(rep.Change),
+				Packages: rep.Packages,
+			})
+		}
+	}
+	return violations, nil
+}
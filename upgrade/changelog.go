@@ -0,0 +1,140 @@
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The sections of a CHANGELOG entry, in the order they are written.
+const (
+	sectionBreaking = "Breaking"
+	sectionAdded    = "Added"
+	sectionChanged  = "Changed"
+)
+
+// changelogSection returns the section of a CHANGELOG entry f is listed in.
+func changelogSection(f *finding) string {
+	switch {
+	case f.Change == breakingChange:
+		return sectionBreaking
+	case f.Kind == kindAdded || f.Kind == kindFieldAdded || f.Kind == kindMethodAdded:
+		return sectionAdded
+	default:
+		return sectionChanged
+	}
+}
+
+// commitSection returns the section of a CHANGELOG entry c is listed in, or an empty string
+// if c claims no change.
+func commitSection(c *commit) string {
+	switch c.Change {
+	case breakingChange:
+		return sectionBreaking
+	case somethingNew:
+		return sectionAdded
+	case justPatch:
+		return sectionChanged
+	default:
+		return ""
+	}
+}
+
+// formatChangelog formats the CHANGELOG entry of the upgrade in rep, listing its findings
+// and the commits claiming a change with --commits under the version it upgrades to, so
+// that the sections account for rep.Change even when only the commits raised it.
+func formatChangelog(rep *report, date time.Time) []byte {
+	var (
+		buf      bytes.Buffer
+		sections = make(map[string][]string)
+	)
+	fmt.Fprintf(&buf, "## %s - %s\n", rep.Next, date.Format(time.DateOnly))
+	for _, pkg := range rep.Packages {
+		for _, f := range pkg.Findings {
+			entry := f.Reason
+			if pkg.Dir != "." {
+				entry = fmt.Sprintf("`%s`: %s", pkg.Dir, f.Reason)
+			}
+			if len(f.Platforms) > 0 {
+				entry += fmt.Sprintf(" (on %s)", strings.Join(f.Platforms, ", "))
+			}
+			section := changelogSection(f)
+			sections[section] = append(sections[section], entry)
+		}
+	}
+	for _, c := range rep.Commits {
+		if section := commitSection(c); section != "" {
+			sections[section] = append(sections[section], c.Subject)
+		}
+	}
+	if len(sections) == 0 {
+		buf.WriteString("\nNo changes to the API.\n")
+	}
+	for _, section := range []string{sectionBreaking, sectionAdded, sectionChanged} {
+		if entries := sections[section]; len(entries) > 0 {
+			fmt.Fprintf(&buf, "\n### %s\n\n", section)
+			for _, entry := range entries {
+				fmt.Fprintf(&buf, "- %s\n", entry)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeChangelog adds the CHANGELOG entry of the upgrade in rep to file. The entry goes
+// before the entries of older versions, that is, before the first second-level heading,
+// so that the title and introduction of the file stay on top; an existing entry for the
+// same version is replaced.
+func writeChangelog(file string, rep *report, date time.Time) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		content = []byte("# Changelog\n")
+	}
+	var (
+		lines = strings.SplitAfter(string(content), "\n")
+		start = len(lines)
+		end   = len(lines)
+	)
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "## ") {
+			continue
+		}
+		if start == len(lines) {
+			start, end = i, i
+		}
+		// The entry of the same version, which ends at the next second-level heading.
+		if heading := strings.Fields(line); len(heading) > 1 && heading[1] == rep.Next.String() {
+			start, end = i, len(lines)
+			for j := i + 1; j < len(lines); j++ {
+				if strings.HasPrefix(lines[j], "## ") {
+					end = j
+					break
+				}
+			}
+			break
+		}
+	}
+	var buf bytes.Buffer
+	for _, line := range lines[:start] {
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.Write(formatChangelog(rep, date))
+	if end < len(lines) {
+		buf.WriteByte('\n')
+		for _, line := range lines[end:] {
+			buf.WriteString(line)
+		}
+	}
+	return os.WriteFile(file, buf.Bytes(), 0644)
+}
@@ -1,90 +1,392 @@
 package upgrade
 
 import (
-	"bytes"
+	"cmp"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
-	"go/ast"
-	"go/format"
-	"go/parser"
-	"go/token"
-	"os"
-	"strconv"
+	"path/filepath"
+	"time"
 )
 
 var (
-	file string
+	files         []string
+	pre           string
+	promote       bool
+	from          string
+	to            string
+	tag           bool
+	explain       bool
+	outputFormat  string
+	typecheck     bool
+	include       []string
+	exclude       []string
+	moduleDir     string
+	applyMajor    bool
+	changelog     bool
+	changelogFile string
+	commits       bool
+	varName       string
+	selector      string
+	commands      bool
+	oldSpec       string
+	newSpec       string
+	platformSpecs []string
+	constValues   bool
 )
 
 var Command = &cobra.Command{
-	Use:     "upgrade version",
+	Use:     "upgrade [version]",
 	Version: "v0.1.3",
 	Short:   "A tool used to determine the next semantic version.",
 	Args:    cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
-		if len(args) == 0 && file == "" {
-			return cmd.Usage()
+		if tag && applyMajor {
+			return errors.New("--tag cannot be used together with --apply-major, the rewritten files need to be committed first")
 		}
-		var old SemanticVersion
-		if len(args) > 0 {
-			version := args[0]
-			old, err = parse(version)
+		if (varName != "" || selector != "") && len(files) == 0 {
+			return errors.New("--var and --selector can only be used together with --file")
+		}
+		if cmd.Flags().Changed("changelog-file") && !changelog {
+			return errors.New("--changelog-file can only be used together with --changelog")
+		}
+		if varName != "" && selector != "" {
+			return errors.New("--var and --selector cannot be used together")
+		}
+		if tag && len(files) > 0 {
+			return errors.New("--tag cannot be used together with --file")
+		}
+		if commands && (len(files) > 0 || len(args) > 0 || tag) {
+			return errors.New("--commands cannot be used together with a version, --file or --tag")
+		}
+		if outputFormat != formatText && outputFormat != formatJSON {
+			return fmt.Errorf("unknown format %q, supported formats are %q and %q", outputFormat, formatText, formatJSON)
+		}
+		if pre != "" && promote {
+			return errors.New("--pre and --promote cannot be used together")
+		}
+		if pre != "" {
+			if err = checkIdentifiers(pre, true); err != nil {
+				return fmt.Errorf("invalid pre-release identifier %q: %w", pre, err)
+			}
+		}
+		if _, err = parsePlatforms(platformSpecs); err != nil {
+			return err
+		}
+		if oldSpec != "" || newSpec != "" {
+			// Comparing file trees needs neither git nor modules, the trees are compared as
+			// a whole.
+			if oldSpec == "" {
+				return errors.New("--new requires --old")
+			}
+			if from != "" || to != "" || tag || commits || commands || applyMajor || moduleDir != "" {
+				return errors.New("--old and --new cannot be used together with --from, --to, --tag, --commits, " +
+					"--commands, --apply-major or --module")
+			}
+			oldTree, oldCleanup, err := openTree(oldSpec)
 			if err != nil {
 				return err
 			}
+			defer oldCleanup()
+			newTree, newCleanup, err := openTree(cmp.Or(newSpec, "."))
+			if err != nil {
+				return err
+			}
+			defer newCleanup()
+			rep, err := upgradeModule(cmd, args, nil, oldTree, newTree)
+			if err != nil {
+				return err
+			}
+			if outputFormat == formatJSON {
+				return rep.writeJSON(cmd.OutOrStdout())
+			} else if len(files) == 0 {
+				return rep.writeText(cmd.OutOrStdout())
+			}
+			return nil
+		}
+		if tag && to == "" {
+			// The tag is created on HEAD, so its version must not depend on uncommitted
+			// changes in the working tree.
+			to = "HEAD"
 		}
-		chg, err := detectChange()
+		modules, err := findModules(".")
 		if err != nil {
 			return err
 		}
-		if file != "" {
-			if err = inferUpdate(file, old, chg); err != nil {
+		if moduleDir != "" {
+			m, err := selectModule(modules, moduleDir)
+			if err != nil {
+				return err
+			}
+			modules = []*module{m}
+		}
+		if len(modules) <= 1 {
+			var m *module
+			if len(modules) == 1 {
+				m = modules[0]
+			}
+			rep, err := upgradeModule(cmd, args, m, nil, nil)
+			if err != nil {
 				return err
 			}
+			if outputFormat == formatJSON {
+				err = rep.writeJSON(cmd.OutOrStdout())
+			} else if len(files) == 0 {
+				err = rep.writeText(cmd.OutOrStdout())
+			}
+			if err != nil {
+				return err
+			}
+			if tag {
+				if rep.Next == rep.Old {
+					return fmt.Errorf("version %s is unchanged, no tag created", rep.tag())
+				}
+				return gitCreateTag(rep.tag(), revisionOrHead(to))
+			}
+			return nil
+		}
+		// Each module is versioned on its own, starting from its latest tag.
+		if len(args) > 0 || len(files) > 0 {
+			return errors.New("there are multiple modules in the repository, please select one with --module " +
+				"to specify its version or version file")
+		}
+		reps := make([]*report, 0, len(modules))
+		for _, m := range modules {
+			rep, err := upgradeModule(cmd, nil, m, nil, nil)
+			if errors.Is(err, ErrNoVersionTag) {
+				// A module that has never been released does not keep the others from
+				// being upgraded.
+				fmt.Fprintf(cmd.ErrOrStderr(), "skipped module %s: %s\n", m.Path, err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("module %s: %w", m.Path, err)
+			}
+			reps = append(reps, rep)
+		}
+		if len(reps) == 0 {
+			return fmt.Errorf("%w for any module, please select one with --module to specify its version", ErrNoVersionTag)
+		}
+		if outputFormat == formatJSON {
+			err = writeJSON(cmd.OutOrStdout(), reps)
 		} else {
-			next := old.Next(chg)
-			fmt.Println(next)
+			for _, rep := range reps {
+				if err = rep.writeText(cmd.OutOrStdout()); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if tag {
+			var tagged bool
+			for _, rep := range reps {
+				if rep.Next != rep.Old {
+					if err = gitCreateTag(rep.tag(), revisionOrHead(to)); err != nil {
+						return err
+					}
+					tagged = true
+				}
+			}
+			if !tagged {
+				return errors.New("no module has changed, no tag created")
+			}
 		}
 		return nil
 	},
 }
 
-func init() {
-	flags := Command.PersistentFlags()
-	flags.StringVarP(&file, "file", "f", "", "version file, the version number will be automatically inferred from the file and updated")
-}
-
-func inferUpdate(file string, old SemanticVersion, chg change) error {
-	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+// upgradeModule detects the changes to the packages of m, or to all packages if m is nil,
+// and determines the next version of m. The file trees are compared instead of git
+// revisions if they are given.
+func upgradeModule(cmd *cobra.Command, args []string, m *module, oldTree, newTree *fileTree) (rep *report, err error) {
+	var (
+		old  SemanticVersion
+		base = from
+	)
+	if len(args) > 0 {
+		version := args[0]
+		old, err = parse(version)
+		if err != nil {
+			return nil, err
+		}
+	} else if oldTree != nil {
+		// The version of a module zip is known from the directory its files are in.
+		old = oldTree.Version
+		if !old.Valid() && len(files) == 0 {
+			return nil, errors.New("the version of the old file tree is unknown, please specify the current version")
+		}
+	} else if len(files) == 0 && !commands {
+		// With neither a version nor a version file, the current version is the highest
+		// semantic version tag of m reachable from the revision being released, which is
+		// also the default revision to compare from.
+		var latest string
+		latest, old, err = latestTag(revisionOrHead(to), m.tagPrefix())
+		if err != nil {
+			return nil, err
+		}
+		if base == "" {
+			base = latest
+		}
+	}
+	platforms, err := parsePlatforms(platformSpecs)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ast.Inspect(f, func(node ast.Node) bool {
-		switch x := node.(type) {
-		case *ast.BasicLit:
-			if x.Kind == token.STRING {
-				lit, _ := strconv.Unquote(x.Value)
-				if lit != "" {
-					if sv, _ := parse(lit); sv.Valid() {
-						if old.Valid() {
-							sv = old
-						}
-						x.Value = strconv.Quote(sv.Next(chg).String())
-					}
-				}
-				return false
+	pol, err := loadPolicy(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	rep, err = detectChange(&detectOptions{
+		From:        base,
+		To:          to,
+		TypeCheck:   typecheck,
+		Include:     include,
+		Exclude:     exclude,
+		Module:      m,
+		OldTree:     oldTree,
+		NewTree:     newTree,
+		Platforms:   platforms,
+		ConstValues: constValues,
+		Policy:      pol,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep.Module = m
+	if commits {
+		// The commits since the base revision may claim changes that are invisible to the
+		// API analysis, such as a fix in a function body, so the higher of both levels wins.
+		since := base
+		if since == "" {
+			// Without --from, the commits are counted from the tag of the current version;
+			// comparing with HEAD would count none of them.
+			tag, ok, err := versionTag(revisionOrHead(to), m.tagPrefix(), old)
+			if err != nil {
+				return nil, err
 			}
-		default:
+			if !ok {
+				return nil, fmt.Errorf("--commits needs --from, since no tag of the current version%s is reachable from %q",
+					m.describe(), revisionOrHead(to))
+			}
+			since = tag
 		}
-		return true
-	})
-	var buf bytes.Buffer
-	if err = format.Node(&buf, fset, f); err != nil {
-		return err
+		rep.Commits, err = conventionalCommits(revisionOrHead(since), revisionOrHead(to), m)
+		if err != nil {
+			return nil, err
+		}
+		var claimed change
+		for _, c := range rep.Commits {
+			claimed = max(claimed, c.Change)
+		}
+		if claimed < rep.Change && rep.Change > justPatch {
+			fmt.Fprintf(cmd.ErrOrStderr(), "warning: the commit messages%s claim a %s change, but the API analysis shows a %s change\n",
+				m.describe(), claimed, rep.Change)
+		}
+		rep.Change = max(rep.Change, claimed)
 	}
-	if err = os.WriteFile(file, buf.Bytes(), 0644); err != nil {
-		return err
+	if explain {
+		if err = rep.explain(cmd.ErrOrStderr()); err != nil {
+			return nil, err
+		}
+	}
+	if len(files) > 0 {
+		rep.Old, rep.Next, err = inferUpdate(files, old, rep.Change)
+		if err != nil {
+			return nil, err
+		}
+	} else if commands {
+		if rep.Commands, err = updateCommands(m, rep); err != nil {
+			return nil, err
+		}
+		// The version of the whole program is the version of its root command.
+		for _, c := range rep.Commands {
+			if c.Root {
+				rep.Old, rep.Next = c.Old, c.Next
+				break
+			}
+		}
+	} else {
+		rep.Old, rep.Next = old, nextVersion(old, rep.Change)
+	}
+	if applyMajor && rep.Next.Major > rep.Old.Major && rep.Next.Major > 1 {
+		if m == nil {
+			return nil, errors.New("--apply-major requires a go.mod file")
+		}
+		oldPath := m.Path
+		changed, err := moveMajor(m, rep.Next.Major)
+		if err != nil {
+			return nil, err
+		}
+		if len(changed) > 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "moved module %s to %s, %d files rewritten\n", oldPath, m.Path, len(changed))
+		}
+	}
+	if changelog && rep.Next != rep.Old {
+		// Each module keeps its own CHANGELOG.
+		path := changelogFile
+		if m != nil {
+			path = filepath.Join(m.Dir, changelogFile)
+		}
+		if err = writeChangelog(path, rep, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return rep, nil
+}
+
+func init() {
+	Command.AddCommand(snapshotCommand)
+	Command.AddCommand(checkCommand)
+	flags := Command.PersistentFlags()
+	flags.StringArrayVarP(&files, "file", "f", nil, "version file, optionally followed by \":key\" selecting the version, "+
+		"the version number will be automatically inferred from the files and updated, can be repeated")
+	flags.StringVar(&varName, "var", "", "with --file, only update the Go const or var of the given name, such as \"Version\"")
+	flags.StringVar(&selector, "selector", "", "with --file, only update the field of a Go composite literal, such as \"GoTurbo.Version\"")
+	flags.BoolVar(&commands, "commands", false, "bump the Version of each cobra command by the changes to its own package, "+
+		"and the root command by all changes")
+	flags.StringVar(&pre, "pre", "", "produce a pre-release version with the given identifier, such as \"rc\" or \"beta\"")
+	flags.BoolVar(&promote, "promote", false, "promote a pre-release version to its normal version")
+	flags.StringVar(&oldSpec, "old", "", "compare from a directory, a zip or tarball, or a module version such as \"example.com/m@v1.2.3\" instead of a git revision")
+	flags.StringVar(&newSpec, "new", "", "compare to a directory, a zip or tarball, or a module version instead of the working tree, requires --old")
+	flags.StringVar(&from, "from", "", "git revision to compare from, defaults to HEAD")
+	flags.StringVar(&to, "to", "", "git revision to compare to, defaults to the working tree")
+	flags.BoolVar(&tag, "tag", false, "create an annotated git tag for the next version")
+	flags.BoolVar(&explain, "explain", false, "explain which symbols caused the chosen upgrade level")
+	flags.StringVar(&outputFormat, "format", formatText, "output format, either \"text\" or \"json\"")
+	flags.BoolVar(&typecheck, "typecheck", false, "compare packages with go/types instead of comparing their syntax, "+
+		"types have to stay identical, and the method sets of named types are compared; the packages importing changed "+
+		"packages are compared as well, since they may embed the changed types")
+	flags.StringVar(&moduleDir, "module", "", "directory of the module to upgrade in a repository with multiple modules")
+	flags.BoolVar(&applyMajor, "apply-major", false, "rewrite the module path and imports to the new major version, such as \"/v2\"")
+	flags.BoolVar(&commits, "commits", false, "also take the Conventional Commit messages since the base revision into account")
+	flags.BoolVar(&changelog, "changelog", false, "add an entry for the next version to the CHANGELOG file of the module")
+	flags.StringVar(&changelogFile, "changelog-file", "CHANGELOG.md", "with --changelog, the CHANGELOG file relative to the module")
+	flags.StringSliceVar(&include, "include", nil, "only analyze packages in directories matching the patterns, such as \"pkg/...\"")
+	flags.StringSliceVar(&exclude, "exclude", nil, "skip packages in directories matching the patterns, such as \"examples/...\"")
+	flags.BoolVar(&constValues, "const-values", false, "also compare the values of exported constants, "+
+		"changing them, such as by reordering an iota block, is a breaking change")
+	flags.StringSliceVar(&platformSpecs, "platforms", nil, "GOOS/GOARCH platforms the API is compared on, considering the "+
+		"build constraints of the files, such as \"linux/amd64,windows/amd64\"; by default, all files are compared at once, "+
+		"or loaded for the host platform with --typecheck")
+}
+
+func revisionOrHead(rev string) string {
+	if rev == "" {
+		return "HEAD"
+	}
+	return rev
+}
+
+// nextVersion determines the next version according to the --pre and --promote flags.
+func nextVersion(old SemanticVersion, chg change) SemanticVersion {
+	switch {
+	case pre != "":
+		return old.NextPrerelease(chg, pre)
+	case promote:
+		return old.Promote(chg)
+	default:
+		return old.Next(chg)
 	}
-	return nil
 }
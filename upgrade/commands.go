@@ -0,0 +1,259 @@
+package upgrade
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cobraPath = "github.com/spf13/cobra"
+
+// commandVersion is the version of a cobra command, declared by the Version field of a
+// cobra.Command composite literal.
+type commandVersion struct {
+	// Name is the name of the command taken from its Use field.
+	Name string `json:"name"`
+	// Var is the name of the variable the command is assigned to, if any.
+	Var string `json:"var,omitempty"`
+	// Dir is the directory of the package the command is declared in.
+	Dir    string          `json:"dir"`
+	File   string          `json:"file"`
+	Line   int             `json:"line"`
+	Root   bool            `json:"root"`
+	Change change          `json:"change"`
+	Old    SemanticVersion `json:"old"`
+	Next   SemanticVersion `json:"next"`
+	edit   versionEdit
+}
+
+func (c *commandVersion) String() string {
+	return fmt.Sprintf("%s:%d: %s %s -> %s (%s)", c.File, c.Line, c.Name, c.Old, c.Next, c.Change)
+}
+
+// updateCommands bumps the version of every cobra command in m, or in all packages if m
+// is nil. The version of a command is bumped by the changes to the package it is declared
+// in, including the packages in its subdirectories unless they declare commands of their
+// own; the version of a root command, which is never added to another command, is bumped
+// by the changes to all packages, that is, by rep.Change.
+func updateCommands(m *module, rep *report) ([]*commandVersion, error) {
+	files, err := goFiles(m, false)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		commands    []*commandVersion
+		contents    = make(map[string][]byte)
+		subcommands = make(map[string]bool)
+	)
+	// The packages of m are told from the import paths of the subcommands added from other
+	// packages.
+	resolve := func(importPath string) (string, bool) {
+		if m == nil || !inModule(importPath, m.Path, nil) {
+			return "", false
+		}
+		return filepath.Join(m.Dir, filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(importPath, m.Path), "/"))), true
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fileCommands, err := findCommands(file, content, subcommands, resolve)
+		if err != nil {
+			return nil, err
+		}
+		if len(fileCommands) > 0 {
+			contents[file] = content
+			commands = append(commands, fileCommands...)
+		}
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("no cobra command with a version found%s", m.describe())
+	}
+	commandDirs := make(map[string]bool)
+	for _, c := range commands {
+		commandDirs[c.Dir] = true
+	}
+	for _, c := range commands {
+		c.Root = c.Var != "" && !subcommands[commandKey(c.Dir, c.Var)]
+		if c.Root {
+			c.Change = rep.Change
+		} else {
+			for _, pkg := range rep.Packages {
+				if commandDir(pkg.Dir, commandDirs) == c.Dir && pkg.Change > c.Change {
+					c.Change = pkg.Change
+				}
+			}
+		}
+		c.Next = nextVersion(c.Old, c.Change)
+	}
+	for file, content := range contents {
+		var (
+			edits []versionEdit
+			nexts []SemanticVersion
+		)
+		for _, c := range commands {
+			if c.File == file {
+				edits = append(edits, c.edit)
+				nexts = append(nexts, c.Next)
+			}
+		}
+		content = replaceVersions(content, edits, func(i int) SemanticVersion { return nexts[i] })
+		if err = os.WriteFile(file, content, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return commands, nil
+}
+
+// commandDir returns the closest directory to dir, dir included, that declares commands.
+func commandDir(dir string, commandDirs map[string]bool) string {
+	for {
+		if commandDirs[dir] {
+			return dir
+		}
+		if dir == "." || dir == string(filepath.Separator) {
+			return ""
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// commandKey identifies the variable name declared by the package in dir.
+func commandKey(dir string, name string) string {
+	return filepath.ToSlash(dir) + "." + name
+}
+
+// findCommands finds the cobra.Command composite literals with a Version in file, ordered
+// by their positions. The variables passed to AddCommand are added to subcommands, keyed by
+// commandKey; resolve returns the directory of a package of the module by its import path,
+// variables of other packages are left out.
+func findCommands(
+	file string,
+	content []byte,
+	subcommands map[string]bool,
+	resolve func(importPath string) (string, bool),
+) ([]*commandVersion, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, content, 0)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cobraName string
+		// imports maps the names of the imported packages to their import paths, assuming
+		// that packages are named after the last element of their paths.
+		imports = make(map[string]string)
+	)
+	for _, importSpec := range f.Imports {
+		importPath, _ := strconv.Unquote(importSpec.Path.Value)
+		name := path.Base(importPath)
+		if importSpec.Name != nil {
+			name = importSpec.Name.Name
+		}
+		if importPath == cobraPath {
+			cobraName = name
+		}
+		imports[name] = importPath
+	}
+	if cobraName == "" {
+		return nil, nil
+	}
+	isCommand := func(expr ast.Expr) bool {
+		switch x := expr.(type) {
+		case *ast.SelectorExpr:
+			pkg, ok := x.X.(*ast.Ident)
+			return ok && pkg.Name == cobraName && x.Sel.Name == "Command"
+		case *ast.Ident:
+			return cobraName == "." && x.Name == "Command"
+		default:
+			return false
+		}
+	}
+	var (
+		commands []*commandVersion
+		vars     = make(map[*ast.CompositeLit]string)
+	)
+	ast.Inspect(f, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.ValueSpec:
+			for i, ident := range x.Names {
+				if i < len(x.Values) {
+					if compositeLit, ok := ast.Unparen(unaddr(x.Values[i])).(*ast.CompositeLit); ok {
+						vars[compositeLit] = ident.Name
+					}
+				}
+			}
+		case *ast.CallExpr:
+			if sel, ok := x.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "AddCommand" {
+				for _, arg := range x.Args {
+					switch arg := ast.Unparen(arg).(type) {
+					case *ast.Ident:
+						subcommands[commandKey(filepath.Dir(file), arg.Name)] = true
+					case *ast.SelectorExpr:
+						pkg, ok := arg.X.(*ast.Ident)
+						if !ok {
+							continue
+						}
+						if dir, ok := resolve(imports[pkg.Name]); ok {
+							subcommands[commandKey(dir, arg.Sel.Name)] = true
+						}
+					}
+				}
+			}
+		case *ast.CompositeLit:
+			if !isCommand(x.Type) {
+				return true
+			}
+			c := &commandVersion{Var: vars[x], Dir: filepath.Dir(file)}
+			for _, elt := range x.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					continue
+				}
+				key, ok := kv.Key.(*ast.Ident)
+				if !ok {
+					continue
+				}
+				lit, ok := kv.Value.(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+				switch key.Name {
+				case "Use":
+					if fields := strings.Fields(stringLiteral(lit)); len(fields) > 0 {
+						c.Name = fields[0]
+					}
+				case "Version":
+					pos := fset.Position(lit.Pos())
+					c.File, c.Line = file, pos.Line
+					c.edit = versionEdit{
+						Start:    pos.Offset,
+						End:      pos.Offset + len(lit.Value),
+						Version:  stringLiteral(lit),
+						GoString: true,
+					}
+				}
+			}
+			if c.File != "" {
+				commands = append(commands, c)
+			}
+		}
+		return true
+	})
+	for _, c := range commands {
+		if c.Old, err = parse(c.edit.Version); err != nil {
+			return nil, fmt.Errorf("%s:%d: %q is not a semantic version: %w", c.File, c.Line, c.edit.Version, err)
+		}
+		if c.Name == "" {
+			c.Name = c.Var
+		}
+	}
+	return commands, nil
+}
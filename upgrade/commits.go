@@ -0,0 +1,80 @@
+package upgrade
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// commit is a commit following the Conventional Commits specification, along with the
+// change its message claims.
+type commit struct {
+	Hash    string `json:"hash"`
+	Subject string `json:"subject"`
+	Change  change `json:"change"`
+}
+
+func (c *commit) String() string {
+	hash := c.Hash
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return fmt.Sprintf("commit %s: %s (%s)", hash, c.Subject, c.Change)
+}
+
+// conventionalHeader matches the header of a Conventional Commit message, such as
+// "feat(parser)!: add an option", capturing its type and the breaking change marker.
+var conventionalHeader = regexp.MustCompile(`^(\w+)(?:\([^()]*\))?(!)?: \S`)
+
+// parseCommitMessage returns the change claimed by a Conventional Commit message, and
+// whether message follows the specification at all. A breaking change is claimed by the
+// "!" marker or a "BREAKING CHANGE" footer, new features by the "feat" type, and fixes
+// by the "fix" type; the other types, such as "docs" or "chore", claim no change.
+func parseCommitMessage(message string) (change, bool) {
+	header, body, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	match := conventionalHeader.FindStringSubmatch(header)
+	if match == nil {
+		return noChange, false
+	}
+	if match[2] == "!" {
+		return breakingChange, true
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "BREAKING CHANGE:") || strings.HasPrefix(line, "BREAKING-CHANGE:") {
+			return breakingChange, true
+		}
+	}
+	switch strings.ToLower(match[1]) {
+	case "feat":
+		return somethingNew, true
+	case "fix":
+		return justPatch, true
+	default:
+		return noChange, true
+	}
+}
+
+// conventionalCommits returns the Conventional Commits in the revision range from..to
+// which touch the module m, or any file if m is nil.
+func conventionalCommits(from, to string, m *module) ([]*commit, error) {
+	var paths []string
+	if m != nil {
+		paths = append(paths, m.Dir)
+		for _, nested := range m.Nested {
+			paths = append(paths, ":(exclude)"+filepath.ToSlash(nested))
+		}
+	}
+	hashes, messages, err := gitLog(from+".."+to, paths...)
+	if err != nil {
+		return nil, err
+	}
+	commits := []*commit{}
+	for i, message := range messages {
+		if chg, ok := parseCommitMessage(message); ok {
+			subject, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+			commits = append(commits, &commit{Hash: hashes[i], Subject: subject, Change: chg})
+		}
+	}
+	return commits, nil
+}
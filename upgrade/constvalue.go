@@ -0,0 +1,187 @@
+package upgrade
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+
+// constExpr is the expression a constant is declared with, along with the value of iota
+// in its ValueSpec; constants without an expression repeat the one of the previous
+// ValueSpec in their declaration.
+type constExpr struct {
+	Expr ast.Expr
+	Iota int64
+}
+
+// constEvaluator evaluates the constants of a package from their syntax with
+// go/constant, on a best-effort basis: the values of conversions are not truncated to
+// their types, and the values of constants depending on other packages are unknown.
+type constEvaluator struct {
+	exprs  map[string]constExpr
+	values map[string]constant.Value
+	// types holds the names of the types declared in the package, which may be converted to.
+	types map[string]bool
+	// evaluating holds the constants being evaluated, to detect invalid cycles.
+	evaluating map[string]bool
+}
+
+func newConstEvaluator(files []*ast.File) *constEvaluator {
+	cv := &constEvaluator{
+		exprs:      make(map[string]constExpr),
+		values:     make(map[string]constant.Value),
+		types:      make(map[string]bool),
+		evaluating: make(map[string]bool),
+	}
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if ok && genDecl.Tok == token.TYPE {
+				for _, spec := range genDecl.Specs {
+					cv.types[spec.(*ast.TypeSpec).Name.Name] = true
+				}
+			}
+			if !ok || genDecl.Tok != token.CONST {
+				continue
+			}
+			var values []ast.Expr
+			for i, spec := range genDecl.Specs {
+				valueSpec := spec.(*ast.ValueSpec)
+				if len(valueSpec.Values) > 0 {
+					values = valueSpec.Values
+				}
+				for j, name := range valueSpec.Names {
+					if j < len(values) {
+						cv.exprs[name.Name] = constExpr{Expr: values[j], Iota: int64(i)}
+					}
+				}
+			}
+		}
+	}
+	return cv
+}
+
+// value returns the value of the constant name, or nil if it is unknown.
+func (cv *constEvaluator) value(name string) constant.Value {
+	if value, ok := cv.values[name]; ok {
+		return value
+	}
+	ce, ok := cv.exprs[name]
+	if !ok || cv.evaluating[name] {
+		return nil
+	}
+	cv.evaluating[name] = true
+	value := cv.eval(ce.Expr, ce.Iota)
+	delete(cv.evaluating, name)
+	cv.values[name] = value
+	return value
+}
+
+func (cv *constEvaluator) eval(expr ast.Expr, iota int64) constant.Value {
+	switch x := expr.(type) {
+	case *ast.BasicLit:
+		if value := constant.MakeFromLiteral(x.Value, x.Kind, 0); value.Kind() != constant.Unknown {
+			return value
+		}
+	case *ast.Ident:
+		switch x.Name {
+		case "iota":
+			return constant.MakeInt64(iota)
+		case "true", "false":
+			return constant.MakeBool(x.Name == "true")
+		default:
+			return cv.value(x.Name)
+		}
+	case *ast.ParenExpr:
+		return cv.eval(x.X, iota)
+	case *ast.UnaryExpr:
+		if value := cv.eval(x.X, iota); value != nil {
+			return constant.UnaryOp(x.Op, value, 0)
+		}
+	case *ast.BinaryExpr:
+		left, right := cv.eval(x.X, iota), cv.eval(x.Y, iota)
+		if left == nil || right == nil {
+			return nil
+		}
+		switch x.Op {
+		case token.SHL, token.SHR:
+			left = constant.ToInt(left)
+			if shift, ok := constant.Uint64Val(constant.ToInt(right)); ok && left.Kind() == constant.Int {
+				return constant.Shift(left, x.Op, uint(shift))
+			}
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+			if comparableValues(left, right) {
+				return constant.MakeBool(constant.Compare(left, x.Op, right))
+			}
+		case token.QUO:
+			if left.Kind() == constant.Int && right.Kind() == constant.Int {
+				if constant.Sign(right) == 0 {
+					return nil
+				}
+				return constant.BinaryOp(left, token.QUO_ASSIGN, right)
+			}
+			fallthrough
+		default:
+			if comparableValues(left, right) {
+				return constant.BinaryOp(left, x.Op, right)
+			}
+		}
+	case *ast.CallExpr:
+		// Conversions to predeclared types or to types of the package, such as Color(1),
+		// and len of a constant string; other calls, such as unsafe.Sizeof(x) or
+		// real(c), are unknown.
+		fun, ok := ast.Unparen(x.Fun).(*ast.Ident)
+		if !ok || len(x.Args) != 1 {
+			return nil
+		}
+		_, predeclared := types.Universe.Lookup(fun.Name).(*types.TypeName)
+		if fun.Name != "len" && !predeclared && !cv.types[fun.Name] {
+			return nil
+		}
+		value := cv.eval(x.Args[0], iota)
+		if value == nil {
+			return nil
+		}
+		if fun.Name == "len" {
+			if value.Kind() != constant.String {
+				return nil
+			}
+			return constant.MakeInt64(int64(len(constant.StringVal(value))))
+		}
+		return value
+	}
+	return nil
+}
+
+// comparableValues reports whether x and y are both numeric, both strings or both
+// booleans, go/constant panics when mixing them.
+func comparableValues(x, y constant.Value) bool {
+	isNumeric := func(kind constant.Kind) bool {
+		return kind == constant.Int || kind == constant.Float || kind == constant.Complex
+	}
+	return x.Kind() == y.Kind() || isNumeric(x.Kind()) && isNumeric(y.Kind())
+}
+
+// sameValue reports whether the constant values x and y are equal, unknown values are
+// assumed to be.
+func sameValue(x, y constant.Value) bool {
+	if x.Kind() == constant.Unknown || y.Kind() == constant.Unknown {
+		return true
+	}
+	return comparableValues(x, y) && constant.Compare(x, token.EQL, y)
+}
+
+// formatValue formats a constant value for a finding, long strings are shortened.
+func formatValue(value constant.Value) string {
+	if value.Kind() == constant.Int || value.Kind() == constant.Bool {
+		return value.ExactString()
+	}
+	if value.Kind() == constant.String {
+		if s := constant.StringVal(value); len(s) <= 40 {
+			return strconv.Quote(s)
+		}
+	}
+	return value.String()
+}
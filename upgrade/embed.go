@@ -0,0 +1,474 @@
+package upgrade
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+)
+
+// member is a field or method of a type, either declared by the type itself or promoted
+// through its embedded fields.
+type member struct {
+	// Kind is "field" or "method".
+	Kind string
+	// Type is the type of a field, or the signature of a method.
+	Type string
+	// Depth is the number of embedded fields the member is promoted through, it is 0 for
+	// the members declared by the type itself.
+	Depth int
+	// PtrOnly reports whether a method is only in the method set of the pointer type, that
+	// is, it has a pointer receiver and is not promoted through an embedded pointer.
+	PtrOnly bool
+}
+
+// packageMembers computes the members of the types of a package from the syntax of all its
+// files. Only the types declared in the package can be looked into, the members promoted
+// from types of other packages are unknown.
+type packageMembers struct {
+	types map[string]*ast.TypeSpec
+	// methods maps the names of the receiver types to their methods.
+	methods map[string][]*ast.FuncDecl
+}
+
+func newPackageMembers(files []*ast.File) *packageMembers {
+	pm := &packageMembers{
+		types:   make(map[string]*ast.TypeSpec),
+		methods: make(map[string][]*ast.FuncDecl),
+	}
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if typeSpec, ok := spec.(*ast.TypeSpec); ok {
+						pm.types[typeSpec.Name.Name] = typeSpec
+					}
+				}
+			case *ast.FuncDecl:
+				if decl.Recv != nil && len(decl.Recv.List) > 0 {
+					typeIdent, _ := getTypeIdent(decl.Recv.List[0].Type)
+					pm.methods[typeIdent] = append(pm.methods[typeIdent], decl)
+				}
+			}
+		}
+	}
+	return pm
+}
+
+// resolve returns the declaration of the type named by expr, following aliases, or nil if
+// it is not declared in the package; expr may be a pointer or an instantiation.
+func (pm *packageMembers) resolve(expr ast.Expr) *ast.TypeSpec {
+	for {
+		switch x := expr.(type) {
+		case *ast.StarExpr:
+			expr = x.X
+		case *ast.ParenExpr:
+			expr = x.X
+		case *ast.IndexExpr:
+			expr = x.X
+		case *ast.IndexListExpr:
+			expr = x.X
+		case *ast.Ident:
+			typeSpec := pm.types[x.Name]
+			if typeSpec != nil && typeSpec.Assign != token.NoPos {
+				expr = typeSpec.Type
+				continue
+			}
+			return typeSpec
+		default:
+			return nil
+		}
+	}
+}
+
+// underlying returns the struct or interface type a type is defined with, looking through
+// the types of the package it is defined from, or nil.
+func (pm *packageMembers) underlying(typeSpec *ast.TypeSpec) ast.Expr {
+	for seen := make(map[*ast.TypeSpec]bool); typeSpec != nil && !seen[typeSpec]; typeSpec = pm.resolve(typeSpec.Type) {
+		seen[typeSpec] = true
+		switch typ := typeSpec.Type.(type) {
+		case *ast.StructType, *ast.InterfaceType:
+			return typ
+		}
+	}
+	return nil
+}
+
+// members lists the exported members of the type typeName by their names. As in the
+// language, a member hides the members of the same name promoted through more embedded
+// fields, and names promoted through the same number of embedded fields more than once
+// are ambiguous, and not promoted at all.
+func (pm *packageMembers) members(typeName string) map[string]member {
+	typeSpec := pm.types[typeName]
+	if typeSpec == nil {
+		return nil
+	}
+	if iface, ok := pm.underlying(typeSpec).(*ast.InterfaceType); ok {
+		members := make(map[string]member)
+		pm.interfaceMethods(iface, 0, make(map[*ast.TypeSpec]bool), members)
+		return members
+	}
+	type embedding struct {
+		TypeSpec *ast.TypeSpec
+		// ViaPtr reports whether the type is reached through an embedded pointer, which
+		// makes it addressable.
+		ViaPtr bool
+	}
+	var (
+		members = make(map[string]member)
+		hidden  = make(map[string]bool)
+		visited = make(map[*ast.TypeSpec]bool)
+		level   = []embedding{{TypeSpec: typeSpec}}
+	)
+	for depth := 0; len(level) > 0; depth++ {
+		var (
+			found  = make(map[string]member)
+			counts = make(map[string]int)
+			next   []embedding
+			// A type embedded more than once at the same depth makes all of its members
+			// ambiguous.
+			occurrences = make(map[*ast.TypeSpec]int)
+		)
+		for _, e := range level {
+			occurrences[e.TypeSpec]++
+		}
+		for _, e := range level {
+			// Types seen at a smaller depth hide themselves, and multiples are only
+			// looked into once.
+			if visited[e.TypeSpec] {
+				continue
+			}
+			visited[e.TypeSpec] = true
+			add := func(name string, m member) {
+				found[name] = m
+				counts[name] += occurrences[e.TypeSpec]
+			}
+			switch typ := pm.underlying(e.TypeSpec).(type) {
+			case *ast.StructType:
+				for _, field := range typ.Fields.List {
+					for _, name := range field.Names {
+						add(name.Name, member{Kind: "field", Type: formatExpr(field.Type), Depth: depth})
+					}
+					if field.Names != nil {
+						continue
+					}
+					add(embeddedFieldName(field.Type), member{Kind: "field", Type: formatExpr(field.Type), Depth: depth})
+					if embedded := pm.resolve(field.Type); embedded != nil {
+						_, isPtr := field.Type.(*ast.StarExpr)
+						next = append(next, embedding{TypeSpec: embedded, ViaPtr: e.ViaPtr || isPtr})
+					}
+				}
+			case *ast.InterfaceType:
+				// Only reached through a struct: all methods of an embedded interface are
+				// promoted at the same depth.
+				methods := make(map[string]member)
+				pm.interfaceMethods(typ, depth, make(map[*ast.TypeSpec]bool), methods)
+				for name, m := range methods {
+					m.Depth = depth
+					add(name, m)
+				}
+			}
+			for _, funcDecl := range pm.methods[e.TypeSpec.Name.Name] {
+				_, isPtr := getTypeIdent(funcDecl.Recv.List[0].Type)
+				add(funcDecl.Name.Name, member{
+					Kind:    "method",
+					Type:    memberSignature(funcDecl.Type),
+					Depth:   depth,
+					PtrOnly: isPtr && !e.ViaPtr,
+				})
+			}
+		}
+		for name, m := range found {
+			if hidden[name] {
+				continue
+			}
+			hidden[name] = true
+			if counts[name] == 1 && ast.IsExported(name) {
+				members[name] = m
+			}
+		}
+		level = next
+	}
+	return members
+}
+
+// interfaceMethods adds the exported methods of iface to members, the ones declared by
+// embedded interfaces with a depth of depth+1. Embedded interfaces of other packages are
+// unknown.
+func (pm *packageMembers) interfaceMethods(iface *ast.InterfaceType, depth int, visited map[*ast.TypeSpec]bool, members map[string]member) {
+	for _, field := range iface.Methods.List {
+		for _, name := range field.Names {
+			if _, ok := members[name.Name]; !ok && name.IsExported() {
+				members[name.Name] = member{Kind: "method", Type: memberSignature(field.Type.(*ast.FuncType)), Depth: depth}
+			}
+		}
+	}
+	// The methods declared by iface come first, in case they are also declared by the
+	// interfaces it embeds.
+	for _, field := range iface.Methods.List {
+		if field.Names != nil {
+			continue
+		}
+		if embedded := pm.resolve(field.Type); embedded != nil && !visited[embedded] {
+			visited[embedded] = true
+			if embeddedIface, ok := pm.underlying(embedded).(*ast.InterfaceType); ok {
+				pm.interfaceMethods(embeddedIface, depth+1, visited, members)
+			}
+		}
+	}
+}
+
+// embeddedTypes lists the unexported types embedded by the exported types of the package,
+// directly or through other embedded types, which determine the members promoted to them.
+func (pm *packageMembers) embeddedTypes() []string {
+	var (
+		embedded []string
+		visited  = make(map[string]bool)
+		visit    func(name string)
+	)
+	visit = func(name string) {
+		typeSpec := pm.types[name]
+		if typeSpec == nil || visited[name] {
+			return
+		}
+		visited[name] = true
+		if !ast.IsExported(name) {
+			embedded = append(embedded, name)
+		}
+		// Aliases, and types defined from other types of the package.
+		if ident, ok := typeBase(typeSpec.Type).(*ast.Ident); ok {
+			visit(ident.Name)
+		}
+		var fields *ast.FieldList
+		switch typ := typeSpec.Type.(type) {
+		case *ast.StructType:
+			fields = typ.Fields
+		case *ast.InterfaceType:
+			fields = typ.Methods
+		default:
+			return
+		}
+		for _, field := range fields.List {
+			if ident, ok := typeBase(field.Type).(*ast.Ident); ok && field.Names == nil {
+				visit(ident.Name)
+			}
+		}
+	}
+	for _, name := range sortedKeys(pm.types) {
+		if ast.IsExported(name) {
+			visit(name)
+		}
+	}
+	sort.Strings(embedded)
+	return embedded
+}
+
+// typeBase strips the pointer and the type arguments from an embedded type.
+func typeBase(expr ast.Expr) ast.Expr {
+	for {
+		switch x := expr.(type) {
+		case *ast.StarExpr:
+			expr = x.X
+		case *ast.ParenExpr:
+			expr = x.X
+		case *ast.IndexExpr:
+			expr = x.X
+		case *ast.IndexListExpr:
+			expr = x.X
+		default:
+			return expr
+		}
+	}
+}
+
+// memberSignature formats the signature of a method without the names of its parameters
+// and results, which can be changed freely.
+func memberSignature(funcType *ast.FuncType) string {
+	unnamed := func(fields *ast.FieldList) *ast.FieldList {
+		if fields == nil {
+			return nil
+		}
+		list := &ast.FieldList{}
+		for _, field := range fields.List {
+			for i := 0; i < max(len(field.Names), 1); i++ {
+				list.List = append(list.List, &ast.Field{Type: field.Type})
+			}
+		}
+		return list
+	}
+	return formatExpr(&ast.FuncType{
+		TypeParams: funcType.TypeParams,
+		Params:     unnamed(funcType.Params),
+		Results:    unnamed(funcType.Results),
+	})
+}
+
+// embeddedFieldName returns the name of an embedded field, which is the name of its type.
+func embeddedFieldName(expr ast.Expr) string {
+	switch x := typeBase(expr).(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.SelectorExpr:
+		return x.Sel.Name
+	default:
+		return formatExpr(x)
+	}
+}
+
+// promotedDiff compares the members promoted to the exported types of a package through
+// their embedded fields, including the methods of interfaces declared by the interfaces
+// they embed; the members declared by the types themselves are compared by typeDiff and
+// diffDecls. A member promoted on one side may be declared on the other.
+func (d *differ) promotedDiff(oldMembers, newMembers *packageMembers) {
+	for _, name := range sortedKeys(oldMembers.types) {
+		oldType, newType := oldMembers.types[name], newMembers.types[name]
+		if !ast.IsExported(name) || newType == nil {
+			continue
+		}
+		_, wasIface := oldMembers.underlying(oldType).(*ast.InterfaceType)
+		_, isIface := newMembers.underlying(newType).(*ast.InterfaceType)
+		if wasIface != isIface {
+			// Already reported as a change of the type.
+			continue
+		}
+		var (
+			oldPromoted = oldMembers.members(name)
+			newPromoted = newMembers.members(name)
+		)
+		for _, memberName := range sortedKeys(oldPromoted) {
+			oldMember := oldPromoted[memberName]
+			newMember, ok := newPromoted[memberName]
+			if oldMember.Depth == 0 && (!ok || newMember.Depth == 0) {
+				continue
+			}
+			symbol := name + "." + memberName
+			switch {
+			case !ok && isIface:
+				d.record(breakingChange, kindMethodRemoved, symbol, oldType, newType,
+					"removed method %s of an embedded interface", symbol)
+			case !ok && oldMember.Kind == "field":
+				d.record(breakingChange, kindFieldRemoved, symbol, oldType, newType,
+					"removed promoted field %s", symbol)
+			case !ok:
+				d.record(breakingChange, kindRemoved, symbol, oldType, newType,
+					"removed promoted method %s", symbol)
+			case oldMember.Kind != newMember.Kind:
+				d.record(breakingChange, kindTypeChanged, symbol, oldType, newType,
+					"promoted %s %s changed to a %s", oldMember.Kind, symbol, newMember.Kind)
+			case oldMember.Type != newMember.Type && isIface:
+				d.record(breakingChange, kindSignatureChanged, symbol, oldType, newType,
+					"method %s of an embedded interface changed from %s to %s", symbol, oldMember.Type, newMember.Type)
+			case oldMember.Type != newMember.Type && oldMember.Kind == "field":
+				d.record(breakingChange, kindTypeChanged, symbol, oldType, newType,
+					"promoted field %s changed type from %s to %s", symbol, oldMember.Type, newMember.Type)
+			case oldMember.Type != newMember.Type:
+				d.record(breakingChange, kindSignatureChanged, symbol, oldType, newType,
+					"signature of promoted method %s changed from %s to %s", symbol, oldMember.Type, newMember.Type)
+			case !oldMember.PtrOnly && newMember.PtrOnly:
+				d.record(breakingChange, kindReceiverChanged, symbol, oldType, newType,
+					"promoted method %s is no longer in the method set of %s, its receiver changed to a pointer", symbol, name)
+			}
+		}
+		for _, memberName := range sortedKeys(newPromoted) {
+			newMember := newPromoted[memberName]
+			if _, ok := oldPromoted[memberName]; ok || newMember.Depth == 0 {
+				continue
+			}
+			symbol := name + "." + memberName
+			switch {
+			case isIface:
+				d.record(breakingChange, kindMethodAdded, symbol, oldType, newType,
+					"added method %s of an embedded interface", symbol)
+			case newMember.Kind == "field":
+				d.record(somethingNew, kindFieldAdded, symbol, oldType, newType,
+					"added promoted field %s", symbol)
+			default:
+				d.record(somethingNew, kindAdded, symbol, oldType, newType,
+					"added promoted method %s", symbol)
+			}
+		}
+	}
+}
+
+// promotedFields lists the exported fields promoted to a type-checked struct type through
+// its embedded fields, as found by types.LookupFieldOrMethod.
+func promotedFields(named *types.Named) map[string]*types.Var {
+	var (
+		names   = make(map[string]bool)
+		visited = make(map[types.Type]bool)
+		collect func(s *types.Struct, depth int)
+	)
+	collect = func(s *types.Struct, depth int) {
+		for i := 0; i < s.NumFields(); i++ {
+			field := s.Field(i)
+			if depth > 0 && field.Exported() {
+				names[field.Name()] = true
+			}
+			if !field.Embedded() {
+				continue
+			}
+			typ := field.Type()
+			if ptr, ok := typ.(*types.Pointer); ok {
+				typ = ptr.Elem()
+			}
+			if embedded, ok := typ.Underlying().(*types.Struct); ok && !visited[typ] {
+				visited[typ] = true
+				collect(embedded, depth+1)
+			}
+		}
+	}
+	s, ok := named.Underlying().(*types.Struct)
+	if !ok {
+		return nil
+	}
+	collect(s, 0)
+	fields := make(map[string]*types.Var)
+	for name := range names {
+		obj, index, _ := types.LookupFieldOrMethod(named, false, nil, name)
+		if field, ok := obj.(*types.Var); ok && field.IsField() && len(index) > 1 {
+			fields[name] = field
+		}
+	}
+	return fields
+}
+
+// promotedFieldsDiff compares the fields promoted to a struct type through its embedded
+// fields, such as the fields of an embedded type of another package; the promoted methods
+// are compared by methodSetDiff.
+func (d *typesDiffer) promotedFieldsDiff(typeName string, oldNamed, newNamed *types.Named) {
+	var (
+		oldFields = promotedFields(oldNamed)
+		newFields = promotedFields(newNamed)
+	)
+	lookupField := func(named *types.Named, name string) *types.Var {
+		obj, _, _ := types.LookupFieldOrMethod(named, false, nil, name)
+		if field, ok := obj.(*types.Var); ok && field.IsField() {
+			return field
+		}
+		return nil
+	}
+	for _, name := range sortedKeys(oldFields) {
+		var (
+			oldField = oldFields[name]
+			newField = lookupField(newNamed, name)
+			symbol   = typeName + "." + name
+		)
+		if newField == nil {
+			d.recordAt(breakingChange, kindFieldRemoved, symbol, d.oldPos(oldNamed.Obj()), d.newPos(newNamed.Obj()),
+				"removed promoted field %s", symbol)
+			continue
+		}
+		if oldType, newType := typeString(oldField.Type()), typeString(newField.Type()); oldType != newType {
+			d.recordAt(breakingChange, kindTypeChanged, symbol, d.oldPos(oldNamed.Obj()), d.newPos(newNamed.Obj()),
+				"promoted field %s changed type from %s to %s", symbol, oldType, newType)
+		}
+	}
+	for _, name := range sortedKeys(newFields) {
+		if _, ok := oldFields[name]; !ok && lookupField(oldNamed, name) == nil {
+			symbol := typeName + "." + name
+			d.recordAt(somethingNew, kindFieldAdded, symbol, d.oldPos(oldNamed.Obj()), d.newPos(newNamed.Obj()),
+				"added promoted field %s", symbol)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package upgrade
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// typeSet is the set of types satisfying a constraint: all types, or the types of a
+// union of terms such as "int" or "~string", further restricted to the comparable types
+// and to the types with the given methods.
+type typeSet struct {
+	all        bool
+	terms      map[string]bool
+	comparable bool
+	// methods maps the names of the methods to their signatures.
+	methods map[string]string
+}
+
+func allTypes() *typeSet {
+	return &typeSet{all: true, methods: make(map[string]string)}
+}
+
+func termTypes(terms ...string) *typeSet {
+	s := &typeSet{terms: make(map[string]bool), methods: make(map[string]string)}
+	for _, term := range terms {
+		s.terms[term] = true
+	}
+	return s
+}
+
+// covers reports whether all types of term are in s, ignoring the methods.
+func (s *typeSet) covers(term string) bool {
+	return s.all || s.terms[term] || !strings.HasPrefix(term, "~") && s.terms["~"+term]
+}
+
+// union adds the types of o to s, which are both unions of terms.
+func (s *typeSet) union(o *typeSet) {
+	if s.all || o.all {
+		s.all, s.terms = true, nil
+		return
+	}
+	for term := range o.terms {
+		s.terms[term] = true
+	}
+}
+
+// intersect restricts s to the types also in o.
+func (s *typeSet) intersect(o *typeSet) {
+	for name, signature := range o.methods {
+		s.methods[name] = signature
+	}
+	s.comparable = s.comparable || o.comparable
+	switch {
+	case o.all:
+	case s.all:
+		s.all, s.terms = false, o.terms
+	default:
+		terms := make(map[string]bool)
+		for term := range s.terms {
+			if o.covers(term) {
+				terms[term] = true
+			}
+		}
+		for term := range o.terms {
+			if s.covers(term) {
+				terms[term] = true
+			}
+		}
+		s.terms = terms
+	}
+}
+
+// isComparable reports whether all types in s are comparable, which is known without
+// type checking for predeclared types.
+func (s *typeSet) isComparable() bool {
+	if s.comparable {
+		return true
+	}
+	if s.all {
+		return false
+	}
+	for term := range s.terms {
+		typeName, ok := types.Universe.Lookup(strings.TrimPrefix(term, "~")).(*types.TypeName)
+		if !ok || !types.Comparable(typeName.Type()) {
+			return false
+		}
+	}
+	return true
+}
+
+// subsetOf reports whether all types in s are also in o.
+func (s *typeSet) subsetOf(o *typeSet) bool {
+	for name, signature := range o.methods {
+		if s.methods[name] != signature {
+			return false
+		}
+	}
+	if o.comparable && !s.isComparable() {
+		return false
+	}
+	if o.all {
+		return true
+	}
+	if s.all {
+		return false
+	}
+	for term := range s.terms {
+		if !o.covers(term) {
+			return false
+		}
+	}
+	return true
+}
+
+// typeParam is a type parameter with its constraint, Set is nil if the types satisfying
+// the constraint cannot be determined.
+type typeParam struct {
+	Name       string
+	Constraint string
+	Set        *typeSet
+}
+
+// typeParamChange is the change of the constraint of a single type parameter.
+type typeParamChange struct {
+	Change change
+	Reason string
+}
+
+// typeParamsChanges compares the constraints of type parameters by their positions, what
+// names the generic type or func. A constraint that accepts more types than before is
+// loosened, which is compatible for the users of what, and one that accepts fewer types is
+// tightened, which is not. The type parameters cannot be compared one by one when their
+// number has changed, or when the types satisfying a changed constraint are unknown, such
+// as for a constraint declared in another package; false is returned then.
+func typeParamsChanges(what string, oldParams, newParams []typeParam) ([]typeParamChange, bool) {
+	if len(oldParams) != len(newParams) {
+		return nil, false
+	}
+	var changes []typeParamChange
+	for i, oldParam := range oldParams {
+		newParam := newParams[i]
+		if oldParam.Constraint == newParam.Constraint {
+			continue
+		}
+		if oldParam.Set == nil || newParam.Set == nil {
+			return nil, false
+		}
+		loosened, tightened := oldParam.Set.subsetOf(newParam.Set), newParam.Set.subsetOf(oldParam.Set)
+		switch {
+		case loosened && tightened:
+			// Equivalent constraints, such as unions in a different order.
+		case loosened:
+			changes = append(changes, typeParamChange{somethingNew, fmt.Sprintf(
+				"constraint of type parameter %s of %s loosened from %s to %s",
+				newParam.Name, what, oldParam.Constraint, newParam.Constraint)})
+		case tightened:
+			changes = append(changes, typeParamChange{breakingChange, fmt.Sprintf(
+				"constraint of type parameter %s of %s tightened from %s to %s",
+				newParam.Name, what, oldParam.Constraint, newParam.Constraint)})
+		default:
+			changes = append(changes, typeParamChange{breakingChange, fmt.Sprintf(
+				"constraint of type parameter %s of %s changed from %s to %s",
+				newParam.Name, what, oldParam.Constraint, newParam.Constraint)})
+		}
+	}
+	return changes, true
+}
+
+// astTypeParams lists the type parameters declared by fields.
+func astTypeParams(fields *ast.FieldList) []typeParam {
+	var params []typeParam
+	if fields == nil {
+		return params
+	}
+	for _, field := range fields.List {
+		set := astTypeSet(field.Type, false)
+		for _, name := range field.Names {
+			params = append(params, typeParam{Name: name.Name, Constraint: formatExpr(field.Type), Set: set})
+		}
+	}
+	return params
+}
+
+// astTypeSet determines the types satisfying the constraint expr from its syntax alone.
+// Since an identifier might denote either an interface or a type, it is only taken as a
+// term if it names a predeclared type or if it is part of a union (inUnion); nil is
+// returned for constraints that cannot be determined.
+func astTypeSet(expr ast.Expr, inUnion bool) *typeSet {
+	switch x := ast.Unparen(expr).(type) {
+	case *ast.Ident:
+		switch {
+		case x.Name == "any":
+			return allTypes()
+		case x.Name == "comparable":
+			s := allTypes()
+			s.comparable = true
+			return s
+		case inUnion || types.Universe.Lookup(x.Name) != nil:
+			return termTypes(x.Name)
+		default:
+			return nil
+		}
+	case *ast.SelectorExpr:
+		if inUnion {
+			return termTypes(formatExpr(x))
+		}
+		return nil
+	case *ast.UnaryExpr:
+		if x.Op != token.TILDE {
+			return nil
+		}
+		return termTypes("~" + formatExpr(x.X))
+	case *ast.BinaryExpr:
+		if x.Op != token.OR {
+			return nil
+		}
+		s, y := astTypeSet(x.X, true), astTypeSet(x.Y, true)
+		if s == nil || y == nil {
+			return nil
+		}
+		s.union(y)
+		return s
+	case *ast.InterfaceType:
+		s := allTypes()
+		for _, field := range x.Methods.List {
+			if len(field.Names) > 0 {
+				for _, name := range field.Names {
+					s.methods[name.Name] = formatExpr(field.Type)
+				}
+				continue
+			}
+			elem := astTypeSet(field.Type, false)
+			if elem == nil {
+				return nil
+			}
+			s.intersect(elem)
+		}
+		return s
+	case *ast.ArrayType, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.StarExpr, *ast.StructType:
+		return termTypes(formatExpr(x))
+	default:
+		return nil
+	}
+}
+
+// typesTypeParams lists the type parameters in list.
+func typesTypeParams(list *types.TypeParamList) []typeParam {
+	params := make([]typeParam, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		param := list.At(i)
+		params = append(params, typeParam{
+			Name:       param.Obj().Name(),
+			Constraint: typeString(param.Constraint()),
+			Set:        typesTypeSet(param.Constraint()),
+		})
+	}
+	return params
+}
+
+// typesTypeSet determines the types satisfying a type-checked constraint.
+func typesTypeSet(constraint types.Type) *typeSet {
+	iface, ok := constraint.Underlying().(*types.Interface)
+	if !ok {
+		return termTypes(typeString(constraint))
+	}
+	s := allTypes()
+	s.comparable = iface.IsComparable()
+	for i := 0; i < iface.NumMethods(); i++ {
+		method := iface.Method(i)
+		s.methods[method.Name()] = typeString(method.Type())
+	}
+	if iface.IsMethodSet() {
+		return s
+	}
+	for i := 0; i < iface.NumEmbeddeds(); i++ {
+		var elem *typeSet
+		switch embedded := iface.EmbeddedType(i).(type) {
+		case *types.Union:
+			elem = termTypes()
+			for j := 0; j < embedded.Len(); j++ {
+				term := embedded.Term(j)
+				elem.union(typesTerm(term.Type(), term.Tilde()))
+			}
+		default:
+			elem = typesTerm(embedded, false)
+		}
+		s.intersect(elem)
+	}
+	return s
+}
+
+// typesTerm returns the types of a term of a union, which may be an interface itself.
+func typesTerm(typ types.Type, tilde bool) *typeSet {
+	if _, ok := typ.Underlying().(*types.Interface); ok && !tilde {
+		return typesTypeSet(typ)
+	}
+	if tilde {
+		return termTypes("~" + typeString(typ))
+	}
+	return termTypes(typeString(typ))
+}
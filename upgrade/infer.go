@@ -0,0 +1,282 @@
+package upgrade
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// valueDecl is the declaration of a package-level var or const. Index is the position of the
+// name in its ValueSpec, used when the names are assigned the results of a single call.
+type valueDecl struct {
+	Type   ast.Expr
+	Values []ast.Expr
+	Index  int
+	Const  bool
+}
+
+// typeInferrer infers the types of the vars and consts of a package declared without an
+// explicit type from their initializers, on a best-effort basis like constEvaluator: only
+// literals, conversions, composite literals, calls of functions declared in the package, and
+// expressions made of these are understood. The types of untyped constants are represented
+// as identifiers such as "untyped int".
+type typeInferrer struct {
+	values map[string]valueDecl
+	funcs  map[string]*ast.FuncDecl
+	types  map[string]bool
+	// inferred holds the types inferred so far, nil for the unknown ones.
+	inferred  map[string]ast.Expr
+	inferring map[string]bool
+}
+
+func newTypeInferrer(files []*ast.File) *typeInferrer {
+	ti := &typeInferrer{
+		values:    make(map[string]valueDecl),
+		funcs:     make(map[string]*ast.FuncDecl),
+		types:     make(map[string]bool),
+		inferred:  make(map[string]ast.Expr),
+		inferring: make(map[string]bool),
+	}
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					ti.funcs[decl.Name.Name] = decl
+				}
+			case *ast.GenDecl:
+				// Constants without an expression repeat the type and expression of the
+				// previous ValueSpec in their declaration.
+				var (
+					typ    ast.Expr
+					values []ast.Expr
+				)
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						ti.types[spec.Name.Name] = true
+					case *ast.ValueSpec:
+						if decl.Tok == token.VAR || len(spec.Values) > 0 {
+							typ, values = spec.Type, spec.Values
+						}
+						for i, name := range spec.Names {
+							ti.values[name.Name] = valueDecl{Type: typ, Values: values, Index: i, Const: decl.Tok == token.CONST}
+						}
+					}
+				}
+			}
+		}
+	}
+	return ti
+}
+
+// typeOf returns the type of the var or const name, either declared or inferred, or nil if
+// it is unknown.
+func (ti *typeInferrer) typeOf(name string) ast.Expr {
+	if typ, ok := ti.inferred[name]; ok {
+		return typ
+	}
+	vd, ok := ti.values[name]
+	if !ok || ti.inferring[name] {
+		return nil
+	}
+	if vd.Type != nil {
+		return vd.Type
+	}
+	ti.inferring[name] = true
+	var typ ast.Expr
+	switch {
+	case vd.Index < len(vd.Values):
+		typ = ti.infer(vd.Values[vd.Index])
+	case len(vd.Values) == 1:
+		// var a, b = f()
+		if results := ti.callResults(vd.Values[0]); vd.Index < len(results) {
+			typ = results[vd.Index]
+		}
+	}
+	if !vd.Const {
+		typ = defaultType(typ)
+	}
+	delete(ti.inferring, name)
+	ti.inferred[name] = typ
+	return typ
+}
+
+func (ti *typeInferrer) infer(expr ast.Expr) ast.Expr {
+	switch x := expr.(type) {
+	case *ast.BasicLit:
+		switch x.Kind {
+		case token.INT:
+			return untypedType("int")
+		case token.FLOAT:
+			return untypedType("float")
+		case token.IMAG:
+			return untypedType("complex")
+		case token.CHAR:
+			return untypedType("rune")
+		case token.STRING:
+			return untypedType("string")
+		}
+	case *ast.Ident:
+		switch x.Name {
+		case "true", "false":
+			return untypedType("bool")
+		case "iota":
+			return untypedType("int")
+		default:
+			return ti.typeOf(x.Name)
+		}
+	case *ast.ParenExpr:
+		return ti.infer(x.X)
+	case *ast.CompositeLit:
+		if array, ok := x.Type.(*ast.ArrayType); ok {
+			if _, ok = array.Len.(*ast.Ellipsis); ok {
+				return nil
+			}
+		}
+		return x.Type
+	case *ast.FuncLit:
+		return x.Type
+	case *ast.TypeAssertExpr:
+		return x.Type
+	case *ast.StarExpr:
+		if ptr, ok := ti.infer(x.X).(*ast.StarExpr); ok {
+			return ptr.X
+		}
+	case *ast.IndexExpr:
+		switch typ := ti.infer(x.X).(type) {
+		case *ast.MapType:
+			return typ.Value
+		case *ast.ArrayType:
+			return typ.Elt
+		}
+	case *ast.UnaryExpr:
+		switch x.Op {
+		case token.AND:
+			if typ := ti.infer(x.X); typ != nil {
+				return &ast.StarExpr{X: typ}
+			}
+		case token.ARROW:
+			if ch, ok := ti.infer(x.X).(*ast.ChanType); ok {
+				return ch.Value
+			}
+		default:
+			return ti.infer(x.X)
+		}
+	case *ast.BinaryExpr:
+		switch x.Op {
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+			return untypedType("bool")
+		case token.SHL, token.SHR:
+			return ti.infer(x.X)
+		}
+		left, right := ti.infer(x.X), ti.infer(x.Y)
+		switch {
+		case left == nil || right == nil:
+			return nil
+		case isUntyped(left) && isUntyped(right):
+			// The kind appearing later in the list wins, such as in 1 + 2.0.
+			const kinds = "untyped bool, untyped string, untyped int, untyped rune, untyped float, untyped complex"
+			if strings.Index(kinds, formatExpr(right)) > strings.Index(kinds, formatExpr(left)) {
+				return right
+			}
+			return left
+		case isUntyped(left):
+			return right
+		case isUntyped(right) || isSameExpr(left, right):
+			return left
+		}
+	case *ast.CallExpr:
+		if results := ti.callResults(x); len(results) == 1 {
+			return results[0]
+		}
+	}
+	return nil
+}
+
+// callResults returns the types of the results of call, which may be a conversion, or a
+// call of a builtin function or of a non-generic function of the package.
+func (ti *typeInferrer) callResults(expr ast.Expr) []ast.Expr {
+	call, ok := ast.Unparen(expr).(*ast.CallExpr)
+	if !ok {
+		return nil
+	}
+	switch fun := ast.Unparen(call.Fun).(type) {
+	case *ast.Ident:
+		switch {
+		case fun.Name == "new" && len(call.Args) == 1:
+			return []ast.Expr{&ast.StarExpr{X: call.Args[0]}}
+		case fun.Name == "make" && len(call.Args) > 0:
+			return []ast.Expr{call.Args[0]}
+		case fun.Name == "len" || fun.Name == "cap":
+			return []ast.Expr{ast.NewIdent("int")}
+		case fun.Name == "append" && len(call.Args) > 0:
+			return []ast.Expr{ti.infer(call.Args[0])}
+		case ti.types[fun.Name]:
+			return []ast.Expr{fun}
+		}
+		if funcDecl, ok := ti.funcs[fun.Name]; ok {
+			if funcDecl.Type.TypeParams != nil || funcDecl.Type.Results == nil {
+				return nil
+			}
+			var results []ast.Expr
+			for _, field := range funcDecl.Type.Results.List {
+				for i := 0; i < max(len(field.Names), 1); i++ {
+					results = append(results, field.Type)
+				}
+			}
+			return results
+		}
+		if _, ok := types.Universe.Lookup(fun.Name).(*types.TypeName); ok {
+			return []ast.Expr{fun}
+		}
+	case *ast.StarExpr, *ast.ArrayType, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.InterfaceType:
+		// Conversions such as []byte(s) and (*T)(nil).
+		return []ast.Expr{fun}
+	}
+	return nil
+}
+
+// untypedCompatible reports whether a constant of type oldType may become an untyped
+// constant of type newType and value newValue, which is compatible as long as the value is
+// still assignable to a basic oldType, see typesDiffer.constDiff. A nil newValue is unknown
+// and assumed to be assignable.
+func untypedCompatible(oldType, newType ast.Expr, newValue constant.Value) bool {
+	ident, ok := oldType.(*ast.Ident)
+	if !ok || !isUntyped(newType) {
+		return false
+	}
+	typeName, ok := types.Universe.Lookup(ident.Name).(*types.TypeName)
+	if !ok {
+		return false
+	}
+	basic, ok := typeName.Type().(*types.Basic)
+	return ok && (newValue == nil || representable(newValue, basic))
+}
+
+func untypedType(kind string) ast.Expr {
+	return ast.NewIdent("untyped " + kind)
+}
+
+func isUntyped(typ ast.Expr) bool {
+	ident, ok := typ.(*ast.Ident)
+	return ok && strings.HasPrefix(ident.Name, "untyped ")
+}
+
+// defaultType returns the type a var takes when initialized with a value of type typ, which
+// is the default type of untyped constants.
+func defaultType(typ ast.Expr) ast.Expr {
+	if !isUntyped(typ) {
+		return typ
+	}
+	switch kind := strings.TrimPrefix(typ.(*ast.Ident).Name, "untyped "); kind {
+	case "float":
+		return ast.NewIdent("float64")
+	case "complex":
+		return ast.NewIdent("complex128")
+	default:
+		return ast.NewIdent(kind)
+	}
+}
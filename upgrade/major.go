@@ -0,0 +1,144 @@
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"golang.org/x/mod/modfile"
+	xmodule "golang.org/x/mod/module"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// majorPath returns the module path for the major version of the module at modulePath,
+// which ends in "/vN" since v2.
+func majorPath(modulePath string, major int) (string, error) {
+	prefix, pathMajor, ok := xmodule.SplitPathVersion(modulePath)
+	if !ok {
+		return "", fmt.Errorf("invalid module path %q", modulePath)
+	}
+	if strings.HasPrefix(modulePath, "gopkg.in/") {
+		return "", fmt.Errorf("module path %q is versioned by gopkg.in, which is not supported", modulePath)
+	}
+	if major <= 1 {
+		return prefix, nil
+	}
+	if pathMajor == "/v"+strconv.Itoa(major) {
+		return modulePath, nil
+	}
+	return prefix + "/v" + strconv.Itoa(major), nil
+}
+
+// inModule reports whether importPath belongs to the module at modulePath, ignoring the
+// nested modules.
+func inModule(importPath, modulePath string, nestedPaths []string) bool {
+	isPrefix := func(prefix string) bool {
+		return importPath == prefix || strings.HasPrefix(importPath, prefix+"/")
+	}
+	return isPrefix(modulePath) && !slices.ContainsFunc(nestedPaths, isPrefix)
+}
+
+// moveMajor moves m to the given major version, by rewriting the module line in its go.mod
+// and the imports of its own packages in all of its .go files. The files changed are
+// returned, relative to the root of the repository. All the files are rewritten in memory
+// before any of them is written, so that a file failing to parse leaves m untouched.
+func moveMajor(m *module, major int) ([]string, error) {
+	goModFile := filepath.Join(m.Dir, "go.mod")
+	content, err := os.ReadFile(goModFile)
+	if err != nil {
+		return nil, err
+	}
+	goMod, err := modfile.Parse(goModFile, content, nil)
+	if err != nil {
+		return nil, err
+	}
+	if goMod.Module == nil {
+		return nil, fmt.Errorf("%s: no module declaration found", goModFile)
+	}
+	oldPath := goMod.Module.Mod.Path
+	newPath, err := majorPath(oldPath, major)
+	if err != nil || newPath == oldPath {
+		return nil, err
+	}
+	if err = goMod.AddModuleStmt(newPath); err != nil {
+		return nil, err
+	}
+	if content, err = goMod.Format(); err != nil {
+		return nil, err
+	}
+	// Nested modules have their own module paths, which must not be rewritten even though
+	// they start with the path of m.
+	var nestedPaths []string
+	for _, nested := range m.Nested {
+		content, err := os.ReadFile(filepath.Join(nested, "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		nestedPaths = append(nestedPaths, modfile.ModulePath(content))
+	}
+	rewrite := func(importPath string) (string, bool) {
+		if !inModule(importPath, oldPath, nestedPaths) {
+			return importPath, false
+		}
+		return newPath + strings.TrimPrefix(importPath, oldPath), true
+	}
+	var (
+		changed  = []string{goModFile}
+		contents = [][]byte{content}
+	)
+	files, err := goFiles(m, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		rewritten, err := rewriteImports(file, rewrite)
+		if err != nil {
+			return nil, err
+		}
+		if rewritten != nil {
+			changed = append(changed, file)
+			contents = append(contents, rewritten)
+		}
+	}
+	for i, file := range changed {
+		if err = os.WriteFile(file, contents[i], 0644); err != nil {
+			return nil, err
+		}
+	}
+	m.Path = newPath
+	return changed, nil
+}
+
+// rewriteImports rewrites the import paths in file with rewrite, and returns the new
+// content of file, or nil if file is unchanged.
+func rewriteImports(file string, rewrite func(importPath string) (string, bool)) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var rewritten bool
+	for _, importSpec := range f.Imports {
+		importPath, err := strconv.Unquote(importSpec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if importPath, ok := rewrite(importPath); ok && importSpec.Path.Value != strconv.Quote(importPath) {
+			importSpec.Path.Value = strconv.Quote(importPath)
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err = format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
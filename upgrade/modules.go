@@ -0,0 +1,184 @@
+package upgrade
+
+import (
+	"fmt"
+	"golang.org/x/mod/modfile"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// module is a Go module in the repository, which is versioned on its own.
+type module struct {
+	// Path is the module path declared in go.mod.
+	Path string `json:"path"`
+	// Dir is the directory containing go.mod, relative to the root of the repository.
+	Dir string `json:"dir"`
+	// Nested holds the directories of the modules inside Dir, whose packages do not
+	// belong to this module.
+	Nested []string `json:"-"`
+}
+
+// contains reports whether the package in dir belongs to m.
+func (m *module) contains(dir string) bool {
+	if !isSubdir(dir, m.Dir) {
+		return false
+	}
+	for _, nested := range m.Nested {
+		if isSubdir(dir, nested) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagPrefix returns the prefix of the version tags of m, following the convention of
+// the go command: the tags of a module in a subdirectory are prefixed with the
+// subdirectory, such as "sub/module/v1.2.3".
+func (m *module) tagPrefix() string {
+	if m == nil || m.Dir == "." {
+		return ""
+	}
+	return filepath.ToSlash(m.Dir) + "/"
+}
+
+// describe returns a phrase naming m in messages, or an empty string if m is nil.
+func (m *module) describe() string {
+	if m == nil {
+		return ""
+	}
+	return " of module " + m.Path
+}
+
+// goFiles lists the .go files of the packages in m, or of all packages if m is nil, with
+// or without _test.go files. Directories ignored by the go tool are skipped.
+func goFiles(m *module, tests bool) ([]string, error) {
+	root := "."
+	if m != nil {
+		root = m.Dir
+	}
+	var files []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name := entry.Name(); path != root &&
+				(strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" ||
+					m != nil && slices.Contains(m.Nested, path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".go" && (tests || !isTestFile(path)) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// isSubdir reports whether dir is parent or a directory inside it.
+func isSubdir(dir, parent string) bool {
+	if parent == "." {
+		return true
+	}
+	dir, parent = filepath.ToSlash(dir), filepath.ToSlash(parent)
+	return dir == parent || strings.HasPrefix(dir, parent+"/")
+}
+
+// findModules finds the modules under root by their go.mod files. If there is a go.work
+// file at root, only the modules it uses are returned, but the other modules are still
+// needed to determine which packages belong to which module.
+func findModules(root string) ([]*module, error) {
+	var modules []*module
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name := entry.Name(); path != root &&
+				(strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Name() != "go.mod" {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		modulePath := modfile.ModulePath(content)
+		if modulePath == "" {
+			return fmt.Errorf("%s: no module declaration found", path)
+		}
+		dir, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		modules = append(modules, &module{Path: modulePath, Dir: dir})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(modules, func(x, y *module) int {
+		return strings.Compare(filepath.ToSlash(x.Dir), filepath.ToSlash(y.Dir))
+	})
+	for _, m := range modules {
+		for _, other := range modules {
+			if other != m && other.Dir != m.Dir && isSubdir(other.Dir, m.Dir) {
+				m.Nested = append(m.Nested, other.Dir)
+			}
+		}
+	}
+	used, err := workspaceModules(root)
+	if err != nil || used == nil {
+		return modules, err
+	}
+	return slices.DeleteFunc(modules, func(m *module) bool {
+		return !slices.Contains(used, m.Dir)
+	}), nil
+}
+
+// workspaceModules returns the directories used by the go.work file at root, relative to
+// root, or nil if there is no go.work file. Modules outside root are not part of the
+// repository, and are left out.
+func workspaceModules(root string) ([]string, error) {
+	file := filepath.Join(root, "go.work")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	work, err := modfile.ParseWork(file, content, nil)
+	if err != nil {
+		return nil, err
+	}
+	used := make([]string, 0, len(work.Use))
+	for _, use := range work.Use {
+		dir := filepath.Clean(filepath.FromSlash(use.Path))
+		if filepath.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+			continue
+		}
+		used = append(used, dir)
+	}
+	return used, nil
+}
+
+// selectModule returns the module in dir.
+func selectModule(modules []*module, dir string) (*module, error) {
+	dir = filepath.Clean(dir)
+	for _, m := range modules {
+		if m.Dir == dir {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no module found in %q", dir)
+}
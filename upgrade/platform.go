@@ -0,0 +1,238 @@
+package upgrade
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build/constraint"
+	"path/filepath"
+	"strings"
+)
+
+// platform is a target of the go tool, the API of a package is compared separately for
+// each platform, considering only the files the go tool would build for it.
+type platform struct {
+	GOOS   string
+	GOARCH string
+}
+
+func (p platform) String() string {
+	return p.GOOS + "/" + p.GOARCH
+}
+
+func parsePlatforms(specs []string) ([]platform, error) {
+	platforms := make([]platform, 0, len(specs))
+	for _, spec := range specs {
+		goos, goarch, ok := strings.Cut(spec, "/")
+		if !ok || !knownOS[goos] || !knownArch[goarch] {
+			return nil, fmt.Errorf("invalid platform %q, a platform is GOOS/GOARCH, such as \"linux/amd64\"", spec)
+		}
+		platforms = append(platforms, platform{GOOS: goos, GOARCH: goarch})
+	}
+	return platforms, nil
+}
+
+// The lists of known operating systems and architectures, which are kept in sync with
+// the ones of go/build.
+var (
+	knownOS = makeSet("aix", "android", "darwin", "dragonfly", "freebsd", "hurd", "illumos", "ios", "js", "linux",
+		"nacl", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows", "zos")
+	unixOS = makeSet("aix", "android", "darwin", "dragonfly", "freebsd", "hurd", "illumos", "ios", "linux",
+		"netbsd", "openbsd", "solaris")
+	knownArch = makeSet("386", "amd64", "amd64p32", "arm", "armbe", "arm64", "arm64be", "loong64", "mips", "mipsle",
+		"mips64", "mips64le", "mips64p32", "mips64p32le", "ppc", "ppc64", "ppc64le", "riscv", "riscv64", "s390",
+		"s390x", "sparc", "sparc64", "wasm")
+)
+
+func makeSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// matchTag reports whether the build tag is satisfied on p, following the go tool with
+// the gc compiler and cgo disabled; release tags such as "go1.21" are always satisfied,
+// and custom tags never are.
+func (p platform) matchTag(tag string) bool {
+	switch {
+	case tag == p.GOOS || tag == p.GOARCH || tag == "gc":
+		return true
+	case tag == "unix":
+		return unixOS[p.GOOS]
+	case tag == "linux":
+		return p.GOOS == "android"
+	case tag == "solaris":
+		return p.GOOS == "illumos"
+	case tag == "darwin":
+		return p.GOOS == "ios"
+	case strings.HasPrefix(tag, "go1."):
+		return true
+	default:
+		return false
+	}
+}
+
+// matchFile reports whether the go tool builds file on p, considering both its name,
+// such as "x_linux_amd64.go", and its build constraint.
+func (p platform) matchFile(filename string, file *ast.File) bool {
+	if !p.matchFileName(filename) {
+		return false
+	}
+	if expr := buildConstraint(file); expr != nil {
+		return expr.Eval(p.matchTag)
+	}
+	return true
+}
+
+func (p platform) matchFileName(filename string) bool {
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	// Everything before the first underscore is the name of the file, not a constraint.
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return true
+	}
+	elems := strings.Split(name[i:], "_")
+	if n := len(elems); n > 0 && elems[n-1] == "test" {
+		elems = elems[:n-1]
+	}
+	n := len(elems)
+	if n >= 2 && knownOS[elems[n-2]] && knownArch[elems[n-1]] {
+		return p.matchTag(elems[n-2]) && p.matchTag(elems[n-1])
+	}
+	if n >= 1 && (knownOS[elems[n-1]] || knownArch[elems[n-1]]) {
+		return p.matchTag(elems[n-1])
+	}
+	return true
+}
+
+// buildConstraint returns the build constraint of file, which is the //go:build line
+// before the package clause, or the // +build lines if there is no //go:build line.
+func buildConstraint(file *ast.File) constraint.Expr {
+	var plusBuild constraint.Expr
+	for _, group := range file.Comments {
+		if group.Pos() >= file.Package {
+			break
+		}
+		for _, comment := range group.List {
+			switch {
+			case constraint.IsGoBuild(comment.Text):
+				if expr, err := constraint.Parse(comment.Text); err == nil {
+					return expr
+				}
+			case constraint.IsPlusBuild(comment.Text):
+				if expr, err := constraint.Parse(comment.Text); err == nil {
+					if plusBuild == nil {
+						plusBuild = expr
+					} else {
+						plusBuild = &constraint.AndExpr{X: plusBuild, Y: expr}
+					}
+				}
+			}
+		}
+	}
+	return plusBuild
+}
+
+// isIgnored reports whether the go tool builds file on no platform at all, such as a
+// generator constrained by "//go:build ignore"; custom tags are never satisfied, see
+// platform.matchTag.
+func isIgnored(filename string, file *ast.File) bool {
+	if buildConstraint(file) == nil {
+		return false
+	}
+	for goos := range knownOS {
+		for goarch := range knownArch {
+			if (platform{GOOS: goos, GOARCH: goarch}).matchFile(filename, file) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasConstraints reports whether any file in ds is constrained by its name or by a build
+// constraint.
+func (ds *declSet) hasConstraints() bool {
+	for _, f := range ds.packageFiles() {
+		if buildConstraint(f) != nil {
+			return true
+		}
+		filename := ds.Fset.Position(f.Package).Filename
+		for goos := range knownOS {
+			if !(platform{GOOS: goos}).matchFileName(filename) {
+				return true
+			}
+		}
+		for goarch := range knownArch {
+			if !(platform{GOARCH: goarch}).matchFileName(filename) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forPlatform returns the declarations of the files in ds built on p.
+func (ds *declSet) forPlatform(p platform) *declSet {
+	platformDecls := newDeclSet()
+	platformDecls.Fset = ds.Fset
+	for _, f := range ds.Files {
+		if p.matchFile(ds.Fset.Position(f.Package).Filename, f) {
+			platformDecls.Files = append(platformDecls.Files, f)
+			inspectDecls(f, platformDecls.Types, platformDecls.Vars, platformDecls.Funcs)
+			inspectAnnotations(ds.Fset, f, platformDecls.Annotations)
+		}
+	}
+	for _, f := range ds.Context {
+		if p.matchFile(ds.Fset.Position(f.Package).Filename, f) {
+			platformDecls.Context = append(platformDecls.Context, f)
+		}
+	}
+	return platformDecls
+}
+
+// diffPlatforms compares the declarations of a package on each platform of opts, and merges
+// the findings, see mergeFindings. The declarations are compared once if no file of the
+// package is constrained.
+func diffPlatforms(oldDecls, newDecls *declSet, opts *detectOptions) *packageDiff {
+	if opts == nil || len(opts.Platforms) == 0 || !oldDecls.hasConstraints() && !newDecls.hasConstraints() {
+		return diffDecls(oldDecls, newDecls, opts)
+	}
+	platforms := opts.Platforms
+	results := make([][]*finding, 0, len(platforms))
+	for _, p := range platforms {
+		results = append(results, diffDecls(oldDecls.forPlatform(p), newDecls.forPlatform(p), opts).Findings)
+	}
+	d := &differ{findings: mergeFindings(platforms, results)}
+	return d.result()
+}
+
+// mergeFindings merges the findings on each platform, results[i] holding the findings on
+// platforms[i]. Findings of the same kind and reason on several platforms are merged into
+// one, which lists the platforms it affects unless it affects all of them.
+func mergeFindings(platforms []platform, results [][]*finding) []*finding {
+	var (
+		merged []*finding
+		byKey  = make(map[string]*finding)
+	)
+	for i, findings := range results {
+		for _, f := range findings {
+			key := fmt.Sprintf("%s\x00%s\x00%s\x00%d", f.Kind, f.Symbol, f.Reason, f.Change)
+			if m, ok := byKey[key]; ok {
+				m.Platforms = append(m.Platforms, platforms[i].String())
+				continue
+			}
+			m := *f
+			m.Platforms = []string{platforms[i].String()}
+			byKey[key] = &m
+			merged = append(merged, &m)
+		}
+	}
+	for _, f := range merged {
+		if len(f.Platforms) == len(platforms) {
+			f.Platforms = nil
+		}
+	}
+	return merged
+}
@@ -0,0 +1,132 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+)
+
+// policyFile is the file the policy is read from, in the directory goturbo runs in, that
+// is, the root of the repository.
+const policyFile = ".goturbo.yaml"
+
+// policy maps the kinds of findings to the level of change they require, overriding the
+// level chosen by the comparison; kinds not in the policy keep their levels.
+type policy map[string]change
+
+// defaultPolicy holds the levels the comparison chooses for the kinds of findings that
+// always have the same level, applying it changes nothing.
+var defaultPolicy = policy{
+	kindRemoved:          breakingChange,
+	kindAdded:            somethingNew,
+	kindSignatureChanged: breakingChange,
+	kindReceiverChanged:  breakingChange,
+	kindFieldRemoved:     breakingChange,
+	kindFieldAdded:       somethingNew,
+	kindTagChanged:       somethingNew,
+	kindTagAdded:         somethingNew,
+	kindTagRemoved:       breakingChange,
+	kindMethodRemoved:    breakingChange,
+	kindMethodAdded:      breakingChange,
+	kindValueChanged:     breakingChange,
+	kindDeprecated:       somethingNew,
+}
+
+// policyKinds lists the kinds of findings a policy may set the level of.
+var policyKinds = []string{
+	kindRemoved, kindAdded, kindTypeChanged, kindTypeParamsChanged, kindSignatureChanged, kindReceiverChanged,
+	kindFieldRemoved, kindFieldAdded, kindTagChanged, kindTagAdded, kindTagRemoved, kindMethodRemoved,
+	kindMethodAdded, kindValueChanged, kindDeprecated,
+}
+
+// loadPolicy reads the policy in the "upgrade.policy" section of file on top of the
+// default policy, which is returned as is if file does not exist. The levels are written
+// as in reports, "none", "patch", "new" or "breaking", or as "minor" and "major":
+//
+//	upgrade:
+//	  policy:
+//	    tag-changed: patch
+//	    interface-method-added: new
+func loadPolicy(file string) (policy, error) {
+	pol := make(policy, len(defaultPolicy))
+	for kind, level := range defaultPolicy {
+		pol[kind] = level
+	}
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return pol, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Upgrade struct {
+			Policy map[string]string `yaml:"policy"`
+		} `yaml:"upgrade"`
+	}
+	if err = yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for kind, level := range config.Upgrade.Policy {
+		if !isPolicyKind(kind) {
+			return nil, fmt.Errorf("%s: unknown kind of finding %q, the kinds are %s", file, kind,
+				strings.Join(policyKinds, ", "))
+		}
+		if pol[kind], err = parseChange(level); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", file, kind, err)
+		}
+	}
+	return pol, nil
+}
+
+func isPolicyKind(kind string) bool {
+	for _, policyKind := range policyKinds {
+		if kind == policyKind {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChange parses a level of change, as written by change.String, or as "minor" and
+// "major".
+func parseChange(level string) (change, error) {
+	switch strings.ToLower(level) {
+	case "none":
+		return noChange, nil
+	case "patch":
+		return justPatch, nil
+	case "new", "minor":
+		return somethingNew, nil
+	case "breaking", "major":
+		return breakingChange, nil
+	default:
+		return noChange, fmt.Errorf("unknown level %q, the levels are none, patch, new and breaking", level)
+	}
+}
+
+// apply sets the levels of the findings in rep, and the levels of its packages and of rep
+// itself accordingly. The findings of experimental and unstable symbols stay exempted.
+func (pol policy) apply(rep *report) {
+	packages := rep.Packages
+	rep.Packages, rep.Change = nil, noChange
+	for _, pkg := range packages {
+		pol.applyPackage(pkg)
+		rep.add(pkg)
+	}
+	if rep.Packages == nil {
+		rep.Packages = []*packageDiff{}
+	}
+}
+
+func (pol policy) applyPackage(pkg *packageDiff) {
+	pkg.Change = justPatch
+	for _, f := range pkg.Findings {
+		if level, ok := pol[f.Kind]; ok {
+			f.Change = exemptChange(f.Stability, level)
+		}
+		pkg.Change = max(pkg.Change, f.Change)
+	}
+	sortFindings(pkg.Findings)
+}
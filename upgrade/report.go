@@ -0,0 +1,285 @@
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The kinds of findings, each kind describes a category of differences in the
+// exported API.
+const (
+	kindRemoved           = "removed"
+	kindAdded             = "added"
+	kindTypeChanged       = "type-changed"
+	kindTypeParamsChanged = "type-params-changed"
+	kindSignatureChanged  = "signature-changed"
+	kindReceiverChanged   = "receiver-changed"
+	kindFieldRemoved      = "field-removed"
+	kindFieldAdded        = "field-added"
+	kindTagChanged        = "tag-changed"
+	kindTagAdded          = "tag-added"
+	kindTagRemoved        = "tag-removed"
+	kindMethodRemoved     = "interface-method-removed"
+	kindMethodAdded       = "interface-method-added"
+	kindValueChanged      = "value-changed"
+	kindDeprecated        = "deprecated"
+)
+
+// The output formats supported by the --format flag.
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+func (chg change) MarshalText() ([]byte, error) {
+	return []byte(chg.String()), nil
+}
+
+func (sv SemanticVersion) MarshalText() ([]byte, error) {
+	return []byte(sv.String()), nil
+}
+
+func (chg change) String() string {
+	switch chg {
+	case noChange:
+		return "none"
+	case justPatch:
+		return "patch"
+	case somethingNew:
+		return "new"
+	case breakingChange:
+		return "breaking"
+	default:
+		return fmt.Sprintf("change(%d)", int(chg))
+	}
+}
+
+// finding explains a single difference in the exported API, along with the change
+// it leads to.
+type finding struct {
+	Symbol string         `json:"symbol"`
+	Kind   string         `json:"kind"`
+	Change change         `json:"change"`
+	Reason string         `json:"reason"`
+	OldPos token.Position `json:"-"`
+	NewPos token.Position `json:"-"`
+	// Platforms lists the platforms the finding applies to, it is empty if the finding
+	// applies to all platforms compared.
+	Platforms []string `json:"platforms,omitempty"`
+	// Stability is the stability annotation of the symbol, which lowered the change, see
+	// exemptChange.
+	Stability string `json:"stability,omitempty"`
+}
+
+// position is the JSON representation of token.Position.
+type position struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+func jsonPosition(pos token.Position) *position {
+	if !pos.IsValid() {
+		return nil
+	}
+	return &position{File: pos.Filename, Line: pos.Line, Column: pos.Column}
+}
+
+func (f *finding) MarshalJSON() ([]byte, error) {
+	// Avoid infinite recursion by marshaling a type without the MarshalJSON method.
+	type plainFinding finding
+	return json.Marshal(struct {
+		*plainFinding
+		OldPos *position `json:"old_pos,omitempty"`
+		NewPos *position `json:"new_pos,omitempty"`
+	}{
+		plainFinding: (*plainFinding)(f),
+		OldPos:       jsonPosition(f.OldPos),
+		NewPos:       jsonPosition(f.NewPos),
+	})
+}
+
+// Pos returns the position in the new version of the code, or the position in the
+// old version if the symbol no longer exists.
+func (f *finding) Pos() token.Position {
+	if f.NewPos.IsValid() {
+		return f.NewPos
+	}
+	return f.OldPos
+}
+
+func (f *finding) String() string {
+	chg := f.Change.String()
+	if len(f.Platforms) > 0 {
+		chg += " on " + strings.Join(f.Platforms, ", ")
+	}
+	if f.Stability != "" {
+		chg += ", " + f.Stability
+	}
+	if pos := f.Pos(); pos.IsValid() {
+		return fmt.Sprintf("%s: %s (%s)", pos, f.Reason, chg)
+	}
+	return fmt.Sprintf("%s (%s)", f.Reason, chg)
+}
+
+// packageDiff holds the findings in a single package, which is identified by its
+// directory.
+type packageDiff struct {
+	Dir      string     `json:"dir"`
+	Change   change     `json:"change"`
+	Findings []*finding `json:"findings"`
+}
+
+// report holds the findings in all changed packages, Change is the highest level of
+// change found, which upgrades Old to Next.
+type report struct {
+	Module   *module         `json:"module,omitempty"`
+	Old      SemanticVersion `json:"old"`
+	Next     SemanticVersion `json:"next"`
+	Change   change          `json:"change"`
+	Packages []*packageDiff  `json:"packages"`
+	// Commits holds the Conventional Commits taken into account with --commits.
+	Commits []*commit `json:"commits,omitempty"`
+	// Commands holds the cobra commands updated with --commands.
+	Commands []*commandVersion `json:"commands,omitempty"`
+}
+
+func newReport() *report {
+	return &report{Packages: []*packageDiff{}}
+}
+
+func (r *report) add(pkg *packageDiff) {
+	r.Packages = append(r.Packages, pkg)
+	if pkg.Change > r.Change {
+		r.Change = pkg.Change
+	}
+}
+
+// explain writes every finding of r to w, package by package in the order of their
+// directories, with the most significant findings of each package first.
+func (r *report) explain(w io.Writer) error {
+	for _, pkg := range r.Packages {
+		for _, f := range pkg.Findings {
+			if _, err := fmt.Fprintln(w, f); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range r.Commits {
+		if _, err := fmt.Fprintln(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tag returns the tag of the next version, which is prefixed for modules in subdirectories.
+func (r *report) tag() string {
+	return r.Module.tagPrefix() + r.Next.String()
+}
+
+// writeText writes the tag of the next version to w, or each updated command in the
+// --commands mode.
+func (r *report) writeText(w io.Writer) error {
+	if r.Commands == nil {
+		_, err := fmt.Fprintln(w, r.tag())
+		return err
+	}
+	for _, c := range r.Commands {
+		if _, err := fmt.Fprintln(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *report) writeJSON(w io.Writer) error {
+	return writeJSON(w, r)
+}
+
+func writeJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// differ compares declarations from the old and new versions of a package, and
+// records every difference it finds.
+type differ struct {
+	oldFset  *token.FileSet
+	newFset  *token.FileSet
+	findings []*finding
+	// constValues compares the values of constants, see detectOptions.ConstValues.
+	constValues bool
+	// oldAnnotations and newAnnotations hold the annotations of the symbols of both
+	// versions, which exempt the findings of experimental and unstable symbols.
+	oldAnnotations annotations
+	newAnnotations annotations
+}
+
+func (d *differ) record(chg change, kind string, symbol string, oldNode, newNode ast.Node, format string, args ...any) {
+	d.recordAt(chg, kind, symbol, nodePos(d.oldFset, oldNode), nodePos(d.newFset, newNode), format, args...)
+}
+
+func (d *differ) recordAt(chg change, kind string, symbol string, oldPos, newPos token.Position, format string, args ...any) {
+	stability := d.stability(symbol)
+	d.findings = append(d.findings, &finding{
+		Symbol:    symbol,
+		Kind:      kind,
+		Change:    exemptChange(stability, chg),
+		Reason:    fmt.Sprintf(format, args...),
+		OldPos:    oldPos,
+		NewPos:    newPos,
+		Stability: stability,
+	})
+}
+
+// result sorts the recorded findings and sums them up as a packageDiff; a package
+// without any findings still has its files changed, which is considered a patch.
+func (d *differ) result() *packageDiff {
+	sortFindings(d.findings)
+	pkg := &packageDiff{Change: justPatch, Findings: d.findings}
+	if pkg.Findings == nil {
+		pkg.Findings = []*finding{}
+	}
+	for _, f := range d.findings {
+		if f.Change > pkg.Change {
+			pkg.Change = f.Change
+		}
+	}
+	return pkg
+}
+
+func sortFindings(findings []*finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		x, y := findings[i], findings[j]
+		if x.Change != y.Change {
+			return x.Change > y.Change
+		}
+		xPos, yPos := x.Pos(), y.Pos()
+		if xPos.Filename != yPos.Filename {
+			return xPos.Filename < yPos.Filename
+		}
+		if xPos.Line != yPos.Line {
+			return xPos.Line < yPos.Line
+		}
+		if xPos.Column != yPos.Column {
+			return xPos.Column < yPos.Column
+		}
+		return x.Reason < y.Reason
+	})
+}
+
+func nodePos(fset *token.FileSet, node ast.Node) token.Position {
+	// Beware of nil pointers wrapped in a non-nil ast.Node.
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return token.Position{}
+	}
+	return fset.Position(node.Pos())
+}
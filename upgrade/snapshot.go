@@ -0,0 +1,626 @@
+package upgrade
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"golang.org/x/tools/go/ast/astutil"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	apiDir string
+)
+
+var snapshotCommand = &cobra.Command{
+	Use:   "snapshot [version]",
+	Short: "Write a snapshot of the exported API of each package.",
+	Long: "Write a snapshot of the exported API of each package to api/<dir>/<pkg>.txt, the version defaults to the " +
+		"latest semantic version tag.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		var version SemanticVersion
+		if len(args) > 0 {
+			if version, err = parse(args[0]); err != nil {
+				return err
+			}
+		} else if _, version, err = latestTag("HEAD", ""); err != nil {
+			return err
+		}
+		dirs, err := packageDirs(".", include, exclude)
+		if err != nil {
+			return err
+		}
+		platforms, err := parsePlatforms(platformSpecs)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(apiDir, 0755); err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			pkgName, decls, err := loadPackageDecls(workTree{}, dir)
+			if err != nil {
+				return err
+			}
+			// A package with constrained files gets a snapshot for each platform, so that
+			// check compares the files built on each platform with their own snapshot.
+			snapshots := []*apiSnapshot{{Version: version, Dir: dir, Decls: decls}}
+			if len(platforms) > 0 && decls.hasConstraints() {
+				snapshots = snapshots[:0]
+				for i := range platforms {
+					snapshots = append(snapshots, &apiSnapshot{
+						Version:  version,
+						Dir:      dir,
+						Platform: &platforms[i],
+						Decls:    decls.forPlatform(platforms[i]),
+					})
+				}
+			}
+			for _, snapshot := range snapshots {
+				var buf bytes.Buffer
+				if err = writeSnapshot(&buf, snapshot, pkgName); err != nil {
+					return err
+				}
+				file := filepath.Join(apiDir, snapshotName(dir, pkgName, snapshot.Platform))
+				if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+					return err
+				}
+				if err = os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
+
+var checkCommand = &cobra.Command{
+	Use:   "check version",
+	Short: "Check that the exported API only changes in the way the proposed version allows.",
+	Long: "Compare the exported API of each package with the snapshots in api/, and fail if the changes require " +
+		"a higher upgrade than from the version of the snapshots to the proposed version.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		proposed, err := parse(args[0])
+		if err != nil {
+			return err
+		}
+		snapshots, err := snapshotFiles(apiDir)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("no snapshot found in %q, please run \"goturbo upgrade snapshot\" first", apiDir)
+		}
+		dirs, err := packageDirs(".", include, exclude)
+		if err != nil {
+			return err
+		}
+		pol, err := loadPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+		platforms, err := parsePlatforms(platformSpecs)
+		if err != nil {
+			return err
+		}
+		var (
+			rep      = newReport()
+			violated []*finding
+			checked  = make(map[string]bool)
+			// platformSnapshots holds the snapshots taken for each platform by directory.
+			platformSnapshots = make(map[string][]*apiSnapshot)
+			opts              = &detectOptions{Platforms: platforms, ConstValues: constValues, Policy: pol}
+		)
+		// Each package is checked against the version of its snapshots, rep.Old holds the
+		// lowest one.
+		checkPackage := func(version SemanticVersion, pkg *packageDiff) {
+			pol.applyPackage(pkg)
+			rep.add(pkg)
+			allowed := allowedChange(version, proposed)
+			for _, f := range pkg.Findings {
+				if f.Change > allowed {
+					violated = append(violated, f)
+				}
+			}
+			if !rep.Old.Valid() || version.Compare(rep.Old) < 0 {
+				rep.Old = version
+			}
+		}
+		for _, file := range snapshots {
+			snapshot, err := readSnapshot(file)
+			if err != nil {
+				return err
+			}
+			if !matchDir(snapshot.Dir, include, exclude) {
+				continue
+			}
+			checked[snapshot.Dir] = true
+			if snapshot.Platform != nil {
+				platformSnapshots[snapshot.Dir] = append(platformSnapshots[snapshot.Dir], snapshot)
+				continue
+			}
+			_, newDecls, err := loadPackageDecls(workTree{}, snapshot.Dir)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			pkg := diffPlatforms(snapshot.Decls, newDecls, opts)
+			pkg.Dir = snapshot.Dir
+			checkPackage(snapshot.Version, pkg)
+		}
+		for _, dir := range sortedKeys(platformSnapshots) {
+			_, newDecls, err := loadPackageDecls(workTree{}, dir)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			var (
+				version           SemanticVersion
+				snapshotPlatforms []platform
+				results           [][]*finding
+			)
+			for _, snapshot := range platformSnapshots[dir] {
+				if !version.Valid() || snapshot.Version.Compare(version) < 0 {
+					version = snapshot.Version
+				}
+				p := *snapshot.Platform
+				snapshotPlatforms = append(snapshotPlatforms, p)
+				results = append(results, diffDecls(snapshot.Decls, newDecls.forPlatform(p), opts).Findings)
+			}
+			d := &differ{findings: mergeFindings(snapshotPlatforms, results)}
+			pkg := d.result()
+			pkg.Dir = dir
+			checkPackage(version, pkg)
+		}
+		// Packages without snapshots are new packages, which only add to the API.
+		for _, dir := range dirs {
+			if !checked[dir] {
+				if allowed := allowedChange(rep.Old, proposed); allowed < somethingNew {
+					violated = append(violated, &finding{
+						Symbol: dir,
+						Kind:   kindAdded,
+						Change: somethingNew,
+						Reason: fmt.Sprintf("added package %s", dir),
+					})
+				}
+			}
+		}
+		if len(violated) == 0 {
+			return nil
+		}
+		sortFindings(violated)
+		for _, f := range violated {
+			fmt.Fprintln(cmd.ErrOrStderr(), f)
+		}
+		return fmt.Errorf("the API changes above are not allowed when upgrading from %s to %s", rep.Old, proposed)
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{snapshotCommand, checkCommand} {
+		cmd.Flags().StringVar(&apiDir, "dir", "api", "directory holding the API snapshots")
+	}
+}
+
+// allowedChange returns the highest level of change allowed when upgrading from old to next.
+func allowedChange(old, next SemanticVersion) change {
+	switch {
+	case next.Compare(old) <= 0:
+		return noChange
+	case next.Major > old.Major:
+		return breakingChange
+	case next.Minor > old.Minor:
+		if old.Major == 0 {
+			// Before v1.0.0, breaking changes only increase the Minor Version number.
+			return breakingChange
+		}
+		return somethingNew
+	case next.Patch > old.Patch:
+		return justPatch
+	default:
+		// Both versions lead to the same normal version, so old is a pre-release, and the
+		// change it was made for is allowed.
+		return old.impliedChange()
+	}
+}
+
+// packageDirs lists the directories under root containing importable packages, skipping
+// those ignored by the go tool, internal directories, commands, and directories rejected
+// by the include and exclude patterns.
+func packageDirs(root string, include, exclude []string) ([]string, error) {
+	var (
+		dirs []string
+		seen = make(map[string]bool)
+	)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name := entry.Name(); path != root &&
+				(strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+					name == "testdata" || name == "vendor" || name == "internal") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if dir := filepath.Dir(path); isPackageFile(path) && !seen[dir] {
+			// The package name of a single file tells whether the package is a command,
+			// unless the file is never built, see packageName.
+			f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly|parser.ParseComments)
+			if err != nil {
+				return err
+			}
+			if isIgnored(path, f) {
+				return nil
+			}
+			seen[dir] = true
+			if f.Name.Name != "main" && matchDir(dir, include, exclude) {
+				dirs = append(dirs, dir)
+			}
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// isPackageFile reports whether file is a .go file contributing to the API of its package.
+func isPackageFile(file string) bool {
+	return filepath.Ext(file) == ".go" && !isTestFile(file)
+}
+
+// loadPackageDecls parses the files of the package in dir, and returns its name along with
+// its exported declarations.
+func loadPackageDecls(src source, dir string) (string, *declSet, error) {
+	decls := newDeclSet()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", decls, err
+	}
+	for _, entry := range entries {
+		if file := filepath.Join(dir, entry.Name()); !entry.IsDir() && isPackageFile(file) {
+			content, err := src.ReadFile(file)
+			if err != nil {
+				return "", nil, err
+			}
+			if err = decls.parseFile(file, content); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return packageName(decls.Fset, decls.Files), decls, nil
+}
+
+// snapshotName returns the path of the snapshot of the package in dir, taken on p unless p
+// is nil, relative to the directory of the snapshots. The directory tree of the packages is
+// mirrored, since flattening the directories into a file name, such as "a_b" for both "a/b"
+// and "a_b", may give different packages the same name.
+func snapshotName(dir string, pkgName string, p *platform) string {
+	name := pkgName
+	if p != nil {
+		name += "_" + p.GOOS + "_" + p.GOARCH
+	}
+	return filepath.Join(dir, name+".txt")
+}
+
+// snapshotFiles lists the snapshots in dir and its subdirectories, none if dir does not
+// exist.
+func snapshotFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && filepath.Ext(path) == ".txt" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return files, err
+}
+
+const (
+	snapshotVersionPrefix  = "// version: "
+	snapshotDirPrefix      = "// dir: "
+	snapshotPlatformPrefix = "// platform: "
+)
+
+// apiSnapshot is the content of a snapshot file.
+type apiSnapshot struct {
+	Version SemanticVersion
+	Dir     string
+	// Platform is the platform the declarations are taken on, it is nil if they are taken
+	// from all the files of the package.
+	Platform *platform
+	Decls    *declSet
+}
+
+// writeSnapshot writes the exported declarations in decls, along with the unexported types
+// embedded in exported ones, as Go source code without function bodies and unexported struct
+// fields, so that the snapshot can be parsed again to be compared with by the same rules. The
+// stability and deprecation annotations of the declarations are kept as comments, but not
+// those of struct fields and interface methods.
+func writeSnapshot(w *bytes.Buffer, snapshot *apiSnapshot, pkgName string) error {
+	fmt.Fprintln(w, "// Code generated by goturbo upgrade snapshot. DO NOT EDIT.")
+	fmt.Fprintln(w, snapshotVersionPrefix+snapshot.Version.String())
+	fmt.Fprintln(w, snapshotDirPrefix+filepath.ToSlash(snapshot.Dir))
+	if snapshot.Platform != nil {
+		fmt.Fprintln(w, snapshotPlatformPrefix+snapshot.Platform.String())
+	}
+	fmt.Fprintln(w)
+	decls := snapshot.Decls
+	fmt.Fprintf(w, "package %s\n", pkgName)
+	var (
+		nodes    []ast.Node
+		comments [][]string
+	)
+	// The unexported types embedded by exported types are kept for the members they
+	// promote, see packageMembers.
+	typeSpecs := maps.Clone(decls.Types)
+	members := newPackageMembers(decls.packageFiles())
+	for _, name := range members.embeddedTypes() {
+		typeSpecs[name] = members.types[name]
+	}
+	for _, key := range sortedKeys(typeSpecs) {
+		typeSpec := *typeSpecs[key]
+		typeSpec.Doc, typeSpec.Comment = nil, nil
+		if structType, ok := typeSpec.Type.(*ast.StructType); ok {
+			typeSpec.Type = exportedStruct(structType)
+		}
+		nodes = append(nodes, &ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{&typeSpec}})
+		comments = append(comments, decls.Annotations[key].comments())
+	}
+	var (
+		printed  []*ast.ValueSpec
+		explicit = explicitConsts(decls.Files)
+	)
+	for _, key := range sortedKeys(decls.Vars) {
+		varSpec := decls.Vars[key]
+		if slices.Contains(printed, varSpec) {
+			continue
+		}
+		printed = append(printed, varSpec)
+		ident := valueIdent(key, varSpec)
+		if spec, ok := explicit[varSpec]; ok {
+			varSpec = spec
+		}
+		tok := token.VAR
+		if valueKind(ident) == "const" {
+			tok = token.CONST
+		}
+		var values []ast.Expr
+		for _, value := range varSpec.Values {
+			values = append(values, snapshotValue(value))
+		}
+		nodes = append(nodes, &ast.GenDecl{Tok: tok, Specs: []ast.Spec{&ast.ValueSpec{
+			Names:  varSpec.Names,
+			Type:   varSpec.Type,
+			Values: values,
+		}}})
+		comments = append(comments, decls.Annotations[ident.Name].comments())
+	}
+	for _, key := range sortedKeys(decls.Funcs) {
+		funcDecl := *decls.Funcs[key]
+		funcDecl.Doc, funcDecl.Body = nil, nil
+		nodes = append(nodes, &funcDecl)
+		name := funcDecl.Name.Name
+		if id := methodID(&funcDecl); id != "" {
+			name = id
+		}
+		comments = append(comments, decls.Annotations[name].comments())
+	}
+	for i, node := range nodes {
+		fmt.Fprintln(w)
+		for _, comment := range comments[i] {
+			fmt.Fprintln(w, comment)
+		}
+		// Positions are discarded, otherwise the printer would keep the gaps left by removed
+		// comments and fields.
+		if err := format.Node(w, token.NewFileSet(), cloneNode(node)); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// explicitConsts returns copies of the const specs in files which depend on their place in
+// a const declaration, that is the specs repeating the type and expressions of a previous one
+// and those using iota past the first spec, with these made explicit and iota replaced by its
+// value, so that the specs can be written on their own.
+func explicitConsts(files []*ast.File) map[*ast.ValueSpec]*ast.ValueSpec {
+	specs := make(map[*ast.ValueSpec]*ast.ValueSpec)
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.CONST {
+				continue
+			}
+			var (
+				typ    ast.Expr
+				values []ast.Expr
+			)
+			for i, spec := range genDecl.Specs {
+				valueSpec := spec.(*ast.ValueSpec)
+				if len(valueSpec.Values) > 0 {
+					typ, values = valueSpec.Type, valueSpec.Values
+				}
+				if i == 0 {
+					continue
+				}
+				explicit := &ast.ValueSpec{Names: valueSpec.Names, Type: typ}
+				for _, value := range values {
+					explicit.Values = append(explicit.Values, replaceIota(value, i))
+				}
+				specs[valueSpec] = explicit
+			}
+		}
+	}
+	return specs
+}
+
+// replaceIota returns a copy of expr with iota replaced by the given value.
+func replaceIota(expr ast.Expr, value int) ast.Expr {
+	return astutil.Apply(cloneNode(expr), func(c *astutil.Cursor) bool {
+		if ident, ok := c.Node().(*ast.Ident); ok && ident.Name == "iota" {
+			c.Replace(&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(value)})
+		}
+		return true
+	}, nil).(ast.Expr)
+}
+
+// snapshotValue returns a copy of an initializer with function bodies and the elements of
+// composite literals removed, which keeps what the type of the value can be told from.
+func snapshotValue(expr ast.Expr) ast.Expr {
+	return astutil.Apply(cloneNode(expr), func(c *astutil.Cursor) bool {
+		switch node := c.Node().(type) {
+		case *ast.FuncLit:
+			c.Replace(&ast.FuncLit{Type: node.Type, Body: &ast.BlockStmt{}})
+			return false
+		case *ast.CompositeLit:
+			c.Replace(&ast.CompositeLit{Type: node.Type})
+			return false
+		}
+		return true
+	}, nil).(ast.Expr)
+}
+
+// exportedStruct returns a copy of structType with unexported named fields removed.
+func exportedStruct(structType *ast.StructType) *ast.StructType {
+	fields := &ast.FieldList{Opening: structType.Fields.Opening, Closing: structType.Fields.Closing}
+	for _, field := range structType.Fields.List {
+		if field.Names == nil {
+			fields.List = append(fields.List, field)
+			continue
+		}
+		var names []*ast.Ident
+		for _, name := range field.Names {
+			if name.IsExported() {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			exported := *field
+			exported.Names = names
+			fields.List = append(fields.List, &exported)
+		}
+	}
+	return &ast.StructType{Struct: structType.Struct, Fields: fields}
+}
+
+// readSnapshot parses a snapshot written by writeSnapshot.
+func readSnapshot(file string) (*apiSnapshot, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		snapshot     = &apiSnapshot{}
+		versionFound bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := strings.CutPrefix(line, snapshotVersionPrefix); ok {
+			if snapshot.Version, err = parse(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			versionFound = true
+		} else if d, ok := strings.CutPrefix(line, snapshotDirPrefix); ok {
+			snapshot.Dir = filepath.FromSlash(d)
+		} else if spec, ok := strings.CutPrefix(line, snapshotPlatformPrefix); ok {
+			platforms, err := parsePlatforms([]string{spec})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			snapshot.Platform = &platforms[0]
+		} else if !strings.HasPrefix(line, "//") {
+			break
+		}
+	}
+	if !versionFound || snapshot.Dir == "" {
+		return nil, fmt.Errorf("%s: not an API snapshot", file)
+	}
+	snapshot.Decls = newDeclSet()
+	if err = snapshot.Decls.parseFile(file, content); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+var (
+	posType    = reflect.TypeOf(token.NoPos)
+	objectType = reflect.TypeOf((*ast.Object)(nil))
+)
+
+// cloneNode deep copies an AST node with all positions discarded, identifiers in the copy
+// are no longer resolved to objects.
+func cloneNode[N ast.Node](node N) N {
+	return cloneValue(reflect.ValueOf(node)).Interface().(N)
+}
+
+func cloneValue(v reflect.Value) reflect.Value {
+	switch {
+	case v.Type() == posType, v.Type() == objectType:
+		return reflect.Zero(v.Type())
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(cloneValue(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(cloneValue(v.Elem()))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(cloneValue(v.Index(i)))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if !c.Field(i).CanSet() {
+				continue
+			}
+			// Whether TypeSpec.Assign and ChanType.Arrow are valid is meaningful, they
+			// are replaced with a valid position instead of being discarded.
+			if name := v.Type().Field(i).Name; (name == "Assign" || name == "Arrow") &&
+				v.Field(i).Type() == posType && v.Field(i).Interface().(token.Pos).IsValid() {
+				c.Field(i).Set(reflect.ValueOf(token.Pos(1)))
+				continue
+			}
+			c.Field(i).Set(cloneValue(v.Field(i)))
+		}
+		return c
+	default:
+		return v
+	}
+}
@@ -0,0 +1,192 @@
+package upgrade
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+// The stability annotations of symbols. An experimental symbol, documented with a paragraph
+// starting with "Experimental:", may be broken in a minor version; an unstable symbol,
+// marked with a "//goturbo:unstable" directive, may change in any way.
+const (
+	stabilityExperimental = "experimental"
+	stabilityUnstable     = "unstable"
+)
+
+const unstableDirective = "//goturbo:unstable"
+
+// annotation holds what the doc comment of a symbol says about its compatibility.
+type annotation struct {
+	// Kind is the kind of the symbol, such as "func" or "field".
+	Kind       string
+	Stability  string
+	Deprecated bool
+	Pos        token.Position
+}
+
+// annotations maps the exported symbols of a package to their annotations, by the names
+// used in findings, where methods are named "T.M" regardless of their receivers; symbols
+// without any annotation are present as well.
+type annotations map[string]annotation
+
+// inspectAnnotations adds the annotations of the exported symbols in file to as.
+func inspectAnnotations(fset *token.FileSet, file *ast.File, as annotations) {
+	add := func(symbol, kind string, node ast.Node, docs ...*ast.CommentGroup) {
+		a := parseAnnotation(docs...)
+		a.Kind, a.Pos = kind, fset.Position(node.Pos())
+		as[symbol] = a
+	}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					if !spec.Name.IsExported() {
+						continue
+					}
+					name := spec.Name.Name
+					add(name, "type", spec, decl.Doc, spec.Doc)
+					inspectMemberAnnotations(name, spec.Type, add)
+				case *ast.ValueSpec:
+					for _, ident := range spec.Names {
+						if ident.IsExported() {
+							add(ident.Name, decl.Tok.String(), ident, decl.Doc, spec.Doc)
+						}
+					}
+				}
+			}
+		case *ast.FuncDecl:
+			if !decl.Name.IsExported() {
+				continue
+			}
+			name := decl.Name.Name
+			if id := methodID(decl); id != "" {
+				name = id
+			}
+			add(name, funcKind(decl), decl, decl.Doc)
+		}
+	}
+}
+
+// inspectMemberAnnotations adds the annotations of the exported fields of a struct type,
+// or of the methods of an interface type, named typeName.
+func inspectMemberAnnotations(typeName string, typ ast.Expr, add func(string, string, ast.Node, ...*ast.CommentGroup)) {
+	var (
+		fields *ast.FieldList
+		kind   string
+	)
+	switch typ := typ.(type) {
+	case *ast.StructType:
+		fields, kind = typ.Fields, "field"
+	case *ast.InterfaceType:
+		fields, kind = typ.Methods, "method"
+	default:
+		return
+	}
+	for _, field := range fields.List {
+		for _, name := range field.Names {
+			if name.IsExported() {
+				add(typeName+"."+name.Name, kind, name, field.Doc)
+			}
+		}
+	}
+}
+
+// parseAnnotation reads the stability and deprecation annotations in the doc comments of a
+// symbol. As with "Deprecated:", the "Experimental:" annotation must start a paragraph.
+func parseAnnotation(docs ...*ast.CommentGroup) annotation {
+	var a annotation
+	for _, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		for _, comment := range doc.List {
+			if comment.Text == unstableDirective || strings.HasPrefix(comment.Text, unstableDirective+" ") {
+				a.Stability = stabilityUnstable
+			}
+		}
+		for _, paragraph := range strings.Split(doc.Text(), "\n\n") {
+			switch {
+			case strings.HasPrefix(paragraph, "Deprecated:"):
+				a.Deprecated = true
+			case strings.HasPrefix(paragraph, "Experimental:") && a.Stability == "":
+				a.Stability = stabilityExperimental
+			}
+		}
+	}
+	return a
+}
+
+// stability returns the stability of symbol, which is the one of the type it belongs to
+// unless it is annotated itself, and whether symbol or its type is in as.
+func (as annotations) stability(symbol string) (string, bool) {
+	symbol = strings.NewReplacer("(*", "", ")", "").Replace(symbol)
+	a, ok := as[symbol]
+	if a.Stability != "" {
+		return a.Stability, true
+	}
+	if typeName, _, found := strings.Cut(symbol, "."); found {
+		if owner, ownerOK := as[typeName]; ownerOK {
+			return owner.Stability, true
+		}
+	}
+	return "", ok
+}
+
+// comments returns the comment lines which annotate a declaration as a.
+func (a annotation) comments() []string {
+	var lines []string
+	switch a.Stability {
+	case stabilityExperimental:
+		lines = append(lines, "// Experimental: exempt from compatibility guarantees.")
+	case stabilityUnstable:
+		lines = append(lines, unstableDirective)
+	}
+	if a.Deprecated {
+		if len(lines) > 0 {
+			// Both annotations must start a paragraph.
+			lines = append(lines, "//")
+		}
+		lines = append(lines, "// Deprecated: see the source.")
+	}
+	return lines
+}
+
+// exemptChange lowers chg to the highest level of change allowed for a symbol of the given
+// stability: changes of experimental symbols are minor at most, and those of unstable ones
+// are ignored.
+func exemptChange(stability string, chg change) change {
+	switch stability {
+	case stabilityExperimental:
+		return min(chg, somethingNew)
+	case stabilityUnstable:
+		return noChange
+	default:
+		return chg
+	}
+}
+
+// stability returns the stability of symbol as annotated in the old version of the
+// package, or in the new one if symbol did not exist before, so that marking a symbol as
+// experimental does not excuse breaking it in the same version.
+func (d *differ) stability(symbol string) string {
+	if stability, ok := d.oldAnnotations.stability(symbol); ok {
+		return stability
+	}
+	stability, _ := d.newAnnotations.stability(symbol)
+	return stability
+}
+
+// deprecationDiff records the symbols which were deprecated between the old and new
+// versions of the package, which is a minor change.
+func (d *differ) deprecationDiff() {
+	for _, symbol := range sortedKeys(d.newAnnotations) {
+		newAnnotation := d.newAnnotations[symbol]
+		if oldAnnotation, ok := d.oldAnnotations[symbol]; ok && !oldAnnotation.Deprecated && newAnnotation.Deprecated {
+			d.recordAt(somethingNew, kindDeprecated, symbol, oldAnnotation.Pos, newAnnotation.Pos,
+				"deprecated %s %s", newAnnotation.Kind, symbol)
+		}
+	}
+}
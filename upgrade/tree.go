@@ -0,0 +1,276 @@
+package upgrade
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	xmodule "golang.org/x/mod/module"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fileTree reads files from a tree of files outside of git, such as a directory, an
+// exported source tarball, or a module zip.
+type fileTree struct {
+	fsys fs.FS
+	// root is the directory of the tree on disk, it is empty for zips, which have to be
+	// extracted for type checking.
+	root string
+	// Version is the version of a module zip, taken from the "module@version" directory
+	// all of its files are in.
+	Version SemanticVersion
+}
+
+func (t *fileTree) ReadFile(name string) ([]byte, error) {
+	src, err := fs.ReadFile(t.fsys, filepath.ToSlash(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w in file tree", ErrFileDoesNotExist)
+	}
+	return src, err
+}
+
+func (t *fileTree) ReadDir(name string) ([]string, error) {
+	entries, err := fs.ReadDir(t.fsys, filepath.ToSlash(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, filepath.Join(name, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// goFiles lists the .go files in t, skipping the directories ignored by the go tool.
+func (t *fileTree) goFiles() (map[string]bool, error) {
+	files := make(map[string]bool)
+	err := fs.WalkDir(t.fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if base := entry.Name(); name != "." &&
+				(strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") || base == "testdata" || base == "vendor") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if path.Ext(name) == ".go" {
+			files[filepath.FromSlash(name)] = true
+		}
+		return nil
+	})
+	return files, err
+}
+
+// extract writes the files of t into dir.
+func (t *fileTree) extract(dir string) error {
+	return fs.WalkDir(t.fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(t.fsys, name)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(file, content, 0644)
+	})
+}
+
+// openTree opens the file tree given to --old or --new, which is one of:
+//
+//   - a directory;
+//   - a zip file, such as a module zip;
+//   - a tarball ending with .tar, .tar.gz or .tgz;
+//   - a module version such as "example.com/m@v1.2.3", whose zip is looked up in the
+//     file:// entries of GOPROXY and in the module cache, without network access.
+//
+// Archives with all of their files in a single directory are opened at that directory.
+func openTree(spec string) (tree *fileTree, cleanup func(), err error) {
+	if info, err := os.Stat(spec); err == nil && info.IsDir() {
+		return &fileTree{fsys: os.DirFS(spec), root: spec}, func() {}, nil
+	}
+	switch lower := strings.ToLower(spec); {
+	case strings.HasSuffix(lower, ".zip"):
+		return openZip(spec)
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return openTarball(spec)
+	case strings.Contains(spec, "@"):
+		modulePath, version, _ := strings.Cut(spec, "@")
+		zipFile, err := proxyZip(modulePath, version)
+		if err != nil {
+			return nil, nil, err
+		}
+		return openZip(zipFile)
+	default:
+		return nil, nil, fmt.Errorf("%q is neither a directory, an archive nor a module version", spec)
+	}
+}
+
+func openZip(file string) (*fileTree, func(), error) {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree := &fileTree{fsys: zr}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if top := topDir(names); top != "" {
+		if tree.fsys, err = fs.Sub(zr, top); err != nil {
+			zr.Close()
+			return nil, nil, err
+		}
+		if _, version, ok := strings.Cut(top, "@"); ok {
+			tree.Version, _ = parseTag(version, "")
+		}
+	}
+	return tree, func() { zr.Close() }, nil
+}
+
+func openTarball(file string) (*fileTree, func(), error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = bytes.NewReader(content)
+	if !strings.HasSuffix(strings.ToLower(file), ".tar") {
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, nil, err
+		}
+	}
+	dir, err := os.MkdirTemp("", "goturbo-upgrade-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	if err = extractTar(r, dir); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	root := dir
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(dir, entries[0].Name())
+	}
+	return &fileTree{fsys: os.DirFS(root), root: root}, cleanup, nil
+}
+
+// topDir returns the directory containing all of names, if there is such a directory. The
+// directory of a module zip is the module path followed by "@" and the version, other
+// directories consist of a single path element.
+func topDir(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	top, _, ok := strings.Cut(names[0], "/")
+	if i := strings.Index(names[0], "@"); i >= 0 {
+		if j := strings.Index(names[0][i:], "/"); j >= 0 {
+			top, ok = names[0][:i+j], true
+		}
+	}
+	if !ok {
+		return ""
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, top+"/") {
+			return ""
+		}
+	}
+	return top
+}
+
+// proxyZip looks up the zip of a module version in the file:// entries of GOPROXY, and in
+// the download cache of the module cache, which has the same layout.
+func proxyZip(modulePath, version string) (string, error) {
+	escapedPath, err := xmodule.EscapePath(modulePath)
+	if err != nil {
+		return "", err
+	}
+	escapedVersion, err := xmodule.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	var proxies []string
+	for _, proxy := range strings.FieldsFunc(os.Getenv("GOPROXY"), func(ch rune) bool { return ch == ',' || ch == '|' }) {
+		if u, err := url.Parse(proxy); err == nil && u.Scheme == "file" {
+			proxies = append(proxies, filepath.FromSlash(u.Path))
+		}
+	}
+	if modCache := moduleCache(); modCache != "" {
+		proxies = append(proxies, filepath.Join(modCache, "cache", "download"))
+	}
+	for _, proxy := range proxies {
+		zipFile := filepath.Join(proxy, filepath.FromSlash(escapedPath), "@v", escapedVersion+".zip")
+		if _, err := os.Stat(zipFile); err == nil {
+			return zipFile, nil
+		}
+	}
+	return "", fmt.Errorf("zip of %s@%s not found in the file:// entries of GOPROXY or in the module cache", modulePath, version)
+}
+
+// moduleCache returns the directory of the module cache, following the rules of the go
+// command for GOMODCACHE.
+func moduleCache() string {
+	if modCache := os.Getenv("GOMODCACHE"); modCache != "" {
+		return modCache
+	}
+	if gopath := filepath.SplitList(os.Getenv("GOPATH")); len(gopath) > 0 && gopath[0] != "" {
+		return filepath.Join(gopath[0], "pkg", "mod")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, "go", "pkg", "mod")
+	}
+	return ""
+}
+
+// treeChangedFiles lists the .go files that differ between two file trees.
+func treeChangedFiles(oldTree, newTree *fileTree) ([]changedFile, error) {
+	oldFiles, err := oldTree.goFiles()
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := newTree.goFiles()
+	if err != nil {
+		return nil, err
+	}
+	var files []changedFile
+	for _, name := range sortedKeys(oldFiles) {
+		if !newFiles[name] {
+			files = append(files, changedFile{Old: name})
+			continue
+		}
+		oldSrc, err := oldTree.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		newSrc, err := newTree.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(oldSrc, newSrc) {
+			files = append(files, changedFile{Old: name, New: name})
+		}
+	}
+	for _, name := range sortedKeys(newFiles) {
+		if !oldFiles[name] {
+			files = append(files, changedFile{New: name})
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,1017 @@
+package upgrade
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/packages"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// checkout places the files of src in a directory on disk, which is required for loading
+// packages with go/packages, and returns the root of that directory.
+func checkout(src source) (root string, cleanup func(), err error) {
+	switch src := src.(type) {
+	case workTree:
+		return ".", func() {}, nil
+	case gitRevision:
+		root, err = os.MkdirTemp("", "goturbo-upgrade-")
+		if err != nil {
+			return "", nil, err
+		}
+		cleanup = func() { os.RemoveAll(root) }
+		if err = gitArchive(string(src), root); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		return root, cleanup, nil
+	case *fileTree:
+		if src.root != "" {
+			return src.root, func() {}, nil
+		}
+		root, err = os.MkdirTemp("", "goturbo-upgrade-")
+		if err != nil {
+			return "", nil, err
+		}
+		cleanup = func() { os.RemoveAll(root) }
+		if err = src.extract(root); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		return root, cleanup, nil
+	default:
+		return "", nil, fmt.Errorf("type checking is not supported for %T", src)
+	}
+}
+
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if name != filepath.Clean(dir) && !strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("illegal file path in archive: %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			// Symbolic links and other special files do not contribute to the API.
+		}
+	}
+}
+
+// loadPackages type-checks the packages in dirs (relative to root) within the module in
+// moduleDir, and indexes them by directory; directories that do not exist under root are
+// skipped. The packages are built for p, or for the default platform if p is nil.
+func loadPackages(root string, moduleDir string, dirs []string, p *platform) (*token.FileSet, map[string]*packages.Package, error) {
+	var patterns []string
+	for _, dir := range dirs {
+		if info, err := os.Stat(filepath.Join(root, dir)); err == nil && info.IsDir() {
+			rel, err := filepath.Rel(moduleDir, dir)
+			if err != nil {
+				return nil, nil, err
+			}
+			patterns = append(patterns, "./"+filepath.ToSlash(rel))
+		}
+	}
+	fset := token.NewFileSet()
+	pkgMap := make(map[string]*packages.Package)
+	if len(patterns) == 0 {
+		return fset, pkgMap, nil
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps |
+			packages.NeedTypes | packages.NeedSyntax,
+		Dir:  filepath.Join(absRoot, moduleDir),
+		Fset: fset,
+	}
+	if p != nil {
+		cfg.Env = append(os.Environ(), "GOOS="+p.GOOS, "GOARCH="+p.GOARCH, "CGO_ENABLED=0")
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, pkg := range pkgs {
+		// A package without files on p has no API there.
+		if p != nil && len(pkg.Errors) > 0 && strings.Contains(pkg.Errors[0].Msg, "build constraints exclude all Go files") {
+			continue
+		}
+		if len(pkg.Errors) > 0 {
+			return nil, nil, fmt.Errorf("loading package %s: %w", pkg.PkgPath, pkg.Errors[0])
+		}
+		if len(pkg.GoFiles) == 0 || pkg.Types == nil {
+			continue
+		}
+		dir, err := filepath.Rel(absRoot, filepath.Dir(pkg.GoFiles[0]))
+		if err != nil {
+			return nil, nil, err
+		}
+		pkgMap[dir] = pkg
+	}
+	return fset, pkgMap, nil
+}
+
+// importingDirs lists the directories of the packages of the module in moduleDir under
+// root which import, directly or not, the packages in dirs, except for dirs themselves.
+func importingDirs(root string, moduleDir string, dirs []string) ([]string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports,
+		Dir:  filepath.Join(absRoot, moduleDir),
+	}
+	pkgs, err := packages.Load(cfg, "./...")
+	if err != nil {
+		return nil, err
+	}
+	var (
+		pkgDirs   = make(map[string]string)
+		importers = make(map[string][]string)
+		queue     []string
+		seen      = make(map[string]bool)
+	)
+	for _, dir := range dirs {
+		seen[filepath.Clean(dir)] = true
+	}
+	for _, pkg := range pkgs {
+		if len(pkg.GoFiles) == 0 {
+			continue
+		}
+		dir, err := filepath.Rel(absRoot, filepath.Dir(pkg.GoFiles[0]))
+		if err != nil {
+			return nil, err
+		}
+		pkgDirs[pkg.PkgPath] = dir
+		for path := range pkg.Imports {
+			importers[path] = append(importers[path], pkg.PkgPath)
+		}
+		if seen[dir] {
+			queue = append(queue, pkg.PkgPath)
+		}
+	}
+	var importing []string
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		for _, importer := range importers[path] {
+			if dir := pkgDirs[importer]; !seen[dir] {
+				seen[dir] = true
+				importing = append(importing, dir)
+				queue = append(queue, importer)
+			}
+		}
+	}
+	slices.Sort(importing)
+	return importing, nil
+}
+
+// typesDiff compares the exported objects of the packages in dirs semantically, with both
+// sides loaded by go/packages and type-checked by go/types within the module in moduleDir,
+// once for each platform of opts. The unchanged packages importing those in dirs are
+// compared as well, since they may embed the changed types and lose the members promoted
+// from them; they are only reported if they changed.
+func typesDiff(moduleDir string, dirs []string, oldSrc, newSrc source, opts *detectOptions) (*report, error) {
+	platforms := opts.Platforms
+	oldRoot, oldCleanup, err := checkout(oldSrc)
+	if err != nil {
+		return nil, err
+	}
+	defer oldCleanup()
+	newRoot, newCleanup, err := checkout(newSrc)
+	if err != nil {
+		return nil, err
+	}
+	defer newCleanup()
+	importing, err := importingDirs(newRoot, moduleDir, dirs)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]bool)
+	for _, dir := range dirs {
+		changed[dir] = true
+	}
+	dirs = slices.Clone(dirs)
+	for _, dir := range importing {
+		if matchDir(dir, opts.Include, opts.Exclude) {
+			dirs = append(dirs, dir)
+		}
+	}
+	// The packages are reported in the order of their directories.
+	slices.Sort(dirs)
+	// The packages are loaded once with the default environment if there are no platforms,
+	// the nil platform.
+	loadPlatforms := []*platform{nil}
+	if len(platforms) > 0 {
+		loadPlatforms = loadPlatforms[:0]
+		for i := range platforms {
+			loadPlatforms = append(loadPlatforms, &platforms[i])
+		}
+	}
+	results := make(map[string][][]*finding)
+	for _, p := range loadPlatforms {
+		oldFset, oldPkgs, err := loadPackages(oldRoot, moduleDir, dirs, p)
+		if err != nil {
+			return nil, err
+		}
+		newFset, newPkgs, err := loadPackages(newRoot, moduleDir, dirs, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			d := &typesDiffer{
+				differ: differ{
+					oldFset:        oldFset,
+					newFset:        newFset,
+					constValues:    opts.ConstValues,
+					oldAnnotations: packageAnnotations(oldPkgs[dir], oldRoot),
+					newAnnotations: packageAnnotations(newPkgs[dir], newRoot),
+				},
+				oldRoot: oldRoot,
+				newRoot: newRoot,
+			}
+			if !isInternal(dir) {
+				d.packageDiff(apiPackage(oldPkgs[dir]), apiPackage(newPkgs[dir]))
+				d.deprecationDiff()
+			}
+			results[dir] = append(results[dir], d.findings)
+		}
+	}
+	rep := newReport()
+	for _, dir := range dirs {
+		d := &differ{findings: results[dir][0]}
+		if len(platforms) > 0 {
+			d.findings = mergeFindings(platforms, results[dir])
+		}
+		pkg := d.result()
+		pkg.Dir = dir
+		if changed[dir] || len(pkg.Findings) > 0 {
+			rep.add(pkg)
+		}
+	}
+	return rep, nil
+}
+
+// apiPackage returns the types of pkg, or nil if pkg is missing or is a command, which has
+// no API.
+func apiPackage(pkg *packages.Package) *types.Package {
+	if pkg == nil || pkg.Name == "main" {
+		return nil
+	}
+	return pkg.Types
+}
+
+// packageAnnotations reads the annotations in the doc comments of pkg, with their positions
+// relative to root.
+func packageAnnotations(pkg *packages.Package, root string) annotations {
+	as := make(annotations)
+	if apiPackage(pkg) == nil {
+		return as
+	}
+	for _, file := range pkg.Syntax {
+		inspectAnnotations(pkg.Fset, file, as)
+	}
+	for symbol, a := range as {
+		a.Pos = relativePos(a.Pos, root)
+		as[symbol] = a
+	}
+	return as
+}
+
+// typesDiffer compares type-checked packages. Since both sides are loaded separately,
+// types from the old and new versions can never be identical in the sense of go/types;
+// instead, they are compared by identical, which maps the named types of one side to
+// those of the other by their package paths and names, and printed by typeString.
+type typesDiffer struct {
+	differ
+	oldRoot string
+	newRoot string
+}
+
+func (d *typesDiffer) oldPos(obj types.Object) token.Position {
+	return relativePos(d.oldFset.Position(obj.Pos()), d.oldRoot)
+}
+
+func (d *typesDiffer) newPos(obj types.Object) token.Position {
+	return relativePos(d.newFset.Position(obj.Pos()), d.newRoot)
+}
+
+func relativePos(pos token.Position, root string) token.Position {
+	if absRoot, err := filepath.Abs(root); err == nil {
+		if rel, err := filepath.Rel(absRoot, pos.Filename); err == nil {
+			pos.Filename = rel
+		}
+	}
+	return pos
+}
+
+func (d *typesDiffer) packageDiff(oldPkg, newPkg *types.Package) {
+	var (
+		oldScope = types.NewScope(nil, token.NoPos, token.NoPos, "")
+		newScope = types.NewScope(nil, token.NoPos, token.NoPos, "")
+	)
+	if oldPkg != nil {
+		oldScope = oldPkg.Scope()
+	}
+	if newPkg != nil {
+		newScope = newPkg.Scope()
+	}
+	for _, name := range oldScope.Names() {
+		oldObj := oldScope.Lookup(name)
+		if !oldObj.Exported() {
+			continue
+		}
+		newObj := newScope.Lookup(name)
+		if newObj == nil {
+			d.recordAt(breakingChange, kindRemoved, name, d.oldPos(oldObj), token.Position{},
+				"removed %s %s", objectKind(oldObj), name)
+			continue
+		}
+		if objectKind(oldObj) != objectKind(newObj) {
+			d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldObj), d.newPos(newObj),
+				"%s %s changed to a %s", objectKind(oldObj), name, objectKind(newObj))
+			continue
+		}
+		switch oldObj := oldObj.(type) {
+		case *types.TypeName:
+			d.typeNameDiff(oldObj, newObj.(*types.TypeName))
+		case *types.Func:
+			d.funcDiff(name, oldObj, newObj.(*types.Func))
+		case *types.Var:
+			// Even a type assignable both ways breaks the code taking the address of the
+			// var, so its type has to stay identical.
+			if !identical(oldObj.Type(), newObj.Type()) {
+				d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldObj), d.newPos(newObj),
+					"var %s changed type from %s to %s", name, typeString(oldObj.Type()), typeString(newObj.Type()))
+			}
+		case *types.Const:
+			d.constDiff(oldObj, newObj.(*types.Const))
+		}
+	}
+	for _, name := range newScope.Names() {
+		newObj := newScope.Lookup(name)
+		if !newObj.Exported() || oldScope.Lookup(name) != nil {
+			continue
+		}
+		d.recordAt(somethingNew, kindAdded, name, token.Position{}, d.newPos(newObj),
+			"added %s %s", objectKind(newObj), name)
+	}
+}
+
+func (d *typesDiffer) typeNameDiff(oldObj, newObj *types.TypeName) {
+	name := newObj.Name()
+	oldNamed, oldIsNamed := oldObj.Type().(*types.Named)
+	newNamed, newIsNamed := types.Unalias(newObj.Type()).(*types.Named)
+	// A defined type may become an alias of another defined type, such as when it moves to
+	// another package, which is compared with it instead. Any other change between an alias
+	// and a defined type changes the identity of the type.
+	moved := !oldObj.IsAlias() && newObj.IsAlias() && newIsNamed && newNamed.TypeArgs().Len() == 0
+	if oldObj.IsAlias() != newObj.IsAlias() && !moved {
+		d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldObj), d.newPos(newObj),
+			"type %s changed from %s to %s", name, typeNameKind(oldObj), typeNameKind(newObj))
+		return
+	}
+	if oldObj.IsAlias() || !oldIsNamed || !newIsNamed {
+		// An alias is equivalent to the type it denotes.
+		if oldType, newType := typeString(oldObj.Type()), typeString(newObj.Type()); !identical(oldObj.Type(), newObj.Type()) {
+			d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldObj), d.newPos(newObj),
+				"type %s changed from %s to %s", name, oldType, newType)
+		}
+		return
+	}
+	d.typeParamsDiff("type "+name, name, oldObj, newObj, oldNamed.TypeParams(), newNamed.TypeParams())
+	switch oldUnderlying := oldNamed.Underlying().(type) {
+	case *types.Struct:
+		if newUnderlying, ok := newNamed.Underlying().(*types.Struct); ok {
+			d.structDiff(name, oldUnderlying, newUnderlying)
+			d.promotedFieldsDiff(name, oldNamed, newNamed)
+		} else {
+			d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldObj), d.newPos(newObj),
+				"type %s changed from %s to %s", name, typeString(oldUnderlying), typeString(newNamed.Underlying()))
+		}
+	case *types.Interface:
+		if newUnderlying, ok := newNamed.Underlying().(*types.Interface); ok {
+			d.interfaceDiff(name, oldUnderlying, newUnderlying)
+		} else {
+			d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldObj), d.newPos(newObj),
+				"type %s changed from %s to %s", name, typeString(oldUnderlying), typeString(newNamed.Underlying()))
+		}
+		// The method set of an interface is the interface itself.
+		return
+	default:
+		if oldType, newType := typeString(oldUnderlying), typeString(newNamed.Underlying()); !identical(oldUnderlying, newNamed.Underlying()) {
+			d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldObj), d.newPos(newObj),
+				"type %s changed from %s to %s", name, oldType, newType)
+		}
+	}
+	d.methodSetDiff(name, oldNamed, newNamed)
+}
+
+// structDiff compares the exported fields of two structs, embedded fields are always
+// compared since they may promote exported fields and methods.
+func (d *typesDiffer) structDiff(typeName string, oldStruct, newStruct *types.Struct) {
+	type structField struct {
+		Var *types.Var
+		Tag string
+	}
+	fieldsByName := func(s *types.Struct) map[string]structField {
+		fields := make(map[string]structField)
+		for i := 0; i < s.NumFields(); i++ {
+			if field := s.Field(i); field.Exported() || field.Embedded() {
+				fields[field.Name()] = structField{Var: field, Tag: s.Tag(i)}
+			}
+		}
+		return fields
+	}
+	var (
+		oldFields = fieldsByName(oldStruct)
+		newFields = fieldsByName(newStruct)
+	)
+	for _, name := range sortedKeys(oldFields) {
+		var (
+			oldField = oldFields[name]
+			symbol   = typeName + "." + name
+		)
+		newField, ok := newFields[name]
+		if !ok {
+			d.recordAt(breakingChange, kindFieldRemoved, symbol, d.oldPos(oldField.Var), token.Position{},
+				"removed %s %s", fieldNoun(oldField.Var), symbol)
+			continue
+		}
+		if oldType, newType := typeString(oldField.Var.Type()), typeString(newField.Var.Type()); !identical(oldField.Var.Type(), newField.Var.Type()) {
+			d.recordAt(breakingChange, kindTypeChanged, symbol, d.oldPos(oldField.Var), d.newPos(newField.Var),
+				"%s %s changed type from %s to %s", fieldNoun(newField.Var), symbol, oldType, newType)
+		}
+		switch {
+		case oldField.Tag == newField.Tag:
+		case newField.Tag == "":
+			d.recordAt(breakingChange, kindTagRemoved, symbol, d.oldPos(oldField.Var), d.newPos(newField.Var),
+				"removed tag `%s` from %s %s", oldField.Tag, fieldNoun(newField.Var), symbol)
+		case oldField.Tag == "":
+			d.recordAt(somethingNew, kindTagAdded, symbol, d.oldPos(oldField.Var), d.newPos(newField.Var),
+				"added tag `%s` to %s %s", newField.Tag, fieldNoun(newField.Var), symbol)
+		default:
+			d.recordAt(somethingNew, kindTagChanged, symbol, d.oldPos(oldField.Var), d.newPos(newField.Var),
+				"tag of %s %s changed from `%s` to `%s`", fieldNoun(newField.Var), symbol, oldField.Tag, newField.Tag)
+		}
+	}
+	for _, name := range sortedKeys(newFields) {
+		if _, ok := oldFields[name]; !ok {
+			symbol := typeName + "." + name
+			d.recordAt(somethingNew, kindFieldAdded, symbol, token.Position{}, d.newPos(newFields[name].Var),
+				"added %s %s", fieldNoun(newFields[name].Var), symbol)
+		}
+	}
+}
+
+// interfaceDiff compares the complete method sets of two interfaces, including methods
+// from embedded interfaces; for interfaces, any modification is considered a breaking
+// change, since adding methods breaks implementations and removing methods breaks callers.
+func (d *typesDiffer) interfaceDiff(typeName string, oldIface, newIface *types.Interface) {
+	var (
+		oldMethods = interfaceMethods(oldIface)
+		newMethods = interfaceMethods(newIface)
+	)
+	for _, name := range sortedKeys(oldMethods) {
+		var (
+			oldMethod = oldMethods[name]
+			symbol    = typeName + "." + name
+		)
+		newMethod, ok := newMethods[name]
+		if !ok {
+			d.recordAt(breakingChange, kindMethodRemoved, symbol, d.oldPos(oldMethod), token.Position{},
+				"removed method %s", symbol)
+			continue
+		}
+		if oldSig, newSig := signatureString(oldMethod.Type().(*types.Signature)), signatureString(newMethod.Type().(*types.Signature)); !identical(oldMethod.Type(), newMethod.Type()) {
+			d.recordAt(breakingChange, kindSignatureChanged, symbol, d.oldPos(oldMethod), d.newPos(newMethod),
+				"method %s changed from %s to %s", symbol, oldSig, newSig)
+		}
+	}
+	for _, name := range sortedKeys(newMethods) {
+		if _, ok := oldMethods[name]; !ok {
+			symbol := typeName + "." + name
+			d.recordAt(breakingChange, kindMethodAdded, symbol, token.Position{}, d.newPos(newMethods[name]),
+				"added method %s", symbol)
+		}
+	}
+	// Interfaces used as constraints may also carry type sets, which cannot be told from
+	// their methods.
+	if oldIface.IsMethodSet() != newIface.IsMethodSet() || !oldIface.IsMethodSet() && typeString(oldIface) != typeString(newIface) {
+		d.recordAt(breakingChange, kindTypeChanged, typeName, token.Position{}, token.Position{},
+			"type set of interface %s changed from %s to %s", typeName, typeString(oldIface), typeString(newIface))
+	}
+}
+
+// methodSetDiff compares the method sets of a named type and of the pointer to it, which
+// include methods promoted from embedded fields.
+func (d *typesDiffer) methodSetDiff(typeName string, oldNamed, newNamed *types.Named) {
+	var (
+		oldValueMethods = methodSet(oldNamed)
+		oldPtrMethods   = methodSet(types.NewPointer(oldNamed))
+		newValueMethods = methodSet(newNamed)
+		newPtrMethods   = methodSet(types.NewPointer(newNamed))
+	)
+	for _, name := range sortedKeys(oldPtrMethods) {
+		var (
+			oldMethod = oldPtrMethods[name]
+			symbol    = typeName + "." + name
+		)
+		newMethod, ok := newPtrMethods[name]
+		if !ok {
+			d.recordAt(breakingChange, kindRemoved, symbol, d.oldPos(oldMethod), token.Position{},
+				"removed method %s", symbol)
+			continue
+		}
+		// The method set of the value type is a subset of that of the pointer type.
+		if _, inOldValueSet := oldValueMethods[name]; inOldValueSet {
+			if _, inNewValueSet := newValueMethods[name]; !inNewValueSet {
+				d.recordAt(breakingChange, kindReceiverChanged, symbol, d.oldPos(oldMethod), d.newPos(newMethod),
+					"method %s is no longer in the method set of %s, its receiver changed to a pointer", symbol, typeName)
+			}
+		}
+		if oldSig, newSig := signatureString(oldMethod.Type().(*types.Signature)), signatureString(newMethod.Type().(*types.Signature)); !identical(oldMethod.Type(), newMethod.Type()) {
+			d.recordAt(breakingChange, kindSignatureChanged, symbol, d.oldPos(oldMethod), d.newPos(newMethod),
+				"signature of method %s changed from %s to %s", symbol, oldSig, newSig)
+		}
+	}
+	for _, name := range sortedKeys(newPtrMethods) {
+		if _, ok := oldPtrMethods[name]; !ok {
+			symbol := typeName + "." + name
+			d.recordAt(somethingNew, kindAdded, symbol, token.Position{}, d.newPos(newPtrMethods[name]),
+				"added method %s", symbol)
+		}
+	}
+}
+
+func (d *typesDiffer) funcDiff(name string, oldFunc, newFunc *types.Func) {
+	var (
+		oldSig = oldFunc.Type().(*types.Signature)
+		newSig = newFunc.Type().(*types.Signature)
+	)
+	d.typeParamsDiff("func "+name, name, oldFunc, newFunc, oldSig.TypeParams(), newSig.TypeParams())
+	if oldSigStr, newSigStr := signatureString(oldSig), signatureString(newSig); !identical(oldSig, newSig) {
+		d.recordAt(breakingChange, kindSignatureChanged, name, d.oldPos(oldFunc), d.newPos(newFunc),
+			"signature of func %s changed from %s to %s", name, oldSigStr, newSigStr)
+	}
+}
+
+// constDiff compares the types of two constants, and their values if asked to. Changing a
+// typed constant of a basic type into an untyped constant is compatible, as long as the
+// value is still assignable to the original type.
+func (d *typesDiffer) constDiff(oldConst, newConst *types.Const) {
+	name := newConst.Name()
+	if d.constValues && !sameValue(oldConst.Val(), newConst.Val()) {
+		d.recordAt(breakingChange, kindValueChanged, name, d.oldPos(oldConst), d.newPos(newConst),
+			"value of const %s changed from %s to %s", name, formatValue(oldConst.Val()), formatValue(newConst.Val()))
+	}
+	if identical(oldConst.Type(), newConst.Type()) {
+		return
+	}
+	oldType, newType := typeString(oldConst.Type()), typeString(newConst.Type())
+	if oldBasic, ok := oldConst.Type().(*types.Basic); ok && oldBasic.Info()&types.IsUntyped == 0 {
+		if newBasic, ok := newConst.Type().(*types.Basic); ok && newBasic.Info()&types.IsUntyped != 0 {
+			if representable(newConst.Val(), oldBasic) {
+				return
+			}
+		}
+	}
+	d.recordAt(breakingChange, kindTypeChanged, name, d.oldPos(oldConst), d.newPos(newConst),
+		"const %s changed type from %s to %s", name, oldType, newType)
+}
+
+// representable reports whether val can be represented by a value of the basic type typ,
+// sizes of int, uint and uintptr are assumed to be 64 bits.
+func representable(val constant.Value, typ *types.Basic) bool {
+	info := typ.Info()
+	switch {
+	case info&types.IsInteger != 0:
+		v := constant.ToInt(val)
+		if v.Kind() != constant.Int {
+			return false
+		}
+		var (
+			min constant.Value
+			max constant.Value
+		)
+		switch typ.Kind() {
+		case types.Int8:
+			min, max = constant.MakeInt64(math.MinInt8), constant.MakeInt64(math.MaxInt8)
+		case types.Int16:
+			min, max = constant.MakeInt64(math.MinInt16), constant.MakeInt64(math.MaxInt16)
+		case types.Int32:
+			min, max = constant.MakeInt64(math.MinInt32), constant.MakeInt64(math.MaxInt32)
+		case types.Int, types.Int64:
+			min, max = constant.MakeInt64(math.MinInt64), constant.MakeInt64(math.MaxInt64)
+		case types.Uint8:
+			min, max = constant.MakeInt64(0), constant.MakeUint64(math.MaxUint8)
+		case types.Uint16:
+			min, max = constant.MakeInt64(0), constant.MakeUint64(math.MaxUint16)
+		case types.Uint32:
+			min, max = constant.MakeInt64(0), constant.MakeUint64(math.MaxUint32)
+		default:
+			min, max = constant.MakeInt64(0), constant.MakeUint64(math.MaxUint64)
+		}
+		return constant.Compare(v, token.GEQ, min) && constant.Compare(v, token.LEQ, max)
+	case info&types.IsFloat != 0:
+		kind := constant.ToFloat(val).Kind()
+		return kind == constant.Float || kind == constant.Int
+	case info&types.IsComplex != 0:
+		return constant.ToComplex(val).Kind() != constant.Unknown
+	case info&types.IsString != 0:
+		return val.Kind() == constant.String
+	case info&types.IsBoolean != 0:
+		return val.Kind() == constant.Bool
+	default:
+		return false
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// identical reports whether oldType and newType, loaded separately, are identical in the
+// sense of go/types once each named type of one side corresponds to the named type of the
+// same package path and name on the other. Aliases are replaced with the types they denote,
+// and, as for signatureString, the names of parameters and results do not matter.
+func identical(oldType, newType types.Type) bool {
+	oldType, newType = types.Unalias(oldType), types.Unalias(newType)
+	switch oldType := oldType.(type) {
+	case *types.Named:
+		newType, ok := newType.(*types.Named)
+		if !ok || !sameObject(oldType.Obj(), newType.Obj()) || oldType.TypeArgs().Len() != newType.TypeArgs().Len() {
+			return false
+		}
+		for i := 0; i < oldType.TypeArgs().Len(); i++ {
+			if !identical(oldType.TypeArgs().At(i), newType.TypeArgs().At(i)) {
+				return false
+			}
+		}
+		return true
+	case *types.Basic:
+		newType, ok := newType.(*types.Basic)
+		return ok && oldType.Kind() == newType.Kind()
+	case *types.Pointer:
+		newType, ok := newType.(*types.Pointer)
+		return ok && identical(oldType.Elem(), newType.Elem())
+	case *types.Slice:
+		newType, ok := newType.(*types.Slice)
+		return ok && identical(oldType.Elem(), newType.Elem())
+	case *types.Array:
+		newType, ok := newType.(*types.Array)
+		return ok && oldType.Len() == newType.Len() && identical(oldType.Elem(), newType.Elem())
+	case *types.Map:
+		newType, ok := newType.(*types.Map)
+		return ok && identical(oldType.Key(), newType.Key()) && identical(oldType.Elem(), newType.Elem())
+	case *types.Chan:
+		newType, ok := newType.(*types.Chan)
+		return ok && oldType.Dir() == newType.Dir() && identical(oldType.Elem(), newType.Elem())
+	case *types.Signature:
+		newType, ok := newType.(*types.Signature)
+		return ok && oldType.Variadic() == newType.Variadic() && oldType.TypeParams().Len() == newType.TypeParams().Len() &&
+			identical(oldType.Params(), newType.Params()) && identical(oldType.Results(), newType.Results())
+	case *types.Tuple:
+		newType, ok := newType.(*types.Tuple)
+		if !ok || oldType.Len() != newType.Len() {
+			return false
+		}
+		for i := 0; i < oldType.Len(); i++ {
+			if !identical(oldType.At(i).Type(), newType.At(i).Type()) {
+				return false
+			}
+		}
+		return true
+	case *types.Struct:
+		newType, ok := newType.(*types.Struct)
+		if !ok || oldType.NumFields() != newType.NumFields() {
+			return false
+		}
+		for i := 0; i < oldType.NumFields(); i++ {
+			oldField, newField := oldType.Field(i), newType.Field(i)
+			if !sameObject(oldField, newField) || oldField.Embedded() != newField.Embedded() ||
+				oldType.Tag(i) != newType.Tag(i) || !identical(oldField.Type(), newField.Type()) {
+				return false
+			}
+		}
+		return true
+	case *types.Interface:
+		newType, ok := newType.(*types.Interface)
+		if !ok || oldType.NumMethods() != newType.NumMethods() || oldType.IsMethodSet() != newType.IsMethodSet() {
+			return false
+		}
+		// The methods are sorted by their ids, made of package paths and names.
+		for i := 0; i < oldType.NumMethods(); i++ {
+			oldMethod, newMethod := oldType.Method(i), newType.Method(i)
+			if !sameObject(oldMethod, newMethod) || !identical(oldMethod.Type(), newMethod.Type()) {
+				return false
+			}
+		}
+		// Type sets are only told apart by their representation.
+		return oldType.IsMethodSet() || typeString(oldType) == typeString(newType)
+	case *types.Union:
+		newType, ok := newType.(*types.Union)
+		return ok && typeString(oldType) == typeString(newType)
+	case *types.TypeParam:
+		newType, ok := newType.(*types.TypeParam)
+		return ok && oldType.Index() == newType.Index()
+	default:
+		return typeString(oldType) == typeString(newType)
+	}
+}
+
+// sameObject reports whether two objects loaded separately correspond to each other, which
+// is the case if they have the same name, and also belong to the same package unless they
+// are exported.
+func sameObject(oldObj, newObj types.Object) bool {
+	if oldObj.Name() != newObj.Name() {
+		return false
+	}
+	if _, isTypeName := oldObj.(*types.TypeName); !isTypeName && oldObj.Exported() {
+		return true
+	}
+	return packagePath(oldObj.Pkg()) == packagePath(newObj.Pkg())
+}
+
+func packagePath(pkg *types.Package) string {
+	if pkg == nil {
+		return ""
+	}
+	return pkg.Path()
+}
+
+// typeString formats typ with complete package paths, aliases are replaced with the types
+// they denote at every level, since go/packages always creates alias types.
+func typeString(typ types.Type) string {
+	var b strings.Builder
+	writeType(&b, typ)
+	return b.String()
+}
+
+func writeType(b *strings.Builder, typ types.Type) {
+	switch typ := types.Unalias(typ).(type) {
+	case *types.Named:
+		if pkg := typ.Obj().Pkg(); pkg != nil {
+			b.WriteString(pkg.Path())
+			b.WriteByte('.')
+		}
+		b.WriteString(typ.Obj().Name())
+		if typeArgs := typ.TypeArgs(); typeArgs.Len() > 0 {
+			b.WriteByte('[')
+			for i := 0; i < typeArgs.Len(); i++ {
+				if i > 0 {
+					b.WriteString(", ")
+				}
+				writeType(b, typeArgs.At(i))
+			}
+			b.WriteByte(']')
+		}
+	case *types.Pointer:
+		b.WriteByte('*')
+		writeType(b, typ.Elem())
+	case *types.Slice:
+		b.WriteString("[]")
+		writeType(b, typ.Elem())
+	case *types.Array:
+		fmt.Fprintf(b, "[%d]", typ.Len())
+		writeType(b, typ.Elem())
+	case *types.Map:
+		b.WriteString("map[")
+		writeType(b, typ.Key())
+		b.WriteByte(']')
+		writeType(b, typ.Elem())
+	case *types.Chan:
+		switch typ.Dir() {
+		case types.SendRecv:
+			b.WriteString("chan ")
+		case types.SendOnly:
+			b.WriteString("chan<- ")
+		case types.RecvOnly:
+			b.WriteString("<-chan ")
+		}
+		writeType(b, typ.Elem())
+	case *types.Signature:
+		b.WriteString(signatureString(typ))
+	case *types.Struct:
+		b.WriteString("struct{")
+		for i := 0; i < typ.NumFields(); i++ {
+			if i > 0 {
+				b.WriteString("; ")
+			}
+			field := typ.Field(i)
+			if !field.Embedded() {
+				b.WriteString(field.Name())
+				b.WriteByte(' ')
+			}
+			writeType(b, field.Type())
+			if tag := typ.Tag(i); tag != "" {
+				b.WriteByte(' ')
+				b.WriteString(strconv.Quote(tag))
+			}
+		}
+		b.WriteByte('}')
+	case *types.Interface:
+		var elems []string
+		for i := 0; i < typ.NumMethods(); i++ {
+			method := typ.Method(i)
+			elems = append(elems, method.Name()+strings.TrimPrefix(signatureString(method.Type().(*types.Signature)), "func"))
+		}
+		for i := 0; i < typ.NumEmbeddeds(); i++ {
+			// Embedded interfaces have been expanded into methods above, only type
+			// constraints are left.
+			if embedded := typ.EmbeddedType(i); !types.IsInterface(embedded) {
+				elems = append(elems, typeString(embedded))
+			}
+		}
+		if typ.IsComparable() && !typ.IsMethodSet() && len(elems) == 0 {
+			elems = append(elems, "comparable")
+		}
+		slices.Sort(elems)
+		b.WriteString("interface{")
+		b.WriteString(strings.Join(elems, "; "))
+		b.WriteByte('}')
+	case *types.Union:
+		for i := 0; i < typ.Len(); i++ {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			term := typ.Term(i)
+			if term.Tilde() {
+				b.WriteByte('~')
+			}
+			writeType(b, term.Type())
+		}
+	case *types.Tuple:
+		b.WriteByte('(')
+		for i := 0; i < typ.Len(); i++ {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeType(b, typ.At(i).Type())
+		}
+		b.WriteByte(')')
+	default:
+		// Basic types and type parameters.
+		b.WriteString(types.TypeString(typ, nil))
+	}
+}
+
+// signatureString formats a signature without the names of parameters and results,
+// since renaming them is not a change.
+func signatureString(sig *types.Signature) string {
+	var b strings.Builder
+	b.WriteString("func(")
+	params := sig.Params()
+	for i := 0; i < params.Len(); i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if sig.Variadic() && i == params.Len()-1 {
+			b.WriteString("...")
+			b.WriteString(typeString(params.At(i).Type().(*types.Slice).Elem()))
+		} else {
+			b.WriteString(typeString(params.At(i).Type()))
+		}
+	}
+	b.WriteByte(')')
+	switch results := sig.Results(); results.Len() {
+	case 0:
+	case 1:
+		b.WriteByte(' ')
+		b.WriteString(typeString(results.At(0).Type()))
+	default:
+		b.WriteString(" (")
+		for i := 0; i < results.Len(); i++ {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(typeString(results.At(i).Type()))
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// typeParamsDiff records the changes to the type parameters of the generic type or func
+// described by what, see typeParamsChanges; any other change to them is a breaking change.
+func (d *typesDiffer) typeParamsDiff(what, symbol string, oldObj, newObj types.Object, oldTypeParams, newTypeParams *types.TypeParamList) {
+	oldString, newString := typeParamsString(oldTypeParams), typeParamsString(newTypeParams)
+	if oldString == newString {
+		return
+	}
+	changes, ok := typeParamsChanges(what, typesTypeParams(oldTypeParams), typesTypeParams(newTypeParams))
+	if !ok {
+		d.recordAt(breakingChange, kindTypeParamsChanged, symbol, d.oldPos(oldObj), d.newPos(newObj),
+			"type parameters of %s changed from %s to %s", what, oldString, newString)
+		return
+	}
+	for _, c := range changes {
+		d.recordAt(c.Change, kindTypeParamsChanged, symbol, d.oldPos(oldObj), d.newPos(newObj), "%s", c.Reason)
+	}
+}
+
+func typeParamsString(typeParams *types.TypeParamList) string {
+	if typeParams.Len() == 0 {
+		return "no type parameters"
+	}
+	params := make([]string, 0, typeParams.Len())
+	for i := 0; i < typeParams.Len(); i++ {
+		typeParam := typeParams.At(i)
+		params = append(params, typeParam.Obj().Name()+" "+typeString(typeParam.Constraint()))
+	}
+	return "[" + strings.Join(params, ", ") + "]"
+}
+
+func interfaceMethods(iface *types.Interface) map[string]*types.Func {
+	methods := make(map[string]*types.Func)
+	for i := 0; i < iface.NumMethods(); i++ {
+		method := iface.Method(i)
+		methods[method.Name()] = method
+	}
+	return methods
+}
+
+// methodSet lists the exported methods in the method set of typ.
+func methodSet(typ types.Type) map[string]*types.Func {
+	methods := make(map[string]*types.Func)
+	mset := types.NewMethodSet(typ)
+	for i := 0; i < mset.Len(); i++ {
+		if method := mset.At(i).Obj().(*types.Func); method.Exported() {
+			methods[method.Name()] = method
+		}
+	}
+	return methods
+}
+
+func objectKind(obj types.Object) string {
+	switch obj.(type) {
+	case *types.TypeName:
+		return "type"
+	case *types.Func:
+		return "func"
+	case *types.Var:
+		return "var"
+	case *types.Const:
+		return "const"
+	default:
+		return "object"
+	}
+}
+
+func typeNameKind(obj *types.TypeName) string {
+	if obj.IsAlias() {
+		return "an alias"
+	}
+	return "a defined type"
+}
+
+func fieldNoun(field *types.Var) string {
+	if field.Embedded() {
+		return "embedded field"
+	}
+	return "field"
+}
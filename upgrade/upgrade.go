@@ -9,31 +9,133 @@ import (
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"io/fs"
+	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"reflect"
 	"slices"
 	"strconv"
 	"strings"
-	"unicode"
 )
 
 type SemanticVersion struct {
 	Major int
 	Minor int
 	Patch int
+	// Prerelease holds the dot-separated pre-release identifiers without the leading
+	// hyphen, such as "rc.1".
+	Prerelease string
+	// Build holds the dot-separated build metadata without the leading plus sign, it
+	// is kept when printing but ignored when determining precedence.
+	Build string
 }
 
 func (sv SemanticVersion) Valid() bool {
-	return sv.Major > 0 || sv.Minor > 0 || sv.Patch > 0
+	return sv.Major > 0 || sv.Minor > 0 || sv.Patch > 0 || sv.Prerelease != ""
 }
 
 func (sv SemanticVersion) String() string {
-	return fmt.Sprintf("v%d.%d.%d", sv.Major, sv.Minor, sv.Patch)
+	var b strings.Builder
+	fmt.Fprintf(&b, "v%d.%d.%d", sv.Major, sv.Minor, sv.Patch)
+	if sv.Prerelease != "" {
+		b.WriteByte('-')
+		b.WriteString(sv.Prerelease)
+	}
+	if sv.Build != "" {
+		b.WriteByte('+')
+		b.WriteString(sv.Build)
+	}
+	return b.String()
+}
+
+// Compare returns -1, 0 or +1 depending on whether sv has lower, equal or higher
+// precedence than other, following the rules of SemVer 2.0; build metadata is
+// ignored.
+func (sv SemanticVersion) Compare(other SemanticVersion) int {
+	if c := compareInt(sv.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareInt(sv.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareInt(sv.Patch, other.Patch); c != 0 {
+		return c
+	}
+	// A pre-release version has lower precedence than the associated normal version.
+	switch {
+	case sv.Prerelease == other.Prerelease:
+		return 0
+	case sv.Prerelease == "":
+		return +1
+	case other.Prerelease == "":
+		return -1
+	}
+	var (
+		ids      = strings.Split(sv.Prerelease, ".")
+		otherIDs = strings.Split(other.Prerelease, ".")
+	)
+	for i := 0; i < len(ids) && i < len(otherIDs); i++ {
+		if c := compareIdentifier(ids[i], otherIDs[i]); c != 0 {
+			return c
+		}
+	}
+	// A larger set of pre-release fields has a higher precedence than a smaller set,
+	// if all the preceding identifiers are equal.
+	return compareInt(len(ids), len(otherIDs))
+}
+
+func compareInt(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return +1
+	default:
+		return 0
+	}
+}
+
+func compareIdentifier(x, y string) int {
+	xNumeric, yNumeric := isNumericIdentifier(x), isNumericIdentifier(y)
+	switch {
+	case xNumeric && yNumeric:
+		// Without leading zeroes, the longer number is the larger one, which also holds
+		// for numbers that overflow an int.
+		if c := compareInt(len(x), len(y)); c != 0 {
+			return c
+		}
+		return strings.Compare(x, y)
+	case xNumeric:
+		// Numeric identifiers always have lower precedence than alphanumeric identifiers.
+		return -1
+	case yNumeric:
+		return +1
+	default:
+		return strings.Compare(x, y)
+	}
+}
+
+// isNumericIdentifier reports whether id is made of ASCII digits only, unlike
+// strconv.Atoi, which also accepts signs.
+func isNumericIdentifier(id string) bool {
+	return id != "" && strings.Trim(id, "0123456789") == ""
+}
+
+// Core returns the normal version associated with sv, which is sv without its
+// pre-release identifiers and build metadata.
+func (sv SemanticVersion) Core() SemanticVersion {
+	return SemanticVersion{Major: sv.Major, Minor: sv.Minor, Patch: sv.Patch}
 }
 
+// Next returns the version following sv for the given change. If sv is a pre-release,
+// the pre-release sequence it belongs to is continued, see NextPrerelease.
 func (sv SemanticVersion) Next(chg change) (next SemanticVersion) {
-	next = sv
+	if sv.Prerelease != "" {
+		return sv.NextPrerelease(chg, prereleaseChannel(sv.Prerelease))
+	}
+	next = sv.Core()
 	switch chg {
 	case breakingChange:
 		if next.Major > 0 {
@@ -50,10 +152,88 @@ func (sv SemanticVersion) Next(chg change) (next SemanticVersion) {
 	case justPatch:
 		next.Patch++
 	case noChange:
+		return sv
 	}
 	return next
 }
 
+// NextPrerelease returns the next pre-release version on the channel identified by
+// id (such as "rc" or "beta"), for example, from v1.3.0-rc.2 to v1.3.0-rc.3, or from
+// v1.2.5 to v1.3.0-rc.1 when something new has been added.
+//
+// When sv is already a pre-release, the normal version it leads to is only bumped
+// again if chg exceeds the change implied by that normal version; v1.3.0-rc.2
+// implies new features, so a breaking change turns it into v2.0.0-rc.1.
+func (sv SemanticVersion) NextPrerelease(chg change, id string) (next SemanticVersion) {
+	if chg == noChange {
+		return sv
+	}
+	if sv.Prerelease == "" {
+		next = sv.Next(chg)
+		next.Prerelease = id + ".1"
+		return next
+	}
+	if chg > sv.impliedChange() {
+		next = sv.Core().Next(chg)
+		next.Prerelease = id + ".1"
+		return next
+	}
+	next = sv.Core()
+	if prereleaseChannel(sv.Prerelease) != id {
+		next.Prerelease = id + ".1"
+		return next
+	}
+	ids := strings.Split(sv.Prerelease, ".")
+	if n, err := strconv.Atoi(ids[len(ids)-1]); err == nil && isNumericIdentifier(ids[len(ids)-1]) && len(ids) > 1 {
+		ids[len(ids)-1] = strconv.Itoa(n + 1)
+	} else {
+		ids = append(ids, "1")
+	}
+	next.Prerelease = strings.Join(ids, ".")
+	return next
+}
+
+// Promote returns the normal version that should be released after sv. For a
+// pre-release, that is the normal version it leads to (v1.3.0-rc.2 becomes v1.3.0),
+// unless chg exceeds the change implied by it; for a normal version, Promote is
+// equivalent to Next.
+func (sv SemanticVersion) Promote(chg change) SemanticVersion {
+	if sv.Prerelease == "" {
+		return sv.Next(chg)
+	}
+	if chg > sv.impliedChange() {
+		return sv.Core().Next(chg)
+	}
+	return sv.Core()
+}
+
+// impliedChange reports the change that a pre-release version was made for, which
+// can be told from the position of its last non-zero number.
+func (sv SemanticVersion) impliedChange() change {
+	switch {
+	case sv.Patch > 0:
+		return justPatch
+	case sv.Minor > 0:
+		if sv.Major == 0 {
+			// Before v1.0.0, breaking changes only increase the Minor Version number.
+			return breakingChange
+		}
+		return somethingNew
+	default:
+		return breakingChange
+	}
+}
+
+// prereleaseChannel returns the pre-release identifiers with the trailing numeric
+// counter removed, for example, "rc" for "rc.2".
+func prereleaseChannel(prerelease string) string {
+	ids := strings.Split(prerelease, ".")
+	if isNumericIdentifier(ids[len(ids)-1]) && len(ids) > 1 {
+		ids = ids[:len(ids)-1]
+	}
+	return strings.Join(ids, ".")
+}
+
 func parse(s string) (sv SemanticVersion, err error) {
 	var (
 		v  string
@@ -76,30 +256,205 @@ func parse(s string) (sv SemanticVersion, err error) {
 	if err != nil {
 		return SemanticVersion{}, fmt.Errorf("unable to parse minor version: %w", err)
 	}
-	for i, ch := range s {
-		if !('0' <= ch && ch <= '9') {
-			v = s[:i]
-			break // Don't forget to break out of the loop.
-		} else if i == len(s)-1 {
-			v = s
-		}
-	}
+	v, s = cutFunc(s, func(ch rune) bool { return !('0' <= ch && ch <= '9') })
 	sv.Patch, err = strconv.Atoi(v)
 	if err != nil {
 		return SemanticVersion{}, fmt.Errorf("unable to parse patch version: %w", err)
 	}
+	// Anything after the patch version that is neither a pre-release nor build metadata
+	// is ignored, so that versions such as "v0.12.4 beta" can still be recognized.
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		sv.Prerelease, s = cutFunc(rest, func(ch rune) bool { return !isIdentifierChar(ch) && ch != '.' })
+		if err = checkIdentifiers(sv.Prerelease, true); err != nil {
+			return SemanticVersion{}, fmt.Errorf("unable to parse pre-release version: %w", err)
+		}
+	}
+	if rest, ok := strings.CutPrefix(s, "+"); ok {
+		sv.Build, _ = cutFunc(rest, func(ch rune) bool { return !isIdentifierChar(ch) && ch != '.' })
+		if err = checkIdentifiers(sv.Build, false); err != nil {
+			return SemanticVersion{}, fmt.Errorf("unable to parse build metadata: %w", err)
+		}
+	}
 	return sv, nil
 }
 
+// cutFunc slices s around the first rune satisfying f.
+func cutFunc(s string, f func(rune) bool) (before, after string) {
+	if i := strings.IndexFunc(s, f); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+func isIdentifierChar(ch rune) bool {
+	return '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '-'
+}
+
+func checkIdentifiers(s string, prerelease bool) error {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return fmt.Errorf("empty identifier in %q", s)
+		}
+		// Numeric pre-release identifiers must not include leading zeroes.
+		if prerelease && len(id) > 1 && id[0] == '0' && isNumericIdentifier(id) {
+			return fmt.Errorf("numeric identifier %q has leading zeroes", id)
+		}
+	}
+	return nil
+}
+
+// parseTag parses a git tag as a semantic version, the tag must be exactly prefix followed
+// by the canonical form of the version, such as "v1.2.3" or "sub/module/v1.3.0-rc.1".
+func parseTag(tag string, prefix string) (SemanticVersion, bool) {
+	version, ok := strings.CutPrefix(tag, prefix)
+	if !ok {
+		return SemanticVersion{}, false
+	}
+	sv, err := parse(version)
+	if err != nil || sv.String() != version {
+		return SemanticVersion{}, false
+	}
+	return sv, true
+}
+
+var (
+	ErrNoVersionTag = errors.New("no semantic version tag found")
+)
+
+// latestTag finds the semantic version tag with the highest precedence among the tags
+// reachable from rev, which start with prefix.
+func latestTag(rev string, prefix string) (string, SemanticVersion, error) {
+	tags, err := gitTags(rev)
+	if err != nil {
+		return "", SemanticVersion{}, err
+	}
+	var (
+		latest  string
+		version SemanticVersion
+	)
+	for _, tag := range tags {
+		if sv, ok := parseTag(tag, prefix); ok && (latest == "" || sv.Compare(version) > 0) {
+			latest, version = tag, sv
+		}
+	}
+	if latest == "" {
+		if prefix != "" {
+			return "", SemanticVersion{}, fmt.Errorf("%w with prefix %q reachable from %q, please specify the current version", ErrNoVersionTag, prefix, rev)
+		}
+		return "", SemanticVersion{}, fmt.Errorf("%w reachable from %q, please specify the current version", ErrNoVersionTag, rev)
+	}
+	return latest, version, nil
+}
+
+// versionTag finds the tag of version among the tags reachable from rev, which start with
+// prefix; it reports false if there is none, or if version is not valid.
+func versionTag(rev string, prefix string, version SemanticVersion) (string, bool, error) {
+	if !version.Valid() {
+		return "", false, nil
+	}
+	tags, err := gitTags(rev)
+	if err != nil {
+		return "", false, err
+	}
+	for _, tag := range tags {
+		if sv, ok := parseTag(tag, prefix); ok && sv.Compare(version) == 0 {
+			return tag, true, nil
+		}
+	}
+	return "", false, nil
+}
+
 type changedDir struct {
 	Olds []string
 	News []string
 }
 
-func detectChange() (change, error) {
-	files, err := gitChangedFiles()
+// detectOptions controls how changes are detected.
+type detectOptions struct {
+	// From and To are the git revisions to compare. When both of them are empty, the
+	// working tree is compared with HEAD; when only To is empty, the working tree is
+	// compared with From; and when only From is empty, it defaults to HEAD.
+	From string
+	To   string
+	// TypeCheck compares packages loaded with go/types instead of their syntax trees.
+	TypeCheck bool
+	// Include and Exclude are patterns of package directories, see matchDir.
+	Include []string
+	Exclude []string
+	// Module restricts the comparison to the packages of a module, all packages in the
+	// repository are compared if it is nil.
+	Module *module
+	// OldTree and NewTree are compared instead of git revisions if both are given.
+	OldTree *fileTree
+	NewTree *fileTree
+	// Platforms are the platforms the API is compared on, each of them considering only
+	// the files the go tool builds for it; the union of all files is compared if empty.
+	Platforms []platform
+	// ConstValues compares the values of exported constants, so that changing them, such
+	// as by reordering an iota block, is a breaking change.
+	ConstValues bool
+	// Policy overrides the levels of the findings, see loadPolicy.
+	Policy policy
+}
+
+func detectChange(opts *detectOptions) (*report, error) {
+	dirs, dirFileMap, oldSrc, newSrc, err := changedPackages(opts)
 	if err != nil {
-		return noChange, err
+		return nil, err
+	}
+	if opts.TypeCheck {
+		moduleDir := "."
+		if opts.Module != nil {
+			moduleDir = opts.Module.Dir
+		}
+		rep, err := typesDiff(moduleDir, dirs, oldSrc, newSrc, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Policy.apply(rep)
+		return rep, nil
+	}
+	rep := newReport()
+	for _, dir := range dirs {
+		var pkg *packageDiff
+		if isInternal(dir) {
+			pkg = new(differ).result()
+		} else if pkg, err = diff(dirFileMap[dir], oldSrc, newSrc, opts); err != nil {
+			return nil, err
+		}
+		pkg.Dir = dir
+		rep.add(pkg)
+	}
+	opts.Policy.apply(rep)
+	return rep, nil
+}
+
+// changedPackages lists the sorted directories of the packages changed between the sources
+// compared by opts, along with the changed files in each directory.
+func changedPackages(opts *detectOptions) ([]string, map[string]*changedDir, source, source, error) {
+	var (
+		files  []changedFile
+		oldSrc source = gitRevision("HEAD")
+		newSrc source = workTree{}
+		err    error
+	)
+	if opts.OldTree != nil && opts.NewTree != nil {
+		oldSrc, newSrc = opts.OldTree, opts.NewTree
+		files, err = treeChangedFiles(opts.OldTree, opts.NewTree)
+	} else if from, to := opts.From, opts.To; from == "" && to == "" {
+		files, err = gitChangedFiles()
+	} else {
+		if from == "" {
+			from = "HEAD"
+		}
+		oldSrc = gitRevision(from)
+		if to != "" {
+			newSrc = gitRevision(to)
+		}
+		files, err = gitDiffFiles(from, to)
+	}
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 	// Divide files in the same directory into a group, because usually .go files in
 	// the same directory belong to the same go package.
@@ -107,6 +462,13 @@ func detectChange() (change, error) {
 		dirFileMap = make(map[string]*changedDir)
 	)
 	for _, file := range files {
+		// Test files are not importable, neither are they shipped to users of the package.
+		if isTestFile(file.Old) {
+			file.Old = ""
+		}
+		if isTestFile(file.New) {
+			file.New = ""
+		}
 		if oldFile := file.Old; oldFile != "" {
 			dir := filepath.Dir(oldFile)
 			chd, ok := dirFileMap[dir]
@@ -126,18 +488,66 @@ func detectChange() (change, error) {
 			dirFileMap[dir] = chd
 		}
 	}
-	var topChange change
-	for _, chd := range dirFileMap {
-		var fileChange change
-		fileChange, err = diff(chd)
-		if err != nil {
-			return noChange, err
+	dirs := make([]string, 0, len(dirFileMap))
+	for dir := range dirFileMap {
+		if matchDir(dir, opts.Include, opts.Exclude) && (opts.Module == nil || opts.Module.contains(dir)) {
+			dirs = append(dirs, dir)
+		}
+	}
+	slices.Sort(dirs)
+	return dirs, dirFileMap, oldSrc, newSrc, nil
+}
+
+// isTestFile reports whether file is a _test.go file.
+func isTestFile(file string) bool {
+	return strings.HasSuffix(file, "_test.go")
+}
+
+// isInternal reports whether dir is, or is inside, an internal directory, the packages
+// there can only be imported by code in the same module, so they have no public API.
+func isInternal(dir string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(dir), "/") {
+		if elem == "internal" {
+			return true
 		}
-		if fileChange > topChange {
-			topChange = fileChange
+	}
+	return false
+}
+
+// matchDir reports whether the package directory dir takes part in API analysis, which
+// is when it matches any of the include patterns (or there are none), but none of the
+// exclude patterns.
+//
+// A pattern is either a glob as in path.Match, or a directory followed by "/..." which
+// matches the directory and all of its subdirectories; "..." alone matches everything.
+// Patterns and directories are relative to the root of the repository, with an optional
+// leading "./".
+func matchDir(dir string, include, exclude []string) bool {
+	dir = filepath.ToSlash(dir)
+	matchAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if matchPattern(pattern, dir) {
+				return true
+			}
 		}
+		return false
 	}
-	return topChange, nil
+	return (len(include) == 0 || matchAny(include)) && !matchAny(exclude)
+}
+
+func matchPattern(pattern string, dir string) bool {
+	pattern = strings.TrimPrefix(filepath.ToSlash(pattern), "./")
+	if pattern == "..." {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/..."); ok {
+		return dir == prefix || strings.HasPrefix(dir, prefix+"/")
+	}
+	if pattern == "" {
+		pattern = "."
+	}
+	matched, _ := path.Match(pattern, dir)
+	return matched
 }
 
 type changedFile struct {
@@ -198,6 +608,233 @@ func gitChangedFiles() ([]changedFile, error) {
 	return files, nil
 }
 
+// gitDiffFiles lists the .go files that differ between two git revisions, or between
+// a revision and the working tree if to is empty.
+func gitDiffFiles(from, to string) ([]changedFile, error) {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+	args := []string{"diff", "--name-status", "-M", from}
+	if to != "" {
+		args = append(args, to)
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	files := make([]changedFile, 0, 8)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		// Each line consists of a status letter (followed by a similarity score for renames
+		// and copies) and one or two paths, separated by tabs.
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		switch status := fields[0]; {
+		case strings.HasPrefix(status, "R") && len(fields) >= 3:
+			if oldFile, newFile := fields[1], fields[2]; filepath.Ext(oldFile) == ".go" || filepath.Ext(newFile) == ".go" {
+				files = append(files, changedFile{
+					Old: goFile(oldFile),
+					New: goFile(newFile),
+				})
+			}
+		case strings.HasPrefix(status, "C") && len(fields) >= 3:
+			if newFile := fields[2]; filepath.Ext(newFile) == ".go" {
+				files = append(files, changedFile{New: newFile})
+			}
+		case strings.HasPrefix(status, "D"):
+			if oldFile := fields[1]; filepath.Ext(oldFile) == ".go" {
+				files = append(files, changedFile{Old: oldFile})
+			}
+		case strings.HasPrefix(status, "A"):
+			if newFile := fields[1]; filepath.Ext(newFile) == ".go" {
+				files = append(files, changedFile{New: newFile})
+			}
+		default:
+			if modifiedFile := fields[len(fields)-1]; filepath.Ext(modifiedFile) == ".go" {
+				files = append(files, changedFile{
+					Old: modifiedFile,
+					New: modifiedFile,
+				})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning %q output: %w", "git diff", err)
+	}
+	if to == "" {
+		// "git diff" does not report untracked files when comparing with the working tree.
+		stdout.Reset()
+		stderr.Reset()
+		cmd = exec.Command("git", "ls-files", "--others", "--exclude-standard")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+		}
+		for _, newFile := range strings.Split(stdout.String(), "\n") {
+			if filepath.Ext(newFile) == ".go" {
+				files = append(files, changedFile{New: newFile})
+			}
+		}
+	}
+	return files, nil
+}
+
+// goFile returns file if it is a .go file, or an empty string otherwise.
+func goFile(file string) string {
+	if filepath.Ext(file) == ".go" {
+		return file
+	}
+	return ""
+}
+
+// source provides the content of files on one side of a comparison, file names are
+// relative to the root of the repository.
+type source interface {
+	ReadFile(name string) ([]byte, error)
+	// ReadDir lists the files in the directory name, joined with name; a directory that
+	// does not exist has no files.
+	ReadDir(name string) ([]string, error)
+}
+
+// gitRevision reads files from a git revision, such as a commit, a branch or a tag.
+type gitRevision string
+
+func (rev gitRevision) ReadFile(name string) ([]byte, error) {
+	return gitShow(string(rev), name)
+}
+
+func (rev gitRevision) ReadDir(name string) ([]string, error) {
+	return gitListFiles(string(rev), name)
+}
+
+// workTree reads files from the working tree.
+type workTree struct{}
+
+func (workTree) ReadFile(name string) ([]byte, error) {
+	src, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w in working tree", ErrFileDoesNotExist)
+	}
+	return src, err
+}
+
+func (workTree) ReadDir(name string) ([]string, error) {
+	entries, err := os.ReadDir(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, filepath.Join(name, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// gitTags lists the tags reachable from rev.
+func gitTags(rev string) ([]string, error) {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+	cmd := exec.Command("git", "tag", "--list", "--merged", rev)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.Fields(stdout.String()), nil
+}
+
+// gitLog returns the hashes and messages of the commits in the revision range revs, which
+// touch any of the paths if given.
+func gitLog(revs string, paths ...string) (hashes []string, messages []string, err error) {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+	// Commits are separated by the NUL character, and the hash is separated from the raw
+	// message by a newline.
+	args := []string{"log", "-z", "--format=%H%n%B", revs}
+	if len(paths) > 0 {
+		args = append(append(args, "--"), paths...)
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	for _, entry := range strings.Split(stdout.String(), "\x00") {
+		if hash, message, ok := strings.Cut(entry, "\n"); ok {
+			hashes = append(hashes, hash)
+			messages = append(messages, message)
+		}
+	}
+	return hashes, messages, nil
+}
+
+// gitCreateTag creates an annotated tag pointing at rev, using the tag name as its message.
+func gitCreateTag(tag string, rev string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "tag", "--annotate", "--message", tag, tag, rev)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// gitArchive extracts the tree of rev into dir.
+func gitArchive(rev string, dir string) error {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+	cmd := exec.Command("git", "archive", "--format=tar", rev)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return extractTar(&stdout, dir)
+}
+
+// gitListFiles lists the files in dir at rev, without the subdirectories.
+func gitListFiles(rev string, dir string) ([]string, error) {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+	args := []string{"ls-tree", "--full-tree", rev}
+	if dir != "." {
+		args = append(args, filepath.ToSlash(dir)+"/")
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	var files []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		// <mode> SP <type> SP <object> TAB <file>
+		if info, file, ok := strings.Cut(line, "\t"); ok && strings.Fields(info)[1] == "blob" {
+			files = append(files, filepath.FromSlash(file))
+		}
+	}
+	return files, nil
+}
+
 func gitShow(branch string, file string) ([]byte, error) {
 	var (
 		stdout bytes.Buffer
@@ -207,7 +844,8 @@ func gitShow(branch string, file string) ([]byte, error) {
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		if strings.Contains(stderr.String(), fmt.Sprintf("but not in '%s'", branch)) {
+		if msg := stderr.String(); strings.Contains(msg, fmt.Sprintf("but not in '%s'", branch)) ||
+			strings.Contains(msg, fmt.Sprintf("does not exist in '%s'", branch)) {
 			return nil, fmt.Errorf("%w in %q", ErrFileDoesNotExist, branch)
 		}
 		return nil, fmt.Errorf("%s: %w", strings.Join(cmd.Args, " "), err)
@@ -224,88 +862,257 @@ const (
 	breakingChange
 )
 
-func diff(chd *changedDir) (change, error) {
-	var (
-		oldFileSet = token.NewFileSet()
-		newFileSet = token.NewFileSet()
-		oldAst     *ast.File
-		newAst     *ast.File
-	)
-	// Determine whether there are any additions or deletions to global variables,
-	// types, and functions.
-	var (
-		oldTypeMap = make(map[string]*ast.TypeSpec)
-		oldVarMap  = make(map[string]*ast.ValueSpec)
-		oldFuncMap = make(map[string]*ast.FuncDecl)
+func diff(chd *changedDir, oldSrc, newSrc source, opts *detectOptions) (*packageDiff, error) {
+	oldDecls, newDecls, err := loadDecls(chd, oldSrc, newSrc)
+	if err != nil {
+		return nil, err
+	}
+	return diffPlatforms(oldDecls, newDecls, opts), nil
+}
 
-		newTypeMap = make(map[string]*ast.TypeSpec)
-		newVarMap  = make(map[string]*ast.ValueSpec)
-		newFuncMap = make(map[string]*ast.FuncDecl)
+// loadDecls parses the old and new versions of the changed files of a package.
+func loadDecls(chd *changedDir, oldSrc, newSrc source) (*declSet, *declSet, error) {
+	var (
+		oldDecls = newDeclSet()
+		newDecls = newDeclSet()
 	)
 	// Compare all *ast.Decl under the same package uniformly to handle the situation
 	// where a *ast.Decl migrates from one file to another.
 	for _, oldFile := range chd.Olds {
-		// Attempting to find the "previous" commit record of the currently changed file in the git history,
-		// and parse its content into *ast.File (this will not be executed for new files, as new files do
-		// not have a git history of commits).
+		// Attempting to find the "previous" content of the currently changed file (usually from the git
+		// history), and parse its content into *ast.File (this will not be executed for new files, as new
+		// files do not have a git history of commits).
 		if oldFile != "" {
-			oldFileSrc, err := gitShow("HEAD", oldFile)
+			oldFileSrc, err := oldSrc.ReadFile(oldFile)
 			if err != nil && !errors.Is(err, ErrFileDoesNotExist) {
-				return noChange, err
+				return nil, nil, err
 			}
 			if oldFileSrc != nil {
-				oldAst, err = parser.ParseFile(oldFileSet, oldFile, oldFileSrc, 0)
-				if err != nil {
-					return noChange, err
+				if err = oldDecls.parseFile(oldFile, oldFileSrc); err != nil {
+					return nil, nil, err
 				}
-				inspectDecls(oldAst, oldTypeMap, oldVarMap, oldFuncMap)
 			}
 		}
 	}
 	for _, newFile := range chd.News {
 		if newFile != "" {
-			var err error
-			newAst, err = parser.ParseFile(newFileSet, newFile, nil, 0)
+			newFileSrc, err := newSrc.ReadFile(newFile)
 			if err != nil {
-				return noChange, err
+				return nil, nil, err
+			}
+			if err = newDecls.parseFile(newFile, newFileSrc); err != nil {
+				return nil, nil, err
 			}
-			inspectDecls(newAst, newTypeMap, newVarMap, newFuncMap)
 		}
 	}
-	var addition bool
+	// The other files of the package may declare types embedded in the changed files, or
+	// types embedding the changed ones.
+	var dir string
+	if len(chd.Olds) > 0 {
+		dir = filepath.Dir(chd.Olds[0])
+	} else if len(chd.News) > 0 {
+		dir = filepath.Dir(chd.News[0])
+	}
+	if err := oldDecls.parseContext(oldSrc, dir); err != nil {
+		return nil, nil, err
+	}
+	if err := newDecls.parseContext(newSrc, dir); err != nil {
+		return nil, nil, err
+	}
+	return oldDecls.api(), newDecls.api(), nil
+}
+
+// declSet holds the exported declarations of a package, indexed by the keys generated by
+// inspectDecls.
+type declSet struct {
+	Fset  *token.FileSet
+	Files []*ast.File
+	Types map[string]*ast.TypeSpec
+	Vars  map[string]*ast.ValueSpec
+	Funcs map[string]*ast.FuncDecl
+	// Annotations holds the annotations in the doc comments of the declarations.
+	Annotations annotations
+	// Context holds the unchanged files of the package, which are not compared but declare
+	// the types embedded in the types of Files, see packageMembers.
+	Context []*ast.File
+}
+
+func newDeclSet() *declSet {
+	return &declSet{
+		Fset:        token.NewFileSet(),
+		Types:       make(map[string]*ast.TypeSpec),
+		Vars:        make(map[string]*ast.ValueSpec),
+		Funcs:       make(map[string]*ast.FuncDecl),
+		Annotations: make(annotations),
+	}
+}
+
+func (ds *declSet) parseFile(filename string, src []byte) error {
+	f, err := parser.ParseFile(ds.Fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	ds.Files = append(ds.Files, f)
+	inspectDecls(f, ds.Types, ds.Vars, ds.Funcs)
+	inspectAnnotations(ds.Fset, f, ds.Annotations)
+	return nil
+}
+
+// parseContext parses the files in dir which are not in ds yet, and belong to the same
+// package, as Context.
+func (ds *declSet) parseContext(src source, dir string) error {
+	if len(ds.Files) == 0 {
+		return nil
+	}
+	files, err := src.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var (
+		parsed = make(map[string]bool)
+		others []*ast.File
+	)
+	for _, f := range ds.Files {
+		parsed[ds.Fset.Position(f.Package).Filename] = true
+	}
+	for _, file := range files {
+		if !isPackageFile(file) || parsed[file] {
+			continue
+		}
+		content, err := src.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		// The context is only needed for embedded types, files which do not parse or are
+		// never built, such as templates constrained by "//go:build ignore", are skipped.
+		f, err := parser.ParseFile(ds.Fset, file, content, parser.ParseComments)
+		if err != nil || isIgnored(file, f) {
+			continue
+		}
+		others = append(others, f)
+	}
+	name := packageName(ds.Fset, append(slices.Clip(ds.Files), others...))
+	for _, f := range others {
+		if f.Name.Name == name {
+			ds.Context = append(ds.Context, f)
+		}
+	}
+	return nil
+}
+
+// packageFiles returns the files of the package, both the compared ones and the context.
+func (ds *declSet) packageFiles() []*ast.File {
+	return append(slices.Clip(ds.Files), ds.Context...)
+}
+
+// isCommand reports whether ds holds a main package.
+func (ds *declSet) isCommand() bool {
+	return packageName(ds.Fset, ds.packageFiles()) == "main"
+}
+
+// api returns ds, or an empty declSet if ds holds a command: commands are not importable,
+// so they have no API at all.
+func (ds *declSet) api() *declSet {
+	if ds.isCommand() {
+		return newDeclSet()
+	}
+	return ds
+}
+
+// packageName returns the name of the package files belong to, which is told from the files
+// the go tool builds, since the others, such as generators constrained by "//go:build ignore",
+// may declare another package.
+func packageName(fset *token.FileSet, files []*ast.File) string {
+	for _, f := range files {
+		if !isIgnored(fset.Position(f.Package).Filename, f) {
+			return f.Name.Name
+		}
+	}
+	if len(files) > 0 {
+		return files[0].Name.Name
+	}
+	return ""
+}
+
+// diffDecls determines whether there are any additions, deletions or modifications to global
+// variables, types, and functions; opts may be nil.
+func diffDecls(oldDecls, newDecls *declSet, opts *detectOptions) *packageDiff {
+	var (
+		oldTypeMap = oldDecls.Types
+		oldVarMap  = oldDecls.Vars
+		oldFuncMap = oldDecls.Funcs
+
+		newTypeMap = newDecls.Types
+		newVarMap  = newDecls.Vars
+		newFuncMap = newDecls.Funcs
+	)
+	d := &differ{
+		oldFset:        oldDecls.Fset,
+		newFset:        newDecls.Fset,
+		constValues:    opts != nil && opts.ConstValues,
+		oldAnnotations: oldDecls.Annotations,
+		newAnnotations: newDecls.Annotations,
+	}
+	var (
+		oldTypes  = newTypeInferrer(oldDecls.packageFiles())
+		newTypes  = newTypeInferrer(newDecls.packageFiles())
+		oldConsts = newConstEvaluator(oldDecls.packageFiles())
+		newConsts = newConstEvaluator(newDecls.packageFiles())
+	)
 	for name, oldTypeSpec := range oldTypeMap {
 		newTypeSpec, ok := newTypeMap[name]
 		if !ok {
-			return breakingChange, nil
-		}
-		switch typeChange := typeDiff(oldTypeSpec, newTypeSpec); typeChange {
-		case breakingChange:
-			return breakingChange, nil
-		case somethingNew:
-			addition = true
-		default:
+			d.record(breakingChange, kindRemoved, oldTypeSpec.Name.Name, oldTypeSpec, nil,
+				"removed type %s", oldTypeSpec.Name.Name)
+			continue
 		}
+		d.typeDiff(oldTypeSpec, newTypeSpec)
 	}
 	for name, oldVarSpec := range oldVarMap {
+		oldIdent := valueIdent(name, oldVarSpec)
 		newVarSpec, ok := newVarMap[name]
 		if !ok {
-			return breakingChange, nil
+			d.record(breakingChange, kindRemoved, oldIdent.Name, oldIdent, nil,
+				"removed %s %s", valueKind(oldIdent), oldIdent.Name)
+			continue
 		}
-		if oldVarSpec.Type != nil && newVarSpec.Type != nil {
-			// Regarding the types in variable definitions, any modification is considered
-			// a breaking change.
-			if typeExprChange := typeExprDiff(oldVarSpec.Type, newVarSpec.Type); typeExprChange != noChange {
-				return breakingChange, nil
-			}
+		// Regarding the types in variable definitions, any modification is considered a
+		// breaking change; the types of values declared without one are inferred from their
+		// initializers, and are not compared if they cannot be.
+		newIdent := valueIdent(name, newVarSpec)
+		oldType, newType := oldTypes.typeOf(oldIdent.Name), newTypes.typeOf(newIdent.Name)
+		if oldType != nil && newType != nil && typeExprDiff(oldType, newType) != noChange &&
+			!(valueKind(newIdent) == "const" && untypedCompatible(oldType, newType, newConsts.value(newIdent.Name))) {
+			d.record(breakingChange, kindTypeChanged, newIdent.Name, oldIdent, newIdent,
+				"%s %s changed type from %s to %s", valueKind(newIdent), newIdent.Name, formatExpr(oldType), formatExpr(newType))
 		}
 		// The definition of constants and variables does not require judging whether
 		// their assignment expressions are consistent, because different expressions
-		// may produce the same value.
+		// may produce the same value; the values of constants are compared instead if
+		// asked to, as far as they can be evaluated.
+		if d.constValues && valueKind(oldIdent) == "const" {
+			oldValue, newValue := oldConsts.value(oldIdent.Name), newConsts.value(newIdent.Name)
+			if oldValue != nil && newValue != nil && !sameValue(oldValue, newValue) {
+				d.record(breakingChange, kindValueChanged, newIdent.Name, oldIdent, newIdent,
+					"value of const %s changed from %s to %s", newIdent.Name, formatValue(oldValue), formatValue(newValue))
+			}
+		}
 	}
+	var (
+		oldMethods = methodsByID(oldFuncMap)
+		newMethods = methodsByID(newFuncMap)
+	)
 	for name, oldFuncDecl := range oldFuncMap {
 		newFuncDecl, ok := newFuncMap[name]
 		if !ok {
-			return breakingChange, nil
+			if newFuncDecl, ok = newMethods[methodID(oldFuncDecl)]; ok {
+				d.record(breakingChange, kindReceiverChanged, funcName(newFuncDecl), oldFuncDecl, newFuncDecl,
+					"method %s receiver changed to %s", funcName(oldFuncDecl), formatExpr(newFuncDecl.Recv.List[0].Type))
+			} else {
+				d.record(breakingChange, kindRemoved, funcName(oldFuncDecl), oldFuncDecl, nil,
+					"removed %s %s", funcKind(oldFuncDecl), funcName(oldFuncDecl))
+			}
+			continue
 		}
 		// In the definition of functions and methods, any changes are considered breaking changes,
 		// including changes to the receiver type, type parameters, function parameters, function
@@ -313,27 +1120,45 @@ func diff(chd *changedDir) (change, error) {
 		// a breaking change), and situations where various types of parameters are added or removed.
 		oldFuncType, newFuncType := oldFuncDecl.Type, newFuncDecl.Type
 		if fieldsChange := posFieldsDiff(oldFuncType.TypeParams, newFuncType.TypeParams); fieldsChange != noChange {
-			return breakingChange, nil
+			d.typeParamsDiff(funcKind(newFuncDecl)+" "+funcName(newFuncDecl), funcName(newFuncDecl),
+				oldFuncDecl, newFuncDecl, oldFuncType.TypeParams, newFuncType.TypeParams)
 		}
-		if fieldsChange := posFieldsDiff(oldFuncType.Params, newFuncType.Params); fieldsChange != noChange {
-			return breakingChange, nil
-		}
-		if fieldsChange := posFieldsDiff(oldFuncType.Results, newFuncType.Results); fieldsChange != noChange {
-			return breakingChange, nil
+		if posFieldsDiff(oldFuncType.Params, newFuncType.Params) != noChange ||
+			posFieldsDiff(oldFuncType.Results, newFuncType.Results) != noChange {
+			d.record(breakingChange, kindSignatureChanged, funcName(newFuncDecl), oldFuncDecl, newFuncDecl,
+				"signature of %s %s changed from %s to %s", funcKind(newFuncDecl), funcName(newFuncDecl),
+				formatSignature(oldFuncType), formatSignature(newFuncType))
 		}
 	}
 	// At this point, all *ast.Decl in the content of old files have been matched one-to-one with
-	// *ast.Decl in the content of new files. If at this time, the number of *ast.Decl in the new
-	// file content is more than that in the old files, it indicates that there are additional
-	// types, variables, or functions.
-	addition = addition ||
-		len(newTypeMap) > len(oldTypeMap) ||
-		len(newVarMap) > len(oldVarMap) ||
-		len(newFuncMap) > len(oldFuncMap)
-	if addition {
-		return somethingNew, nil
+	// *ast.Decl in the content of new files. Any *ast.Decl left in the new file content indicates
+	// that there are additional types, variables, or functions.
+	for name, newTypeSpec := range newTypeMap {
+		if _, ok := oldTypeMap[name]; !ok {
+			d.record(somethingNew, kindAdded, newTypeSpec.Name.Name, nil, newTypeSpec,
+				"added type %s", newTypeSpec.Name.Name)
+		}
+	}
+	for name, newVarSpec := range newVarMap {
+		if _, ok := oldVarMap[name]; !ok {
+			newIdent := valueIdent(name, newVarSpec)
+			d.record(somethingNew, kindAdded, newIdent.Name, nil, newIdent,
+				"added %s %s", valueKind(newIdent), newIdent.Name)
+		}
 	}
-	return justPatch, nil
+	for name, newFuncDecl := range newFuncMap {
+		if _, ok := oldFuncMap[name]; !ok {
+			if _, ok = oldMethods[methodID(newFuncDecl)]; ok {
+				// Already reported as a change of the receiver.
+				continue
+			}
+			d.record(somethingNew, kindAdded, funcName(newFuncDecl), nil, newFuncDecl,
+				"added %s %s", funcKind(newFuncDecl), funcName(newFuncDecl))
+		}
+	}
+	d.promotedDiff(newPackageMembers(oldDecls.packageFiles()), newPackageMembers(newDecls.packageFiles()))
+	d.deprecationDiff()
+	return d.result()
 }
 
 const pointerTypePrefix = "PointerType_"
@@ -344,17 +1169,8 @@ func inspectDecls(
 	varMap map[string]*ast.ValueSpec,
 	funcMap map[string]*ast.FuncDecl,
 ) {
-	// If a file comes with a build tag, then all *ast.Decl under that file will
-	// carry the prefix of the build tag included in that file.
-	//
-	// This also means that moving a public type, variable, or function from a
-	// file without build tags to one with build tags, or vice versa, will be
-	// considered a breaking change; the recommended best practice is to only
-	// place private types, variables, and functions in files with build tags.
-	var prefix string
-	if tags := buildTags(file); tags != "" {
-		prefix = tags + "_"
-	}
+	// Build constraints are not part of the keys: the files built on each platform are
+	// selected before their declarations are inspected, see declSet.forPlatform.
 	decls := file.Decls
 	for _, decl := range decls {
 		if genDecl, isGenDecl := decl.(*ast.GenDecl); isGenDecl {
@@ -363,7 +1179,7 @@ func inspectDecls(
 				for _, spec := range genDecl.Specs {
 					if typeSpec, isTypeSpec := spec.(*ast.TypeSpec); isTypeSpec {
 						if name := typeSpec.Name.String(); ast.IsExported(name) {
-							typeMap[prefix+name] = typeSpec
+							typeMap[name] = typeSpec
 						}
 					}
 				}
@@ -372,7 +1188,7 @@ func inspectDecls(
 					if varSpec, isVarSpec := spec.(*ast.ValueSpec); isVarSpec {
 						for _, ident := range varSpec.Names {
 							if name := ident.String(); ast.IsExported(name) {
-								varMap[prefix+name] = varSpec
+								varMap[name] = varSpec
 							}
 						}
 					}
@@ -410,59 +1226,122 @@ func inspectDecls(
 				b.WriteString(name)
 				typeStr := b.String()
 				if ptrRecv {
-					funcMap[prefix+pointerTypePrefix+typeStr] = funcDecl
+					funcMap[pointerTypePrefix+typeStr] = funcDecl
 				} else {
-					funcMap[prefix+typeStr] = funcDecl
+					funcMap[typeStr] = funcDecl
 				}
 			}
 		}
 	}
 }
 
-func buildTags(file *ast.File) string {
-	const (
-		goBuildPrefix   = "//go:build"
-		plusBuildPrefix = "// +build"
-	)
-	tags := make([]string, 0, 2)
-	for _, group := range file.Comments {
-		for _, comment := range group.List {
-			if tag, ok := strings.CutPrefix(comment.Text, goBuildPrefix); ok {
-				tags = append(tags, strings.TrimSpace(tag))
+func (d *differ) typeDiff(oldType, newType *ast.TypeSpec) {
+	name := newType.Name.Name
+	if genericChange := posFieldsDiff(oldType.TypeParams, newType.TypeParams); genericChange != noChange {
+		d.typeParamsDiff("type "+name, name, oldType, newType, oldType.TypeParams, newType.TypeParams)
+	}
+	if (oldType.Assign != token.NoPos) != (newType.Assign != token.NoPos) {
+		d.record(breakingChange, kindTypeChanged, name, oldType, newType,
+			"type %s changed from %s to %s", name, typeSpecKind(oldType), typeSpecKind(newType))
+	}
+	// Struct fields and interface methods are compared one by one, so that each of them
+	// can be explained separately.
+	switch oldTypeExpr := oldType.Type.(type) {
+	case *ast.StructType:
+		if newTypeExpr, ok := newType.Type.(*ast.StructType); ok && oldTypeExpr.Incomplete == newTypeExpr.Incomplete {
+			for _, fc := range namedFieldsChanges(oldTypeExpr.Fields, newTypeExpr.Fields, true) {
+				d.recordField(name, fc, false)
 			}
-			if tag, ok := strings.CutPrefix(comment.Text, plusBuildPrefix); ok {
-				tags = append(tags, strings.TrimSpace(tag))
+			return
+		}
+	case *ast.InterfaceType:
+		if newTypeExpr, ok := newType.Type.(*ast.InterfaceType); ok && oldTypeExpr.Incomplete == newTypeExpr.Incomplete {
+			for _, fc := range namedFieldsChanges(oldTypeExpr.Methods, newTypeExpr.Methods, false) {
+				d.recordField(name, fc, true)
 			}
+			return
 		}
 	}
-	if len(tags) == 0 {
-		return ""
+	if typeExprChange := typeExprDiff(oldType.Type, newType.Type); typeExprChange != noChange {
+		d.record(typeExprChange, kindTypeChanged, name, oldType, newType,
+			"type %s changed from %s to %s", name, formatExpr(oldType.Type), formatExpr(newType.Type))
 	}
-	slices.Sort(tags)
-	return strings.Map(
-		func(r rune) rune {
-			if unicode.IsSpace(r) {
-				return '_'
-			} else {
-				return r
+}
+
+// recordField records a change of a struct field, or of an interface method if isInterface
+// is true; for interfaces, any modification is considered a breaking change.
+func (d *differ) recordField(typeName string, fc fieldChange, isInterface bool) {
+	var (
+		symbol = typeName + "." + fc.Name
+		noun   = "field"
+		kind   = fc.Kind
+		chg    = fc.Change
+	)
+	switch {
+	case isInterface && fc.Embedded:
+		noun = "embedded interface"
+	case isInterface:
+		noun = "method"
+	case fc.Embedded:
+		noun = "embedded field"
+	}
+	if isInterface {
+		chg = breakingChange
+		switch kind {
+		case kindFieldRemoved:
+			kind = kindMethodRemoved
+		case kindFieldAdded:
+			kind = kindMethodAdded
+		case kindTypeChanged:
+			if !fc.Embedded {
+				kind = kindSignatureChanged
 			}
-		},
-		strings.Join(tags, "_"),
+		}
+	}
+	var (
+		oldNode ast.Node
+		newNode ast.Node
 	)
+	if fc.Old != nil {
+		oldNode = fc.Old
+	}
+	if fc.New != nil {
+		newNode = fc.New
+	}
+	switch fc.Kind {
+	case kindFieldRemoved:
+		d.record(chg, kind, symbol, oldNode, newNode, "removed %s %s", noun, symbol)
+	case kindFieldAdded:
+		d.record(chg, kind, symbol, oldNode, newNode, "added %s %s", noun, symbol)
+	case kindTypeChanged:
+		format := "%s %s changed type from %s to %s"
+		if isInterface {
+			format = "%s %s changed from %s to %s"
+		}
+		d.record(chg, kind, symbol, oldNode, newNode, format, noun, symbol, formatExpr(fc.Old.Type), formatExpr(fc.New.Type))
+	case kindTagAdded:
+		d.record(chg, kind, symbol, oldNode, newNode, "added tag %s to %s %s", fc.New.Tag.Value, noun, symbol)
+	case kindTagRemoved:
+		d.record(chg, kind, symbol, oldNode, newNode, "removed tag %s from %s %s", fc.Old.Tag.Value, noun, symbol)
+	case kindTagChanged:
+		d.record(chg, kind, symbol, oldNode, newNode, "tag of %s %s changed from %s to %s", noun, symbol,
+			fc.Old.Tag.Value, fc.New.Tag.Value)
+	}
 }
 
-func typeDiff(oldType, newType *ast.TypeSpec) change {
-	// Any changes to the generic parameters in the type definition will be considered as breaking changes.
-	if genericChange := posFieldsDiff(oldType.TypeParams, newType.TypeParams); genericChange != noChange {
-		return breakingChange
-	}
-	if (oldType.Assign != token.NoPos) != (newType.Assign != token.NoPos) {
-		return breakingChange
+// typeParamsDiff records the changes to the type parameters of the generic type or func
+// described by what, see typeParamsChanges; any other change to them is a breaking change.
+func (d *differ) typeParamsDiff(what, symbol string, oldNode, newNode ast.Node, oldTypeParams, newTypeParams *ast.FieldList) {
+	changes, ok := typeParamsChanges(what, astTypeParams(oldTypeParams), astTypeParams(newTypeParams))
+	if !ok {
+		d.record(breakingChange, kindTypeParamsChanged, symbol, oldNode, newNode,
+			"type parameters of %s changed from %s to %s", what,
+			formatTypeParams(oldTypeParams), formatTypeParams(newTypeParams))
+		return
 	}
-	if typeExprChange := typeExprDiff(oldType.Type, newType.Type); typeExprChange != noChange {
-		return typeExprChange
+	for _, c := range changes {
+		d.record(c.Change, kindTypeParamsChanged, symbol, oldNode, newNode, "%s", c.Reason)
 	}
-	return noChange
 }
 
 func posFieldsDiff(oldFields, newFields *ast.FieldList) change {
@@ -487,7 +1366,7 @@ func posFieldsDiff(oldFields, newFields *ast.FieldList) change {
 	return noChange
 }
 
-func namedFieldsDiff(oldFields, newFields *ast.FieldList) change {
+func namedFieldsDiff(oldFields, newFields *ast.FieldList, exportedOnly bool) change {
 	if oldFields == nil && newFields == nil {
 		return noChange
 	}
@@ -497,65 +1376,122 @@ func namedFieldsDiff(oldFields, newFields *ast.FieldList) change {
 	if oldFields == nil {
 		return somethingNew
 	}
+	var fieldsChange change
+	for _, fc := range namedFieldsChanges(oldFields, newFields, exportedOnly) {
+		if fc.Change > fieldsChange {
+			fieldsChange = fc.Change
+		}
+	}
+	return fieldsChange
+}
+
+// fieldChange describes how a single field of a struct, or a single method of an interface,
+// has changed.
+type fieldChange struct {
+	Name     string
+	Embedded bool
+	Kind     string
+	Change   change
+	Old      *ast.Field
+	New      *ast.Field
+}
+
+// namedFieldsChanges matches fields by their names and lists the changes of each field. When
+// exportedOnly is true, named fields that are not exported will be ignored, since they are not
+// accessible from other packages.
+func namedFieldsChanges(oldFields, newFields *ast.FieldList, exportedOnly bool) []fieldChange {
 	var (
-		oldFieldsMap = make(map[string]*ast.Field)
-		newFieldsMap = make(map[string]*ast.Field)
+		oldFieldsMap = fieldsByName(oldFields, exportedOnly)
+		newFieldsMap = fieldsByName(newFields, exportedOnly)
+		changes      []fieldChange
 	)
-	// For anonymous fields, we use their type name as the field name,
-	// along with a prefix indicating whether it is a pointer type.
-	for _, field := range oldFields.List {
-		if field.Names == nil {
-			if field.Type != nil {
-				typeIdent, isPtr := getTypeIdent(field.Type)
-				if isPtr {
-					typeIdent = pointerTypePrefix + typeIdent
-				}
-				oldFieldsMap[typeIdent] = field
-			}
-		} else {
-			for _, name := range field.Names {
-				oldFieldsMap[name.String()] = field
+	for name, oldField := range oldFieldsMap {
+		newField, ok := newFieldsMap[name]
+		if !ok {
+			changes = append(changes, fieldChange{
+				Name:     fieldName(name, oldField),
+				Embedded: oldField.Names == nil,
+				Kind:     kindFieldRemoved,
+				Change:   breakingChange,
+				Old:      oldField,
+			})
+			continue
+		}
+		if typeExprChange := typeExprDiff(oldField.Type, newField.Type); typeExprChange != noChange {
+			changes = append(changes, fieldChange{
+				Name:     fieldName(name, newField),
+				Embedded: newField.Names == nil,
+				Kind:     kindTypeChanged,
+				Change:   typeExprChange,
+				Old:      oldField,
+				New:      newField,
+			})
+		}
+		if tagChange := tagDiff(oldField.Tag, newField.Tag); tagChange != noChange {
+			kind := kindTagChanged
+			if oldField.Tag == nil {
+				kind = kindTagAdded
+			} else if newField.Tag == nil {
+				kind = kindTagRemoved
 			}
+			changes = append(changes, fieldChange{
+				Name:     fieldName(name, newField),
+				Embedded: newField.Names == nil,
+				Kind:     kind,
+				Change:   tagChange,
+				Old:      oldField,
+				New:      newField,
+			})
 		}
 	}
-	for _, field := range newFields.List {
+	for name, newField := range newFieldsMap {
+		if _, ok := oldFieldsMap[name]; !ok {
+			changes = append(changes, fieldChange{
+				Name:     fieldName(name, newField),
+				Embedded: newField.Names == nil,
+				Kind:     kindFieldAdded,
+				Change:   somethingNew,
+				New:      newField,
+			})
+		}
+	}
+	return changes
+}
+
+// fieldsByName indexes fields by their names. For anonymous fields, we use their type name as
+// the field name, along with a prefix indicating whether it is a pointer type.
+func fieldsByName(fields *ast.FieldList, exportedOnly bool) map[string]*ast.Field {
+	fieldsMap := make(map[string]*ast.Field)
+	if fields == nil {
+		return fieldsMap
+	}
+	for _, field := range fields.List {
 		if field.Names == nil {
 			if field.Type != nil {
 				typeIdent, isPtr := getTypeIdent(field.Type)
 				if isPtr {
 					typeIdent = pointerTypePrefix + typeIdent
 				}
-				newFieldsMap[typeIdent] = field
+				fieldsMap[typeIdent] = field
 			}
 		} else {
 			for _, name := range field.Names {
-				newFieldsMap[name.String()] = field
+				if exportedOnly && !name.IsExported() {
+					continue
+				}
+				fieldsMap[name.String()] = field
 			}
 		}
 	}
-	for name, oldField := range oldFieldsMap {
-		newField, ok := newFieldsMap[name]
-		if !ok {
-			return breakingChange
-		}
-		if fieldChange := fieldDiff(oldField, newField); fieldChange != noChange {
-			return fieldChange
-		}
-	}
-	if oldFields.NumFields() < newFields.NumFields() {
-		return somethingNew
-	}
-	return noChange
+	return fieldsMap
 }
 
-func fieldDiff(oldField, newField *ast.Field) change {
-	if typeExprChange := typeExprDiff(oldField.Type, newField.Type); typeExprChange != noChange {
-		return typeExprChange
+// fieldName returns the name used to present a field, which is the type for anonymous fields.
+func fieldName(key string, field *ast.Field) string {
+	if field.Names == nil {
+		return formatExpr(field.Type)
 	}
-	if tagChange := tagDiff(oldField.Tag, newField.Tag); tagChange != noChange {
-		return tagChange
-	}
-	return noChange
+	return key
 }
 
 func typeExprDiff(oldTypeExpr, newTypeExpr ast.Expr) change {
@@ -592,13 +1528,13 @@ func typeExprDiff(oldTypeExpr, newTypeExpr ast.Expr) change {
 		//  - deleting public fields is considered a breaking change;
 		//  - changing the type of public fields is considered a breaking change;
 		//  - deleting or changing private fields is not considered a breaking change;
-		//  - adding any field is not considered a breaking change;
+		//  - adding public fields is not considered a breaking change, private fields are ignored;
 		//  - changing tag information is not considered a breaking change;
 		oldStructType, newStructType := oldTypeExpr.(*ast.StructType), newTypeExpr.(*ast.StructType)
 		if oldStructType.Incomplete != newStructType.Incomplete {
 			return breakingChange
 		}
-		if fieldsChange := namedFieldsDiff(oldStructType.Fields, newStructType.Fields); fieldsChange != noChange {
+		if fieldsChange := namedFieldsDiff(oldStructType.Fields, newStructType.Fields, true); fieldsChange != noChange {
 			return fieldsChange
 		}
 	case *ast.FuncType:
@@ -619,7 +1555,7 @@ func typeExprDiff(oldTypeExpr, newTypeExpr ast.Expr) change {
 		if oldInterfaceType.Incomplete != newInterfaceType.Incomplete {
 			return breakingChange
 		}
-		if fieldsChange := namedFieldsDiff(oldInterfaceType.Methods, newInterfaceType.Methods); fieldsChange != noChange {
+		if fieldsChange := namedFieldsDiff(oldInterfaceType.Methods, newInterfaceType.Methods, false); fieldsChange != noChange {
 			return breakingChange
 		}
 	case *ast.MapType:
@@ -715,3 +1651,88 @@ func formatExpr(expr ast.Expr) string {
 	printer.Fprint(&formatter, token.NewFileSet(), expr)
 	return formatter.String()
 }
+
+func formatTypeParams(typeParams *ast.FieldList) string {
+	if typeParams == nil || len(typeParams.List) == 0 {
+		return "no type parameters"
+	}
+	params := make([]string, 0, len(typeParams.List))
+	for _, field := range typeParams.List {
+		var names []string
+		for _, name := range field.Names {
+			names = append(names, name.Name)
+		}
+		params = append(params, strings.Join(names, ", ")+" "+formatExpr(field.Type))
+	}
+	return "[" + strings.Join(params, ", ") + "]"
+}
+
+// formatSignature formats a function type without its type parameters, which are
+// reported separately.
+func formatSignature(funcType *ast.FuncType) string {
+	return formatExpr(&ast.FuncType{Params: funcType.Params, Results: funcType.Results})
+}
+
+func typeSpecKind(typeSpec *ast.TypeSpec) string {
+	if typeSpec.Assign != token.NoPos {
+		return "an alias"
+	}
+	return "a defined type"
+}
+
+// funcName returns the name used to present a function or method, such as "Foo",
+// "T.M" or "(*T).M".
+func funcName(funcDecl *ast.FuncDecl) string {
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+		return funcDecl.Name.Name
+	}
+	typeIdent, isPtr := getTypeIdent(funcDecl.Recv.List[0].Type)
+	if isPtr {
+		return "(*" + typeIdent + ")." + funcDecl.Name.Name
+	}
+	return typeIdent + "." + funcDecl.Name.Name
+}
+
+func funcKind(funcDecl *ast.FuncDecl) string {
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+		return "func"
+	}
+	return "method"
+}
+
+// methodID identifies a method regardless of whether its receiver is a pointer, it
+// returns an empty string for functions.
+func methodID(funcDecl *ast.FuncDecl) string {
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+		return ""
+	}
+	typeIdent, _ := getTypeIdent(funcDecl.Recv.List[0].Type)
+	return typeIdent + "." + funcDecl.Name.Name
+}
+
+func methodsByID(funcMap map[string]*ast.FuncDecl) map[string]*ast.FuncDecl {
+	methods := make(map[string]*ast.FuncDecl)
+	for _, funcDecl := range funcMap {
+		if id := methodID(funcDecl); id != "" {
+			methods[id] = funcDecl
+		}
+	}
+	return methods
+}
+
+// valueIdent finds the identifier in varSpec that key was created for.
+func valueIdent(key string, varSpec *ast.ValueSpec) *ast.Ident {
+	for _, ident := range varSpec.Names {
+		if key == ident.Name {
+			return ident
+		}
+	}
+	return varSpec.Names[0]
+}
+
+func valueKind(ident *ast.Ident) string {
+	if ident.Obj != nil && ident.Obj.Kind == ast.Con {
+		return "const"
+	}
+	return "var"
+}
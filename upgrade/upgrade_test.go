@@ -1,8 +1,25 @@
 package upgrade
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParse(t *testing.T) {
@@ -35,6 +52,23 @@ func TestParse(t *testing.T) {
 				Patch: 4,
 			},
 		},
+		{
+			Version: "v1.3.0-rc.1+build.5",
+			Want: SemanticVersion{
+				Major:      1,
+				Minor:      3,
+				Patch:      0,
+				Prerelease: "rc.1",
+				Build:      "build.5",
+			},
+		},
+		{
+			Version: "v2.0.0+20240501",
+			Want: SemanticVersion{
+				Major: 2,
+				Build: "20240501",
+			},
+		},
 	}
 	for _, tc := range testcases {
 		sv, err := parse(tc.Version)
@@ -48,3 +82,2258 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMalformed(t *testing.T) {
+	for _, version := range []string{"v1.2", "v1.2.x", "v1.2.3-", "v1.2.3-rc..1", "v1.2.3-01", "v1.2.3+"} {
+		if _, err := parse(version); err == nil {
+			t.Errorf("parse: want error for %q", version)
+			return
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// Taken from the example in SemVer 2.0 §11, in ascending order of precedence.
+	versions := []string{
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-alpha.beta",
+		"v1.0.0-beta",
+		"v1.0.0-beta.2",
+		"v1.0.0-beta.11",
+		"v1.0.0-beta.99999999999999999999",
+		"v1.0.0-beta.100000000000000000000",
+		"v1.0.0-beta.-1",
+		"v1.0.0-rc.1",
+		"v1.0.0",
+		"v1.0.1",
+		"v1.1.0",
+		"v2.0.0",
+	}
+	for i := 1; i < len(versions); i++ {
+		lo, _ := parse(versions[i-1])
+		hi, _ := parse(versions[i])
+		if lo.Compare(hi) != -1 || hi.Compare(lo) != +1 {
+			t.Errorf("compare: want %s < %s", lo, hi)
+			return
+		}
+	}
+	x, _ := parse("v1.0.0+a")
+	y, _ := parse("v1.0.0+b")
+	if x.Compare(y) != 0 {
+		t.Errorf("compare: build metadata should be ignored")
+	}
+}
+
+func TestNext(t *testing.T) {
+	type testcase struct {
+		Version string
+		Change  change
+		Pre     string
+		Promote bool
+		Want    string
+	}
+	var testcases = []testcase{
+		{Version: "v1.2.3", Change: justPatch, Want: "v1.2.4"},
+		{Version: "v1.2.3", Change: breakingChange, Want: "v2.0.0"},
+		{Version: "v0.2.3", Change: breakingChange, Want: "v0.3.0"},
+		{Version: "v1.2.3+build.1", Change: somethingNew, Want: "v1.3.0"},
+		{Version: "v1.3.0-rc.2", Change: justPatch, Want: "v1.3.0-rc.3"},
+		{Version: "v1.3.0-rc.2", Change: somethingNew, Want: "v1.3.0-rc.3"},
+		{Version: "v1.3.0-rc.2", Change: breakingChange, Want: "v2.0.0-rc.1"},
+		{Version: "v1.3.0-rc.2", Change: justPatch, Promote: true, Want: "v1.3.0"},
+		{Version: "v1.3.0-rc.2", Change: noChange, Promote: true, Want: "v1.3.0"},
+		{Version: "v1.3.1-rc.1", Change: somethingNew, Promote: true, Want: "v1.4.0"},
+		{Version: "v1.2.5", Change: somethingNew, Pre: "rc", Want: "v1.3.0-rc.1"},
+		{Version: "v1.3.0-beta.4", Change: justPatch, Pre: "rc", Want: "v1.3.0-rc.1"},
+		{Version: "v1.3.0-beta", Change: justPatch, Pre: "beta", Want: "v1.3.0-beta.1"},
+	}
+	for _, tc := range testcases {
+		sv, err := parse(tc.Version)
+		if err != nil {
+			t.Errorf("parse: %s", err)
+			return
+		}
+		var next SemanticVersion
+		switch {
+		case tc.Pre != "":
+			next = sv.NextPrerelease(tc.Change, tc.Pre)
+		case tc.Promote:
+			next = sv.Promote(tc.Change)
+		default:
+			next = sv.Next(tc.Change)
+		}
+		if next.String() != tc.Want {
+			t.Errorf("next: %s with change %d, want %s, got %s", tc.Version, tc.Change, tc.Want, next)
+			return
+		}
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	type testcase struct {
+		Tag    string
+		Prefix string
+		Want   bool
+	}
+	var testcases = []testcase{
+		{Tag: "v1.2.3", Want: true},
+		{Tag: "v1.3.0-rc.1", Want: true},
+		{Tag: "1.2.3", Want: false},
+		{Tag: "v1.2", Want: false},
+		{Tag: "v1.2.3 beta", Want: false},
+		{Tag: "release-1", Want: false},
+		{Tag: "sub/module/v1.2.3", Want: false},
+		{Tag: "sub/module/v1.2.3", Prefix: "sub/module/", Want: true},
+		{Tag: "sub/v1.2.3", Prefix: "sub/module/", Want: false},
+		{Tag: "v1.2.3", Prefix: "sub/module/", Want: false},
+	}
+	for _, tc := range testcases {
+		if _, ok := parseTag(tc.Tag, tc.Prefix); ok != tc.Want {
+			t.Errorf("parseTag: %q with prefix %q, want %v, got %v", tc.Tag, tc.Prefix, tc.Want, ok)
+			return
+		}
+	}
+}
+
+// mapSource serves files from memory, so that comparisons can be tested without git.
+type mapSource map[string]string
+
+func (src mapSource) ReadFile(name string) ([]byte, error) {
+	content, ok := src[name]
+	if !ok {
+		return nil, fmt.Errorf("%w in memory", ErrFileDoesNotExist)
+	}
+	return []byte(content), nil
+}
+
+func (src mapSource) ReadDir(name string) ([]string, error) {
+	var files []string
+	for file := range src {
+		if filepath.Dir(file) == name {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func diffSources(t *testing.T, oldSrc, newSrc mapSource) *packageDiff {
+	t.Helper()
+	chd := &changedDir{}
+	for name := range oldSrc {
+		chd.Olds = append(chd.Olds, name)
+	}
+	for name := range newSrc {
+		chd.News = append(chd.News, name)
+	}
+	sort.Strings(chd.Olds)
+	sort.Strings(chd.News)
+	pkg, err := diff(chd, oldSrc, newSrc, nil)
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	return pkg
+}
+
+func TestDiff(t *testing.T) {
+	type testcase struct {
+		Name    string
+		Old     string
+		New     string
+		Want    change
+		Reasons []string
+	}
+	var testcases = []testcase{
+		{
+			Name: "private changes",
+			Old:  "package p\ntype T struct{ a int }\nfunc f() {}",
+			New:  "package p\ntype T struct{ b string }\nfunc g() {}",
+			Want: justPatch,
+		},
+		{
+			Name: "unexported field added",
+			Old:  "package p\ntype T struct{ X int }",
+			New:  "package p\ntype T struct{ X int; y []int }",
+			Want: justPatch,
+		},
+		{
+			Name:    "added func",
+			Old:     "package p\nfunc Foo() {}",
+			New:     "package p\nfunc Foo() {}\nfunc Bar() {}",
+			Want:    somethingNew,
+			Reasons: []string{"added func Bar"},
+		},
+		{
+			Name:    "removed func and changed field",
+			Old:     "package p\ntype Bar struct{ X int }\nfunc Foo() {}",
+			New:     "package p\ntype Bar struct{ X int64 }",
+			Want:    breakingChange,
+			Reasons: []string{"field Bar.X changed type from int to int64", "removed func Foo"},
+		},
+		{
+			Name:    "receiver changed",
+			Old:     "package p\ntype T int\nfunc (T) M() {}",
+			New:     "package p\ntype T int\nfunc (*T) M() {}",
+			Want:    breakingChange,
+			Reasons: []string{"method T.M receiver changed to *T"},
+		},
+		{
+			Name:    "tags",
+			Old:     "package p\ntype T struct{ X int `json:\"x\"`; Y int `json:\"y\"` }",
+			New:     "package p\ntype T struct{ X int `json:\"x,omitempty\"`; Y int }",
+			Want:    breakingChange,
+			Reasons: []string{"removed tag `json:\"y\"` from field T.Y", "tag of field T.X changed from `json:\"x\"` to `json:\"x,omitempty\"`"},
+		},
+		{
+			Name:    "interface method added",
+			Old:     "package p\ntype I interface{ M() }",
+			New:     "package p\ntype I interface{ M(); N() }",
+			Want:    breakingChange,
+			Reasons: []string{"added method I.N"},
+		},
+		{
+			Name:    "constraint loosened",
+			Old:     "package p\nfunc Sum[T int](xs ...T) T { return 0 }",
+			New:     "package p\nfunc Sum[T ~int | ~int64](xs ...T) T { return 0 }",
+			Want:    somethingNew,
+			Reasons: []string{"constraint of type parameter T of func Sum loosened from int to ~int | ~int64"},
+		},
+		{
+			Name:    "constraint tightened",
+			Old:     "package p\ntype Set[K comparable] map[K]bool",
+			New:     "package p\ntype Set[K interface{ ~string | ~int }] map[K]bool",
+			Want:    breakingChange,
+			Reasons: []string{"constraint of type parameter K of type Set tightened from comparable to interface{ ~string | ~int }"},
+		},
+		{
+			Name: "equivalent constraints",
+			Old:  "package p\nfunc F[T int | string, U any]() {}",
+			New:  "package p\nfunc F[T string | int, U interface{}]() {}",
+			Want: justPatch,
+		},
+		{
+			Name:    "constraint declared elsewhere",
+			Old:     "package p\nfunc F[T Number]() {}",
+			New:     "package p\nfunc F[T Integer]() {}",
+			Want:    breakingChange,
+			Reasons: []string{"type parameters of func F changed from [T Number] to [T Integer]"},
+		},
+		{
+			Name:    "inferred var type changed",
+			Old:     "package p\ntype Client struct{}\nfunc newClient() *Client { return nil }\nvar Default = newClient()",
+			New:     "package p\ntype Client struct{}\nvar Default = Client{}",
+			Want:    breakingChange,
+			Reasons: []string{"var Default changed type from *Client to Client"},
+		},
+		{
+			Name: "inferred types unchanged",
+			Old:  "package p\ntype Client struct{}\nvar Default *Client = &Client{}\nvar Retries = 3\nconst Timeout = 1.5\nconst Name string = \"p\"",
+			New:  "package p\ntype Client struct{}\nfunc newClient() (*Client, error) { return nil, nil }\nvar Default, err = newClient()\nvar Retries = int(3)\nconst Timeout = 3 / 2.0\nconst Name = \"p\"",
+			Want: justPatch,
+		},
+		{
+			Name:    "iota block typed",
+			Old:     "package p\ntype Color int\nconst (\n\tRed = iota\n\tGreen\n)",
+			New:     "package p\ntype Color int\nconst (\n\tRed Color = iota\n\tGreen\n)",
+			Want:    breakingChange,
+			Reasons: []string{"const Red changed type from untyped int to Color", "const Green changed type from untyped int to Color"},
+		},
+		{
+			Name:    "untyped value not representable",
+			Old:     "package p\nconst Max uint8 = 255",
+			New:     "package p\nconst Max = 256",
+			Want:    breakingChange,
+			Reasons: []string{"const Max changed type from uint8 to untyped int"},
+		},
+	}
+	for _, tc := range testcases {
+		pkg := diffSources(t, mapSource{"p/p.go": tc.Old}, mapSource{"p/p.go": tc.New})
+		if pkg.Change != tc.Want {
+			t.Errorf("diff: %s, want %s, got %s", tc.Name, tc.Want, pkg.Change)
+			return
+		}
+		var reasons []string
+		for _, f := range pkg.Findings {
+			reasons = append(reasons, f.Reason)
+		}
+		if !reflect.DeepEqual(reasons, tc.Reasons) {
+			t.Errorf("diff: %s, want reasons %q, got %q", tc.Name, tc.Reasons, reasons)
+			return
+		}
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	pkg := diffSources(t, mapSource{"p/p.go": "package p\nfunc Foo() {}"}, mapSource{"p/p.go": "package p\nfunc Bar() {}"})
+	pkg.Dir = "p"
+	rep := newReport()
+	rep.add(pkg)
+	rep.Old, _ = parse("v1.2.3")
+	rep.Next = rep.Old.Next(rep.Change)
+	var buf bytes.Buffer
+	if err := rep.writeJSON(&buf); err != nil {
+		t.Fatalf("writeJSON: %s", err)
+	}
+	var got struct {
+		Old      string
+		Next     string
+		Change   string
+		Packages []struct {
+			Dir      string
+			Findings []map[string]any
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if got.Old != "v1.2.3" || got.Next != "v2.0.0" || got.Change != "breaking" {
+		t.Errorf("writeJSON: unexpected versions or change in %s", buf.String())
+		return
+	}
+	if len(got.Packages) != 1 || len(got.Packages[0].Findings) != 2 {
+		t.Errorf("writeJSON: unexpected packages in %s", buf.String())
+		return
+	}
+	removed := got.Packages[0].Findings[0]
+	if removed["symbol"] != "Foo" || removed["old_pos"] == nil || removed["new_pos"] != nil {
+		t.Errorf("writeJSON: unexpected finding %v", removed)
+	}
+}
+
+func checkSource(t *testing.T, fset *token.FileSet, src string) *types.Package {
+	t.Helper()
+	f, err := parser.ParseFile(fset, "p/p.go", src, 0)
+	if err != nil {
+		t.Fatalf("parser.ParseFile: %s", err)
+	}
+	conf := &types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("example.com/p", fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatalf("types.Check: %s", err)
+	}
+	return pkg
+}
+
+func TestTypesDiff(t *testing.T) {
+	type testcase struct {
+		Name    string
+		Old     string
+		New     string
+		Want    change
+		Reasons []string
+	}
+	var testcases = []testcase{
+		{
+			Name: "alias is identical",
+			Old:  "package p\ntype ID = int\ntype T struct{ X int }\nfunc F(int) {}",
+			New:  "package p\ntype ID = int\ntype T struct{ X ID }\nfunc F(id ID) {}",
+			Want: justPatch,
+		},
+		{
+			Name: "typed constant to untyped",
+			Old:  "package p\nconst Max int8 = 100",
+			New:  "package p\nconst Max = 100",
+			Want: justPatch,
+		},
+		{
+			Name:    "untyped constant out of range",
+			Old:     "package p\nconst Max int8 = 100",
+			New:     "package p\nconst Max = 1000",
+			Want:    breakingChange,
+			Reasons: []string{"const Max changed type from int8 to untyped int"},
+		},
+		{
+			Name:    "underlying type defined elsewhere",
+			Old:     "package p\ntype inner int\ntype T struct{ X inner }",
+			New:     "package p\ntype inner = string\ntype T struct{ X inner }",
+			Want:    breakingChange,
+			Reasons: []string{"field T.X changed type from example.com/p.inner to string"},
+		},
+		{
+			Name:    "named type to an identical unnamed type",
+			Old:     "package p\ntype IDs []int\ntype T struct{ X IDs }",
+			New:     "package p\ntype IDs []int\ntype T struct{ X []int }",
+			Want:    breakingChange,
+			Reasons: []string{"field T.X changed type from example.com/p.IDs to []int"},
+		},
+		{
+			Name: "defined type moved to another package",
+			Old:  "package p\ntype Reader interface{ Read(p []byte) (n int, err error) }",
+			New:  "package p\nimport \"io\"\ntype Reader = io.Reader",
+			Want: justPatch,
+		},
+		{
+			Name:    "defined type moved, losing a method",
+			Old:     "package p\ntype Stringer interface {\n\tString() string\n\tLen() int\n}",
+			New:     "package p\nimport \"fmt\"\ntype Stringer = fmt.Stringer",
+			Want:    breakingChange,
+			Reasons: []string{"removed method Stringer.Len"},
+		},
+		{
+			Name:    "defined type to an alias of an unnamed type",
+			Old:     "package p\ntype T struct{ X int }",
+			New:     "package p\ntype T = struct{ X int }",
+			Want:    breakingChange,
+			Reasons: []string{"type T changed from a defined type to an alias"},
+		},
+		{
+			Name:    "promoted method removed",
+			Old:     "package p\ntype Base struct{}\nfunc (*Base) Close() {}\ntype T struct{ *Base }",
+			New:     "package p\ntype Base struct{}\ntype T struct{ *Base }",
+			Want:    breakingChange,
+			Reasons: []string{"removed method Base.Close", "removed method T.Close"},
+		},
+		{
+			Name:    "named constraint loosened",
+			Old:     "package p\ntype Signed interface{ ~int | ~int64 }\nfunc Abs[T Signed](x T) T { return x }",
+			New:     "package p\ntype Signed interface{ ~int | ~int64 }\nfunc Abs[T Signed | ~float64](x T) T { return x }",
+			Want:    somethingNew,
+			Reasons: []string{"constraint of type parameter T of func Abs loosened from example.com/p.Signed to interface{example.com/p.Signed | ~float64}"},
+		},
+		{
+			Name:    "method added to constraint",
+			Old:     "package p\nfunc F[T any]() {}",
+			New:     "package p\nfunc F[T interface{ ~int; String() string }]() {}",
+			Want:    breakingChange,
+			Reasons: []string{"constraint of type parameter T of func F tightened from interface{} to interface{String() string; ~int}"},
+		},
+	}
+	for _, tc := range testcases {
+		var (
+			oldFset = token.NewFileSet()
+			newFset = token.NewFileSet()
+		)
+		d := &typesDiffer{differ: differ{oldFset: oldFset, newFset: newFset}}
+		d.packageDiff(checkSource(t, oldFset, tc.Old), checkSource(t, newFset, tc.New))
+		pkg := d.result()
+		if pkg.Change != tc.Want {
+			t.Errorf("typesDiff: %s, want %s, got %s", tc.Name, tc.Want, pkg.Change)
+			return
+		}
+		var reasons []string
+		for _, f := range pkg.Findings {
+			reasons = append(reasons, f.Reason)
+		}
+		if !reflect.DeepEqual(reasons, tc.Reasons) {
+			t.Errorf("typesDiff: %s, want reasons %q, got %q", tc.Name, tc.Reasons, reasons)
+			return
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	const src = `package p
+
+import "io"
+
+type Reader = io.Reader
+
+type T struct {
+	// X is documented.
+	X int ` + "`json:\"x\"`" + `
+	y string
+	*Embedded
+}
+
+type Embedded struct{}
+
+func (t *T) Read(p []byte) (int, error) { return 0, nil }
+
+var Default = &T{X: 1, y: "y"}
+
+const (
+	A = iota
+	B
+)
+
+type Color int
+
+const (
+	Red Color = iota + 1
+	Green
+	blue
+	Yellow
+)
+`
+	decls := newDeclSet()
+	if err := decls.parseFile("p/p.go", []byte(src)); err != nil {
+		t.Fatalf("parseFile: %s", err)
+	}
+	version, _ := parse("v1.2.3")
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, &apiSnapshot{Version: version, Dir: "p", Decls: decls}, "p"); err != nil {
+		t.Fatalf("writeSnapshot: %s", err)
+	}
+	if strings.Contains(buf.String(), "y string") || strings.Contains(buf.String(), "return") {
+		t.Errorf("writeSnapshot: unexported fields or function bodies are kept:\n%s", buf.String())
+		return
+	}
+	file := filepath.Join(t.TempDir(), "p.txt")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("os.WriteFile: %s", err)
+	}
+	snapshot, err := readSnapshot(file)
+	if err != nil {
+		t.Fatalf("readSnapshot: %s", err)
+	}
+	if snapshot.Version != version || snapshot.Dir != "p" || snapshot.Platform != nil {
+		t.Errorf("readSnapshot: want version %s and dir %q, got %s and %q", version, "p", snapshot.Version, snapshot.Dir)
+		return
+	}
+	snapshotDecls := snapshot.Decls
+	if pkg := diffDecls(snapshotDecls, decls, &detectOptions{ConstValues: true}); len(pkg.Findings) > 0 {
+		t.Errorf("diffDecls: a snapshot should be identical to its source, got %v", pkg.Findings)
+		return
+	}
+	// Constants repeating the type and expression of a previous spec are compared the same
+	// way from a snapshot as from the source.
+	changed := newDeclSet()
+	if err := changed.parseFile("p/p.go", []byte(strings.Replace(src, "\tGreen\n", "\tGreen = \"x\"\n", 1))); err != nil {
+		t.Fatalf("parseFile: %s", err)
+	}
+	opts := &detectOptions{ConstValues: true}
+	if want, got := diffDecls(decls, changed, opts), diffDecls(snapshotDecls, changed, opts); len(got.Findings) == 0 ||
+		!reflect.DeepEqual(findingReasons(got), findingReasons(want)) {
+		t.Errorf("diffDecls: want %v from a snapshot, got %v", findingReasons(want), findingReasons(got))
+	}
+}
+
+func findingReasons(pkg *packageDiff) []string {
+	var reasons []string
+	for _, f := range pkg.Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	return reasons
+}
+
+func TestAllowedChange(t *testing.T) {
+	type testcase struct {
+		Old  string
+		Next string
+		Want change
+	}
+	var testcases = []testcase{
+		{Old: "v1.2.3", Next: "v1.2.3", Want: noChange},
+		{Old: "v1.2.3", Next: "v1.2.4", Want: justPatch},
+		{Old: "v1.2.3", Next: "v1.3.0", Want: somethingNew},
+		{Old: "v0.2.3", Next: "v0.3.0", Want: breakingChange},
+		{Old: "v1.2.3", Next: "v2.0.0", Want: breakingChange},
+		{Old: "v1.3.0-rc.1", Next: "v1.3.0", Want: somethingNew},
+		{Old: "v1.2.3", Next: "v1.2.2", Want: noChange},
+	}
+	for _, tc := range testcases {
+		old, _ := parse(tc.Old)
+		next, _ := parse(tc.Next)
+		if got := allowedChange(old, next); got != tc.Want {
+			t.Errorf("allowedChange: from %s to %s, want %s, got %s", tc.Old, tc.Next, tc.Want, got)
+			return
+		}
+	}
+}
+
+func TestMatchDir(t *testing.T) {
+	type testcase struct {
+		Dir     string
+		Include []string
+		Exclude []string
+		Want    bool
+	}
+	var testcases = []testcase{
+		{Dir: "pkg/foo", Want: true},
+		{Dir: "pkg/foo", Include: []string{"pkg/..."}, Want: true},
+		{Dir: "pkg", Include: []string{"./pkg/..."}, Want: true},
+		{Dir: "pkgs/foo", Include: []string{"pkg/..."}, Want: false},
+		{Dir: "pkg/foo", Include: []string{"pkg/*"}, Want: true},
+		{Dir: "pkg/foo/bar", Include: []string{"pkg/*"}, Want: false},
+		{Dir: ".", Include: []string{"."}, Want: true},
+		{Dir: "examples/foo", Exclude: []string{"examples/..."}, Want: false},
+		{Dir: "pkg/foo", Include: []string{"..."}, Exclude: []string{"pkg/foo"}, Want: false},
+	}
+	for _, tc := range testcases {
+		if got := matchDir(tc.Dir, tc.Include, tc.Exclude); got != tc.Want {
+			t.Errorf("matchDir: %q with include %q and exclude %q, want %v, got %v", tc.Dir, tc.Include, tc.Exclude, tc.Want, got)
+			return
+		}
+	}
+	for dir, want := range map[string]bool{
+		"internal":       true,
+		"pkg/internal":   true,
+		"pkg/internal/x": true,
+		"pkg/internals":  false,
+		"pkg/myinternal": false,
+		".":              false,
+	} {
+		if got := isInternal(dir); got != want {
+			t.Errorf("isInternal: %q, want %v, got %v", dir, want, got)
+			return
+		}
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	pkg := diffSources(t, mapSource{"cmd/x/main.go": "package main\nfunc Foo() {}"}, mapSource{"cmd/x/main.go": "package main\nfunc Bar() {}"})
+	if pkg.Change != justPatch || len(pkg.Findings) != 0 {
+		t.Errorf("diff: commands have no API, want a patch without findings, got %s with %v", pkg.Change, pkg.Findings)
+		return
+	}
+	pkg = diffSources(t, mapSource{"cmd/x/main.go": "package main\nfunc Foo() {}"}, mapSource{"cmd/x/main.go": "package x\nfunc Foo() {}"})
+	if pkg.Change != somethingNew {
+		t.Errorf("diff: a command turned into a package adds API, want %s, got %s", somethingNew, pkg.Change)
+		return
+	}
+	const generator = "//go:build ignore\n\npackage main\nfunc main() {}"
+	pkg = diffSources(t, mapSource{"p/gen.go": generator, "p/lib.go": "package p\nfunc Foo() {}"}, mapSource{"p/gen.go": generator, "p/lib.go": "package p"})
+	if pkg.Change != breakingChange {
+		t.Errorf("diff: an ignored generator does not make a command, want %s, got %s", breakingChange, pkg.Change)
+		return
+	}
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a/gen.go": generator, "a/lib.go": "package a", "cmd/x/main.go": "package main"})
+	dirs, err := packageDirs(root, nil, nil)
+	if err != nil {
+		t.Errorf("packageDirs: %s", err)
+		return
+	}
+	if want := []string{filepath.Join(root, "a")}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("packageDirs: want %v, got %v", want, dirs)
+		return
+	}
+}
+
+// gitRepo creates a git repository in a temporary directory and makes it the working
+// directory until the end of the test, it returns a function running git in it.
+func gitRepo(t *testing.T) func(args ...string) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+		}
+		return string(out)
+	}
+	git("init", "-q")
+	git("config", "user.email", "test@example.com")
+	git("config", "user.name", "test")
+	git("config", "commit.gpgsign", "false")
+	return git
+}
+
+// writeFiles writes files relative to dir, an empty content removes the file.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if content == "" {
+			if err := os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// commitFiles writes files and commits them, optionally tagging the commit.
+func commitFiles(t *testing.T, git func(args ...string) string, files map[string]string, tags ...string) {
+	t.Helper()
+	writeFiles(t, ".", files)
+	git("add", "-A")
+	git("commit", "-q", "--allow-empty", "-m", "commit")
+	for _, tag := range tags {
+		git("tag", tag)
+	}
+}
+
+// reportSymbols lists the symbols of the findings in rep, in order.
+func reportSymbols(rep *report) []string {
+	symbols := []string{}
+	for _, pkg := range rep.Packages {
+		for _, f := range pkg.Findings {
+			symbols = append(symbols, f.Symbol)
+		}
+	}
+	return symbols
+}
+
+func TestDetectRevisions(t *testing.T) {
+	git := gitRepo(t)
+	commitFiles(t, git, map[string]string{"go.mod": "module example.com/m\n", "a/a.go": "package a\n\nfunc Foo() {}\n"})
+	commitFiles(t, git, map[string]string{"a/a.go": "package a\n\nfunc Foo() {}\n\nfunc Bar() {}\n"})
+	commitFiles(t, git, map[string]string{"a/a.go": "package a\n\nfunc Bar() {}\n"})
+	// Untracked files of the working tree are compared as well.
+	writeFiles(t, ".", map[string]string{"a/b.go": "package a\n\nfunc Baz() {}\n"})
+	type testcase struct {
+		From    string
+		To      string
+		Change  change
+		Symbols []string
+	}
+	var testcases = []testcase{
+		{Change: somethingNew, Symbols: []string{"Baz"}},
+		{From: "HEAD~1", Change: breakingChange, Symbols: []string{"Foo", "Baz"}},
+		{From: "HEAD~2", Change: breakingChange, Symbols: []string{"Foo", "Bar", "Baz"}},
+		{From: "HEAD~2", To: "HEAD~1", Change: somethingNew, Symbols: []string{"Bar"}},
+		{From: "HEAD~1", To: "HEAD", Change: breakingChange, Symbols: []string{"Foo"}},
+		// Without --from, HEAD is compared with --to.
+		{To: "HEAD~1", Change: somethingNew, Symbols: []string{"Foo"}},
+	}
+	for _, tc := range testcases {
+		rep, err := detectChange(&detectOptions{From: tc.From, To: tc.To})
+		if err != nil {
+			t.Errorf("detectChange: --from %q --to %q: %s", tc.From, tc.To, err)
+			return
+		}
+		if symbols := reportSymbols(rep); rep.Change != tc.Change || !reflect.DeepEqual(symbols, tc.Symbols) {
+			t.Errorf("detectChange: --from %q --to %q: want %s with %v, got %s with %v",
+				tc.From, tc.To, tc.Change, tc.Symbols, rep.Change, symbols)
+			return
+		}
+	}
+}
+
+func TestTagIgnoresWorkTree(t *testing.T) {
+	git := gitRepo(t)
+	commitFiles(t, git, map[string]string{"go.mod": "module example.com/m\n", "a/a.go": "package a\n\nfunc Foo() {}\n"}, "v1.0.0")
+	commitFiles(t, git, map[string]string{"a/a.go": "package a\n\nfunc Foo() { println() }\n"})
+	writeFiles(t, ".", map[string]string{"a/b.go": "package a\n\nfunc Bar() {}\n"})
+	t.Cleanup(func() { tag, to = false, "" })
+	Command.SetArgs([]string{"--tag"})
+	Command.SetOut(io.Discard)
+	t.Cleanup(func() { Command.SetOut(nil) })
+	if err := Command.Execute(); err != nil {
+		t.Errorf("upgrade --tag: %s", err)
+		return
+	}
+	if tags := strings.Fields(git("tag", "--points-at", "HEAD")); !reflect.DeepEqual(tags, []string{"v1.0.1"}) {
+		t.Errorf("upgrade --tag: want HEAD tagged as v1.0.1 regardless of the working tree, got %v", tags)
+		return
+	}
+}
+
+func TestUntaggedModuleSkipped(t *testing.T) {
+	git := gitRepo(t)
+	commitFiles(t, git, map[string]string{
+		"go.mod":     "module example.com/root\n",
+		"a/a.go":     "package a\n\nfunc Foo() {}\n",
+		"sub/go.mod": "module example.com/root/sub\n",
+		"sub/b/b.go": "package b\n\nfunc Foo() {}\n",
+	}, "v1.0.0")
+	writeFiles(t, ".", map[string]string{
+		"a/a.go":     "package a\n\nfunc Foo() {}\n\nfunc Bar() {}\n",
+		"sub/b/b.go": "package b\n",
+	})
+	var stdout, stderr bytes.Buffer
+	Command.SetArgs([]string{})
+	Command.SetOut(&stdout)
+	Command.SetErr(&stderr)
+	t.Cleanup(func() { Command.SetOut(nil); Command.SetErr(nil) })
+	if err := Command.Execute(); err != nil {
+		t.Errorf("upgrade: %s", err)
+		return
+	}
+	if !strings.Contains(stdout.String(), "v1.1.0") || strings.Contains(stdout.String(), "example.com/root/sub") {
+		t.Errorf("upgrade: want only the tagged module upgraded to v1.1.0, got:\n%s", stdout.String())
+		return
+	}
+	if !strings.Contains(stderr.String(), "skipped module example.com/root/sub") {
+		t.Errorf("upgrade: want the untagged module reported as skipped, got:\n%s", stderr.String())
+		return
+	}
+}
+
+func TestCheckPlatforms(t *testing.T) {
+	gitRepo(t)
+	writeFiles(t, ".", map[string]string{
+		"go.mod":         "module example.com/m\n",
+		"p/p_linux.go":   "package p\n\nfunc F() {}\n\nfunc L() {}\n",
+		"p/p_windows.go": "package p\n\nfunc F() {}\n",
+	})
+	platformSpecs = []string{"linux/amd64", "windows/amd64"}
+	t.Cleanup(func() { platformSpecs = nil; Command.SetErr(nil) })
+	var stderr bytes.Buffer
+	Command.SetErr(&stderr)
+	Command.SetArgs([]string{"snapshot", "v1.0.0"})
+	if err := Command.Execute(); err != nil {
+		t.Errorf("snapshot: %s", err)
+		return
+	}
+	for _, name := range []string{"p/p_linux_amd64.txt", "p/p_windows_amd64.txt"} {
+		if _, err := os.Stat(filepath.Join("api", name)); err != nil {
+			t.Errorf("snapshot: want a snapshot for each platform: %s", err)
+			return
+		}
+	}
+	Command.SetArgs([]string{"check", "v1.0.1"})
+	if err := Command.Execute(); err != nil {
+		t.Errorf("check: want no change, got %s", err)
+		return
+	}
+	writeFiles(t, ".", map[string]string{"p/p_linux.go": "package p\n\nfunc F() {}\n"})
+	if err := Command.Execute(); err == nil || !strings.Contains(stderr.String(), "removed func L (breaking on linux/amd64)") {
+		t.Errorf("check: want L removed on linux/amd64 only, got %v:\n%s", err, stderr.String())
+		return
+	}
+	Command.SetArgs([]string{"check", "v2.0.0"})
+	if err := Command.Execute(); err != nil {
+		t.Errorf("check: %s", err)
+		return
+	}
+}
+
+func TestSnapshotDirs(t *testing.T) {
+	gitRepo(t)
+	// the snapshots of a/b and a_b must not overwrite each other
+	writeFiles(t, ".", map[string]string{
+		"go.mod":   "module example.com/m\n",
+		"m.go":     "package m\n\nfunc M() {}\n",
+		"a/b/b.go": "package b\n\nfunc B() {}\n",
+		"a_b/b.go": "package ab\n\nfunc AB() {}\n",
+	})
+	t.Cleanup(func() { Command.SetErr(nil) })
+	var stderr bytes.Buffer
+	Command.SetErr(&stderr)
+	Command.SetArgs([]string{"snapshot", "v1.0.0"})
+	if err := Command.Execute(); err != nil {
+		t.Errorf("snapshot: %s", err)
+		return
+	}
+	for _, name := range []string{"m.txt", "a/b/b.txt", "a_b/ab.txt"} {
+		if _, err := os.Stat(filepath.Join("api", name)); err != nil {
+			t.Errorf("snapshot: want a snapshot for each package: %s", err)
+			return
+		}
+	}
+	Command.SetArgs([]string{"check", "v1.0.1"})
+	if err := Command.Execute(); err != nil {
+		t.Errorf("check: want no change, got %s:\n%s", err, stderr.String())
+		return
+	}
+	writeFiles(t, ".", map[string]string{"a/b/b.go": "package b\n"})
+	if err := Command.Execute(); err == nil || !strings.Contains(stderr.String(), "removed func B") {
+		t.Errorf("check: want B removed, got %v:\n%s", err, stderr.String())
+		return
+	}
+}
+
+func TestCheckConstValues(t *testing.T) {
+	type testcase struct {
+		Name      string
+		Platforms []string
+	}
+	var testcases = []testcase{
+		{Name: "all files"},
+		{Name: "per platform", Platforms: []string{"linux/amd64", "windows/amd64"}},
+	}
+	t.Cleanup(func() { platformSpecs = nil; constValues = false; Command.SetErr(nil) })
+	var stderr bytes.Buffer
+	Command.SetErr(&stderr)
+	for _, tc := range testcases {
+		gitRepo(t)
+		writeFiles(t, ".", map[string]string{
+			"go.mod":       "module example.com/m\n",
+			"p/p.go":       "package p\n\nconst (\n\tA = iota\n\tB\n)\n",
+			"p/p_linux.go": "package p\n\nfunc L() {}\n",
+		})
+		platformSpecs, constValues = tc.Platforms, false
+		Command.SetArgs([]string{"snapshot", "v1.0.0"})
+		if err := Command.Execute(); err != nil {
+			t.Errorf("snapshot: %s, %s", tc.Name, err)
+			return
+		}
+		writeFiles(t, ".", map[string]string{"p/p.go": "package p\n\nconst (\n\tB = iota\n\tA\n)\n"})
+		Command.SetArgs([]string{"check", "v1.0.1"})
+		if err := Command.Execute(); err != nil {
+			t.Errorf("check: %s, want no change without --const-values, got %s", tc.Name, err)
+			return
+		}
+		stderr.Reset()
+		constValues = true
+		if err := Command.Execute(); err == nil || !strings.Contains(stderr.String(), "const A") {
+			t.Errorf("check: %s, want the value of A changed with --const-values, got %v:\n%s", tc.Name, err, stderr.String())
+			return
+		}
+	}
+}
+
+func TestCommitsSinceVersion(t *testing.T) {
+	git := gitRepo(t)
+	commitFiles(t, git, map[string]string{"go.mod": "module example.com/m\n", "a/a.go": "package a\n\nfunc Foo() {}\n"}, "v1.0.0")
+	writeFiles(t, ".", map[string]string{"a/a.go": "package a\n\nfunc Foo() { println() }\n"})
+	git("commit", "-q", "-am", "feat!: Foo prints a line")
+	commits = true
+	t.Cleanup(func() { commits = false })
+	type testcase struct {
+		Version string
+		Want    change
+		Err     string
+	}
+	var testcases = []testcase{
+		{Version: "v1.0.0", Want: breakingChange},
+		{Version: "v1.1.0", Err: "--commits needs --from"},
+	}
+	for _, tc := range testcases {
+		rep, err := upgradeModule(Command, []string{tc.Version}, nil, nil, nil)
+		if tc.Err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.Err) {
+				t.Errorf("upgradeModule: %s, want an error containing %q, got %v", tc.Version, tc.Err, err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("upgradeModule: %s: %s", tc.Version, err)
+			return
+		}
+		if rep.Change != tc.Want || len(rep.Commits) != 1 {
+			t.Errorf("upgradeModule: %s, want a %s change from 1 commit, got %s from %d", tc.Version, tc.Want, rep.Change, len(rep.Commits))
+			return
+		}
+	}
+}
+
+func TestTypeCheckImporters(t *testing.T) {
+	git := gitRepo(t)
+	commitFiles(t, git, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.22\n",
+		"a/a.go": "package a\n\ntype Base struct{}\n\nfunc (*Base) Close() {}\n\nfunc (*Base) Open() {}\n",
+		"b/b.go": "package b\n\nimport \"example.com/m/a\"\n\ntype T struct{ *a.Base }\n",
+		"c/c.go": "package c\n\nimport \"example.com/m/a\"\n\nvar B a.Base\n",
+	})
+	writeFiles(t, ".", map[string]string{"a/a.go": "package a\n\ntype Base struct{}\n\nfunc (*Base) Open() {}\n"})
+	rep, err := detectChange(&detectOptions{TypeCheck: true})
+	if err != nil {
+		t.Errorf("detectChange: %s", err)
+		return
+	}
+	var reasons []string
+	for _, pkg := range rep.Packages {
+		for _, f := range pkg.Findings {
+			reasons = append(reasons, pkg.Dir+": "+f.Reason)
+		}
+	}
+	// c imports a as well, but is left out of the report since its API is the same
+	if want := []string{"a: removed method Base.Close", "b: removed method T.Close"}; !reflect.DeepEqual(reasons, want) || len(rep.Packages) != 2 {
+		t.Errorf("detectChange: want %q, got %q", want, reasons)
+		return
+	}
+}
+
+func TestAudit(t *testing.T) {
+	type commit struct {
+		Files map[string]string
+		Tags  []string
+	}
+	type testcase struct {
+		Name    string
+		Commits []commit
+		Want    []string
+	}
+	const (
+		goMod = "module example.com/m\n"
+		foo   = "package a\n\nfunc Foo() {}\n"
+		bar   = "package a\n\nfunc Bar() {}\n"
+		both  = "package a\n\nfunc Foo() {}\n\nfunc Bar() {}\n"
+	)
+	var testcases = []testcase{
+		{
+			Name: "understated",
+			Commits: []commit{
+				{Files: map[string]string{"go.mod": goMod, "a/a.go": foo}, Tags: []string{"v1.0.0"}},
+				{Files: map[string]string{"a/a.go": both}, Tags: []string{"v1.1.0"}},
+				{Files: map[string]string{"a/a.go": bar}, Tags: []string{"v1.1.1"}},
+			},
+			Want: []string{"v1.1.0 -> v1.1.1: breaking change, but only patch allowed, expected v2.0.0"},
+		},
+		{
+			Name: "pre-releases",
+			Commits: []commit{
+				{Files: map[string]string{"go.mod": goMod, "a/a.go": foo}, Tags: []string{"v1.0.0"}},
+				{Files: map[string]string{"a/a.go": both}, Tags: []string{"v1.1.0-rc.1"}},
+				{Files: map[string]string{"a/a.go": bar}, Tags: []string{"v1.1.0-rc.2"}},
+				{Files: map[string]string{"a/a.go": foo}, Tags: []string{"v2.0.0-rc.1", "v2.0.0"}},
+			},
+			Want: []string{"v1.1.0-rc.1 -> v1.1.0-rc.2: breaking change, but only new allowed, expected v2.0.0-rc.1"},
+		},
+		{
+			Name: "build metadata",
+			Commits: []commit{
+				{Files: map[string]string{"go.mod": goMod, "a/a.go": foo}, Tags: []string{"v1.0.0"}},
+				{Files: map[string]string{"a/a.go": both}, Tags: []string{"v1.0.0+build.2"}},
+			},
+		},
+		{
+			Name: "multiple modules",
+			Commits: []commit{
+				{
+					Files: map[string]string{"go.mod": goMod, "a/a.go": foo, "sub/go.mod": "module example.com/m/sub\n", "sub/a/a.go": foo},
+					Tags:  []string{"v1.0.0", "sub/v0.1.0"},
+				},
+				{Files: map[string]string{"a/a.go": both, "sub/a/a.go": bar}, Tags: []string{"v1.1.0", "sub/v0.1.1"}},
+			},
+			Want: []string{"sub/v0.1.0 -> sub/v0.1.1: breaking change, but only patch allowed, expected sub/v0.2.0"},
+		},
+	}
+	var stdout bytes.Buffer
+	Command.SetOut(&stdout)
+	t.Cleanup(func() { Command.SetOut(nil) })
+	for _, tc := range testcases {
+		git := gitRepo(t)
+		for _, c := range tc.Commits {
+			commitFiles(t, git, c.Files, c.Tags...)
+		}
+		stdout.Reset()
+		Command.SetArgs([]string{"audit"})
+		err := Command.Execute()
+		if (err != nil) != (len(tc.Want) > 0) {
+			t.Errorf("audit: %s, want %d violations, got %v:\n%s", tc.Name, len(tc.Want), err, stdout.String())
+			return
+		}
+		// the usage printed after the error follows the violations
+		var got []string
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if strings.Contains(line, " -> ") {
+				got = append(got, line)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("audit: %s, want %q, got %q", tc.Name, tc.Want, got)
+			return
+		}
+	}
+}
+
+func TestFindModules(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":            "module example.com/root\n",
+		"a/a.go":            "package a\n",
+		"sub/module/go.mod": "module example.com/root/sub/module\n",
+		"sub/module/b/b.go": "package b\n",
+		"testdata/go.mod":   "module example.com/ignored\n",
+	} {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modules, err := findModules(root)
+	if err != nil {
+		t.Errorf("findModules: %s", err)
+		return
+	}
+	if len(modules) != 2 || modules[0].Dir != "." || modules[1].Dir != filepath.FromSlash("sub/module") {
+		t.Errorf("findModules: want modules in %q and %q, got %v", ".", "sub/module", modules)
+		return
+	}
+	type testcase struct {
+		Dir    string
+		Module *module
+	}
+	var testcases = []testcase{
+		{Dir: "a", Module: modules[0]},
+		{Dir: "sub", Module: modules[0]},
+		{Dir: "sub/module", Module: modules[1]},
+		{Dir: "sub/module/b", Module: modules[1]},
+		{Dir: "sub/modules", Module: modules[0]},
+	}
+	for _, tc := range testcases {
+		for _, m := range modules {
+			if got, want := m.contains(filepath.FromSlash(tc.Dir)), m == tc.Module; got != want {
+				t.Errorf("contains: %q in module %q, want %v, got %v", tc.Dir, m.Dir, want, got)
+				return
+			}
+		}
+	}
+	if prefix := modules[1].tagPrefix(); prefix != "sub/module/" {
+		t.Errorf("tagPrefix: want %q, got %q", "sub/module/", prefix)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(root, "go.work"), []byte("go 1.22\n\nuse ./sub/module\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if modules, err = findModules(root); err != nil {
+		t.Errorf("findModules: %s", err)
+		return
+	}
+	if len(modules) != 1 || modules[0].Path != "example.com/root/sub/module" {
+		t.Errorf("findModules: want only the module used by go.work, got %v", modules)
+		return
+	}
+}
+
+func TestMajorPath(t *testing.T) {
+	type testcase struct {
+		Path  string
+		Major int
+		Want  string
+	}
+	var testcases = []testcase{
+		{Path: "example.com/m", Major: 2, Want: "example.com/m/v2"},
+		{Path: "example.com/m/v2", Major: 3, Want: "example.com/m/v3"},
+		{Path: "example.com/m/v2", Major: 2, Want: "example.com/m/v2"},
+		{Path: "example.com/m/v2", Major: 1, Want: "example.com/m"},
+		{Path: "example.com/m/v2", Major: 0, Want: "example.com/m"},
+	}
+	for _, tc := range testcases {
+		got, err := majorPath(tc.Path, tc.Major)
+		if err != nil {
+			t.Errorf("majorPath: %q to v%d: %s", tc.Path, tc.Major, err)
+			return
+		}
+		if got != tc.Want {
+			t.Errorf("majorPath: %q to v%d, want %q, got %q", tc.Path, tc.Major, tc.Want, got)
+			return
+		}
+	}
+	if _, err := majorPath("gopkg.in/yaml.v3", 4); err == nil {
+		t.Errorf("majorPath: want an error for gopkg.in paths")
+		return
+	}
+	nested := []string{"example.com/m/sub"}
+	for importPath, want := range map[string]bool{
+		"example.com/m":        true,
+		"example.com/m/a/b":    true,
+		"example.com/mm":       false,
+		"example.com/m/sub":    false,
+		"example.com/m/sub/x":  false,
+		"example.com/m/subpkg": true,
+		"fmt":                  false,
+	} {
+		if got := inModule(importPath, "example.com/m", nested); got != want {
+			t.Errorf("inModule: %q, want %v, got %v", importPath, want, got)
+			return
+		}
+	}
+}
+
+func TestMoveMajor(t *testing.T) {
+	root := t.TempDir()
+	const goMod = "module example.com/m\n"
+	writeFiles(t, root, map[string]string{
+		"go.mod":   goMod,
+		"a/a.go":   "package a\n\nimport \"example.com/m/b\"\n\nvar X = b.X\n",
+		"b/b.go":   "package b\n\nvar X int\n",
+		"c/bad.go": "package c\n\nimport \"example.com/m/b\"\n\nfunc {\n",
+	})
+	m := &module{Path: "example.com/m", Dir: root}
+	if _, err := moveMajor(m, 2); err == nil {
+		t.Errorf("moveMajor: want an error for a file that does not parse")
+		return
+	}
+	if content, _ := os.ReadFile(filepath.Join(root, "go.mod")); string(content) != goMod {
+		t.Errorf("moveMajor: go.mod should be left untouched after an error, got:\n%s", content)
+		return
+	}
+	writeFiles(t, root, map[string]string{"c/bad.go": ""})
+	changed, err := moveMajor(m, 2)
+	if err != nil {
+		t.Errorf("moveMajor: %s", err)
+		return
+	}
+	if want := []string{filepath.Join(root, "go.mod"), filepath.Join(root, "a", "a.go")}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("moveMajor: want %v changed, got %v", want, changed)
+		return
+	}
+	if content, _ := os.ReadFile(filepath.Join(root, "a", "a.go")); !strings.Contains(string(content), `"example.com/m/v2/b"`) {
+		t.Errorf("moveMajor: imports not rewritten:\n%s", content)
+		return
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	pkg := diffSources(t,
+		mapSource{"p/p.go": "package p\nfunc Foo() {}\ntype T struct{ A int }"},
+		mapSource{"p/p.go": "package p\nfunc Bar() {}\ntype T struct{ A int `json:\"a\"`; B int }"})
+	pkg.Dir = "p"
+	rep := newReport()
+	rep.add(pkg)
+	rep.Old, _ = parse("v1.2.0")
+	rep.Next = rep.Old.Next(rep.Change)
+	file := filepath.Join(t.TempDir(), "CHANGELOG.md")
+	old := "# Changelog\n\nAll notable changes.\n\n## v2.0.0 - 2020-01-02\n\n- stale\n\n## v1.2.0 - 2020-01-01\n\n- initial\n"
+	if err := os.WriteFile(file, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	if err := writeChangelog(file, rep, date); err != nil {
+		t.Errorf("writeChangelog: %s", err)
+		return
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Changelog\n\nAll notable changes.\n\n" +
+		"## v2.0.0 - 2020-02-01\n\n" +
+		"### Breaking\n\n- `p`: removed func Foo\n\n" +
+		"### Added\n\n- `p`: added func Bar\n- `p`: added field T.B\n\n" +
+		"### Changed\n\n- `p`: added tag `json:\"a\"` to field T.A\n\n" +
+		"## v1.2.0 - 2020-01-01\n\n- initial\n"
+	if string(content) != want {
+		t.Errorf("writeChangelog: want\n%s\ngot\n%s", want, content)
+		return
+	}
+	// the commits raise the level of a patch, and findings keep their platforms
+	rep = newReport()
+	rep.add(&packageDiff{Dir: "p", Change: justPatch, Findings: []*finding{{
+		Change:    justPatch,
+		Kind:      kindTagAdded,
+		Reason:    "added tag `json:\"a\"` to field T.A",
+		Platforms: []string{"linux/amd64"},
+	}}})
+	rep.Commits = []*commit{
+		{Hash: "1", Subject: "feat!: Foo no longer retries", Change: breakingChange},
+		{Hash: "2", Subject: "docs: explain Foo", Change: noChange},
+	}
+	rep.Change = breakingChange
+	rep.Old, _ = parse("v1.2.0")
+	rep.Next = rep.Old.Next(rep.Change)
+	want = "## v2.0.0 - 2020-02-01\n\n" +
+		"### Breaking\n\n- feat!: Foo no longer retries\n\n" +
+		"### Changed\n\n- `p`: added tag `json:\"a\"` to field T.A (on linux/amd64)\n"
+	if got := string(formatChangelog(rep, date)); got != want {
+		t.Errorf("formatChangelog: want\n%s\ngot\n%s", want, got)
+		return
+	}
+}
+
+func TestParseCommitMessage(t *testing.T) {
+	type testcase struct {
+		Message      string
+		Want         change
+		Conventional bool
+	}
+	var testcases = []testcase{
+		{Message: "fix: handle nil maps", Want: justPatch, Conventional: true},
+		{Message: "fix(parser): handle nil maps\n\nCloses #12.", Want: justPatch, Conventional: true},
+		{Message: "feat: add an option", Want: somethingNew, Conventional: true},
+		{Message: "feat!: drop an option", Want: breakingChange, Conventional: true},
+		{Message: "refactor(api)!: rename Client", Want: breakingChange, Conventional: true},
+		{Message: "feat: add an option\n\nBREAKING CHANGE: the default changed", Want: breakingChange, Conventional: true},
+		{Message: "chore: bump deps\n\nBREAKING-CHANGE: requires Go 1.22", Want: breakingChange, Conventional: true},
+		{Message: "docs: fix a typo", Want: noChange, Conventional: true},
+		{Message: "Fix a typo", Want: noChange, Conventional: false},
+		{Message: "feat:missing space", Want: noChange, Conventional: false},
+		{Message: "Merge branch 'main'\n\nfeat: not a header", Want: noChange, Conventional: false},
+	}
+	for _, tc := range testcases {
+		got, ok := parseCommitMessage(tc.Message)
+		if got != tc.Want || ok != tc.Conventional {
+			t.Errorf("parseCommitMessage: %q, want %s (%v), got %s (%v)", tc.Message, tc.Want, tc.Conventional, got, ok)
+			return
+		}
+	}
+}
+
+func TestInferUpdate(t *testing.T) {
+	const src = `package version
+
+const MinVersion = "v1.0.0"
+
+var Version = "v1.2.3"
+
+var Help = "v1.0.0"
+
+var Command = &cobra.Command{Use: "x", Version: "v1.2.3"}
+
+var Info = struct{ Version string }{Version: "v1.2.3"}
+`
+	type testcase struct {
+		Var      string
+		Selector string
+		Want     []string
+		Error    bool
+	}
+	var testcases = []testcase{
+		{Want: []string{"v1.0.1", "v1.2.4", "v1.0.1", "v1.2.4", "v1.2.4"}},
+		{Var: "Version", Want: []string{"v1.0.0", "v1.2.4", "v1.0.0", "v1.2.3", "v1.2.3"}},
+		{Selector: "Command.Version", Want: []string{"v1.0.0", "v1.2.3", "v1.0.0", "v1.2.4", "v1.2.3"}},
+		{Selector: "cobra.Command.Version", Want: []string{"v1.0.0", "v1.2.3", "v1.0.0", "v1.2.4", "v1.2.3"}},
+		{Selector: "Info.Version", Want: []string{"v1.0.0", "v1.2.3", "v1.0.0", "v1.2.3", "v1.2.4"}},
+		{Var: "Versions", Error: true},
+		{Selector: "Command.Use", Error: true},
+		{Selector: "Version", Error: true},
+	}
+	defer func() { varName, selector = "", "" }()
+	for _, tc := range testcases {
+		file := filepath.Join(t.TempDir(), "version.go")
+		if err := os.WriteFile(file, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		varName, selector = tc.Var, tc.Selector
+		_, _, err := inferUpdate([]string{file}, SemanticVersion{}, justPatch)
+		if tc.Error {
+			if err == nil {
+				t.Errorf("inferUpdate: --var %q --selector %q, want an error", tc.Var, tc.Selector)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("inferUpdate: --var %q --selector %q: %s", tc.Var, tc.Selector, err)
+			return
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		ast.Inspect(f, func(node ast.Node) bool {
+			if lit, ok := node.(*ast.BasicLit); ok && lit.Value != `"x"` {
+				got = append(got, stringLiteral(lit))
+			}
+			return true
+		})
+		if !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("inferUpdate: --var %q --selector %q, want %q, got %q", tc.Var, tc.Selector, tc.Want, got)
+			return
+		}
+	}
+}
+
+func TestInferUpdateFiles(t *testing.T) {
+	dir := t.TempDir()
+	type testcase struct {
+		Name string
+		Key  string
+		Old  string
+		New  string
+	}
+	var testcases = []testcase{
+		{
+			Name: "VERSION",
+			Old:  "1.2.3\n",
+			New:  "1.3.0\n",
+		},
+		{
+			Name: "package.json",
+			Old:  "{\n  \"name\": \"app\",\n  \"version\": \"1.2.3\",\n  \"engines\": {\"node\": \"20.1.0\"}\n}\n",
+			New:  "{\n  \"name\": \"app\",\n  \"version\": \"1.3.0\",\n  \"engines\": {\"node\": \"20.1.0\"}\n}\n",
+		},
+		{
+			Name: "lock.json",
+			Key:  "packages.1.version",
+			Old:  `{"packages": [{"version": "0.1.0"}, {"version": "v1.2.3"}]}`,
+			New:  `{"packages": [{"version": "0.1.0"}, {"version": "v1.3.0"}]}`,
+		},
+		{
+			Name: "Chart.yaml",
+			Key:  "appVersion",
+			Old:  "apiVersion: v2\nname: app # the name\nversion: 0.1.0\nappVersion: \"1.2.3\"\n",
+			New:  "apiVersion: v2\nname: app # the name\nversion: 0.1.0\nappVersion: \"1.3.0\"\n",
+		},
+		{
+			Name: "values.yml",
+			Key:  "image.tag",
+			Old:  "image:\n  repository: app\n  tag: v1.2.3\n",
+			New:  "image:\n  repository: app\n  tag: v1.3.0\n",
+		},
+		{
+			Name: "Dockerfile",
+			Key:  "LABEL",
+			Old:  "FROM golang:1.22.3\nLABEL version=\"1.2.3\"\n",
+			New:  "FROM golang:1.22.3\nLABEL version=\"1.3.0\"\n",
+		},
+	}
+	var files []string
+	for _, tc := range testcases {
+		file := filepath.Join(dir, tc.Name)
+		if err := os.WriteFile(file, []byte(tc.Old), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tc.Key != "" {
+			file += ":" + tc.Key
+		}
+		files = append(files, file)
+	}
+	current, next, err := inferUpdate(files, SemanticVersion{}, somethingNew)
+	if err != nil {
+		t.Errorf("inferUpdate: %s", err)
+		return
+	}
+	if current.String() != "v1.2.3" || next.String() != "v1.3.0" {
+		t.Errorf("inferUpdate: want v1.2.3 updated to v1.3.0, got %s updated to %s", current, next)
+		return
+	}
+	for _, tc := range testcases {
+		content, err := os.ReadFile(filepath.Join(dir, tc.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != tc.New {
+			t.Errorf("inferUpdate: %s, want %q, got %q", tc.Name, tc.New, content)
+			return
+		}
+	}
+	// without a key, the FROM line of the Dockerfile would be updated as well
+	for _, spec := range []string{"package.json:missing", "Chart.yaml:name.first", "Dockerfile:NOTHING", "Dockerfile"} {
+		if _, _, err = inferUpdate([]string{filepath.Join(dir, spec)}, SemanticVersion{}, justPatch); err == nil {
+			t.Errorf("inferUpdate: %s, want an error", spec)
+			return
+		}
+	}
+}
+
+func TestParseVersionFile(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "a:b")
+	if err := os.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	type testcase struct {
+		Spec string
+		Want versionFile
+	}
+	var testcases = []testcase{
+		{Spec: "VERSION", Want: versionFile{Path: "VERSION"}},
+		{Spec: "version.go:GoTurbo.Version", Want: versionFile{Path: "version.go", Key: "GoTurbo.Version"}},
+		{Spec: "Dockerfile:LABEL version", Want: versionFile{Path: "Dockerfile", Key: "LABEL version"}},
+		{Spec: `C:\repo\VERSION`, Want: versionFile{Path: `C:\repo\VERSION`}},
+		{Spec: `C:\repo\Chart.yaml:appVersion`, Want: versionFile{Path: `C:\repo\Chart.yaml`, Key: "appVersion"}},
+		{Spec: existing, Want: versionFile{Path: existing}},
+	}
+	for _, tc := range testcases {
+		if got := parseVersionFile(tc.Spec); got != tc.Want {
+			t.Errorf("parseVersionFile: %s, want %+v, got %+v", tc.Spec, tc.Want, got)
+			return
+		}
+	}
+}
+
+func TestUpdateCommands(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"main.go": `package main
+
+import (
+	"example.com/app/other"
+	"example.com/app/sub"
+	"github.com/spf13/cobra"
+)
+
+var App = &cobra.Command{Use: "app", Version: "v1.0.0"}
+
+func init() { App.AddCommand(sub.Command, other.Command) }
+`,
+		"sub/cmd.go": `package sub
+
+import c "github.com/spf13/cobra"
+
+var Command = &c.Command{
+	Use:     "sub [flags]",
+	Version: "v0.1.0",
+}
+`,
+		"other/cmd.go": `package other
+
+import "github.com/spf13/cobra"
+
+var Command = &cobra.Command{Use: "other", Version: "v2.3.4"}
+`,
+		"other/x/x.go": "package x\n",
+		// Another root command, named like the subcommands of app.
+		"tool/main.go": `package main
+
+import "github.com/spf13/cobra"
+
+var Command = &cobra.Command{Use: "tool", Version: "v0.5.0"}
+`,
+	} {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rep := newReport()
+	rep.add(&packageDiff{Dir: filepath.Join(root, "sub"), Change: justPatch})
+	rep.add(&packageDiff{Dir: filepath.Join(root, "other", "x"), Change: somethingNew})
+	commands, err := updateCommands(&module{Path: "example.com/app", Dir: root}, rep)
+	if err != nil {
+		t.Errorf("updateCommands: %s", err)
+		return
+	}
+	want := map[string]string{"app": "v1.1.0", "sub": "v0.1.1", "other": "v2.4.0", "tool": "v0.6.0"}
+	if len(commands) != len(want) {
+		t.Errorf("updateCommands: want %d commands, got %v", len(want), commands)
+		return
+	}
+	for _, c := range commands {
+		if isRoot := c.Name == "app" || c.Name == "tool"; c.Next.String() != want[c.Name] || c.Root != isRoot {
+			t.Errorf("updateCommands: want %s at %s (root: %v), got %s", c.Name, want[c.Name], isRoot, c)
+			return
+		}
+		content, err := os.ReadFile(c.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), strconv.Quote(want[c.Name])) {
+			t.Errorf("updateCommands: want %s written to %s, got\n%s", want[c.Name], c.File, content)
+			return
+		}
+	}
+}
+
+func TestFileTree(t *testing.T) {
+	dir := t.TempDir()
+	zipFile := filepath.Join(dir, "v1.2.3.zip")
+	f, err := os.Create(zipFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range map[string]string{
+		"example.com/m@v1.2.3/go.mod":     "module example.com/m\n",
+		"example.com/m@v1.2.3/m.go":       "package m\nfunc Foo() {}\n",
+		"example.com/m@v1.2.3/p/p.go":     "package p\nfunc Bar() {}\n",
+		"example.com/m@v1.2.3/old/old.go": "package old\n",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	newDir := filepath.Join(dir, "new")
+	for name, content := range map[string]string{
+		"go.mod":      "module example.com/m\n",
+		"m.go":        "package m\nfunc Foo() {}\n",
+		"p/p.go":      "package p\nfunc Baz() {}\n",
+		"new/new.go":  "package new\n",
+		".git/x.go":   "package x\n",
+		"vendor/v.go": "package v\n",
+	} {
+		file := filepath.Join(newDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldTree, oldCleanup, err := openTree(zipFile)
+	if err != nil {
+		t.Errorf("openTree: %s", err)
+		return
+	}
+	defer oldCleanup()
+	if oldTree.Version.String() != "v1.2.3" {
+		t.Errorf("openTree: want the version v1.2.3 of the module zip, got %s", oldTree.Version)
+		return
+	}
+	newTree, newCleanup, err := openTree(newDir)
+	if err != nil {
+		t.Errorf("openTree: %s", err)
+		return
+	}
+	defer newCleanup()
+	files, err := treeChangedFiles(oldTree, newTree)
+	if err != nil {
+		t.Errorf("treeChangedFiles: %s", err)
+		return
+	}
+	want := []changedFile{
+		{Old: filepath.FromSlash("old/old.go")},
+		{Old: filepath.FromSlash("p/p.go"), New: filepath.FromSlash("p/p.go")},
+		{New: filepath.FromSlash("new/new.go")},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("treeChangedFiles: want %v, got %v", want, files)
+		return
+	}
+	rep, err := detectChange(&detectOptions{OldTree: oldTree, NewTree: newTree})
+	if err != nil {
+		t.Errorf("detectChange: %s", err)
+		return
+	}
+	if rep.Change != breakingChange || len(rep.Packages) != 3 {
+		t.Errorf("detectChange: want a breaking change in 3 packages, got %s in %d", rep.Change, len(rep.Packages))
+		return
+	}
+}
+
+func TestPlatforms(t *testing.T) {
+	type testcase struct {
+		File     string
+		Src      string
+		Platform platform
+		Want     bool
+	}
+	var testcases = []testcase{
+		{File: "p.go", Src: "package p", Platform: platform{"linux", "amd64"}, Want: true},
+		{File: "p_linux.go", Src: "package p", Platform: platform{"linux", "amd64"}, Want: true},
+		{File: "p_linux.go", Src: "package p", Platform: platform{"android", "arm64"}, Want: true},
+		{File: "p_linux.go", Src: "package p", Platform: platform{"darwin", "amd64"}, Want: false},
+		{File: "p_windows_arm64.go", Src: "package p", Platform: platform{"windows", "amd64"}, Want: false},
+		{File: "p_arm64_test.go", Src: "package p", Platform: platform{"darwin", "arm64"}, Want: true},
+		{File: "linux.go", Src: "package p", Platform: platform{"darwin", "amd64"}, Want: true},
+		{File: "p_unix.go", Src: "package p", Platform: platform{"windows", "amd64"}, Want: true},
+		{File: "p.go", Src: "//go:build unix\n\npackage p", Platform: platform{"darwin", "arm64"}, Want: true},
+		{File: "p.go", Src: "//go:build unix\n\npackage p", Platform: platform{"windows", "amd64"}, Want: false},
+		{File: "p.go", Src: "//go:build !windows && go1.18\n\npackage p", Platform: platform{"linux", "amd64"}, Want: true},
+		{File: "p.go", Src: "//go:build cgo || ignore\n\npackage p", Platform: platform{"linux", "amd64"}, Want: false},
+		{File: "p.go", Src: "// +build linux darwin\n// +build amd64\n\npackage p", Platform: platform{"darwin", "amd64"}, Want: true},
+		{File: "p.go", Src: "// +build linux darwin\n// +build amd64\n\npackage p", Platform: platform{"darwin", "arm64"}, Want: false},
+		{File: "p_windows.go", Src: "//go:build amd64\n\npackage p", Platform: platform{"linux", "amd64"}, Want: false},
+		{File: "p.go", Src: "package p\n\n//go:build windows", Platform: platform{"linux", "amd64"}, Want: true},
+	}
+	for _, tc := range testcases {
+		f, err := parser.ParseFile(token.NewFileSet(), tc.File, tc.Src, parser.ParseComments)
+		if err != nil {
+			t.Errorf("parser.ParseFile: %s", err)
+			return
+		}
+		if got := tc.Platform.matchFile(tc.File, f); got != tc.Want {
+			t.Errorf("matchFile: %s on %s with %q, want %v, got %v", tc.File, tc.Platform, tc.Src, tc.Want, got)
+			return
+		}
+	}
+	if _, err := parsePlatforms([]string{"linux/amd64", "plan9"}); err == nil {
+		t.Errorf("parsePlatforms: want an error for \"plan9\"")
+		return
+	}
+	platforms, err := parsePlatforms([]string{"linux/amd64", "linux/arm64", "darwin/amd64", "darwin/arm64", "windows/amd64"})
+	if err != nil {
+		t.Errorf("parsePlatforms: %s", err)
+		return
+	}
+	// F moves between equivalent constraints, W is removed from windows only.
+	var (
+		oldSrc = mapSource{
+			"p/p_linux.go":   "package p\nfunc F() {}",
+			"p/p_windows.go": "package p\nfunc F() {}\nfunc W() {}",
+			"p/p_other.go":   "//go:build !linux && !windows\n\npackage p\nfunc F() {}",
+		}
+		newSrc = mapSource{
+			"p/p.go":         "//go:build linux\n\npackage p\nfunc F() {}",
+			"p/p_windows.go": "package p\nfunc F() {}",
+			"p/p_other.go":   "//go:build !linux && !windows\n\npackage p\nfunc F() {}",
+		}
+		chd = &changedDir{}
+	)
+	for _, name := range sortedKeys(oldSrc) {
+		chd.Olds = append(chd.Olds, name)
+	}
+	for _, name := range sortedKeys(newSrc) {
+		chd.News = append(chd.News, name)
+	}
+	pkg, err := diff(chd, oldSrc, newSrc, &detectOptions{Platforms: platforms})
+	if err != nil {
+		t.Errorf("diff: %s", err)
+		return
+	}
+	if pkg.Change != breakingChange || len(pkg.Findings) != 1 {
+		t.Errorf("diff: want a single breaking change, got %s with %v", pkg.Change, pkg.Findings)
+		return
+	}
+	if f := pkg.Findings[0]; f.Symbol != "W" || !reflect.DeepEqual(f.Platforms, []string{"windows/amd64"}) {
+		t.Errorf("diff: want W removed on windows/amd64, got %s", f)
+		return
+	}
+}
+
+func TestConstValues(t *testing.T) {
+	type testcase struct {
+		Name    string
+		Old     string
+		New     string
+		Reasons []string
+	}
+	var testcases = []testcase{
+		{
+			Name: "same values",
+			Old:  "package p\nconst (\n\tA = iota\n\tB\n)\nconst Max = 1 << 10",
+			New:  "package p\nconst (\n\tA = 0\n\tB = A + 1\n)\nconst Max = 1024",
+		},
+		{
+			Name: "iota block reordered",
+			Old:  "package p\ntype Color int\nconst (\n\tRed Color = iota\n\tGreen\n\tBlue\n)",
+			New:  "package p\ntype Color int\nconst (\n\tRed Color = iota\n\tBlue\n\tGreen\n)",
+			Reasons: []string{
+				"value of const Blue changed from 2 to 1",
+				"value of const Green changed from 1 to 2",
+			},
+		},
+		{
+			Name:    "string and unexported dependency",
+			Old:     "package p\nconst prefix = \"v1/\"\nconst Path = prefix + \"users\"",
+			New:     "package p\nconst prefix = \"v2/\"\nconst Path = prefix + \"users\"",
+			Reasons: []string{"value of const Path changed from \"v1/users\" to \"v2/users\""},
+		},
+		{
+			Name:    "integer division",
+			Old:     "package p\nconst Half = 3 / 2",
+			New:     "package p\nconst Half = (3 + 2) / 2",
+			Reasons: []string{"value of const Half changed from 1 to 2"},
+		},
+	}
+	for _, tc := range testcases {
+		oldDecls, newDecls := newDeclSet(), newDeclSet()
+		if err := oldDecls.parseFile("p/p.go", []byte(tc.Old)); err != nil {
+			t.Errorf("parseFile: %s", err)
+			return
+		}
+		if err := newDecls.parseFile("p/p.go", []byte(tc.New)); err != nil {
+			t.Errorf("parseFile: %s", err)
+			return
+		}
+		var reasons []string
+		for _, f := range diffDecls(oldDecls, newDecls, &detectOptions{ConstValues: true}).Findings {
+			reasons = append(reasons, f.Reason)
+		}
+		if !reflect.DeepEqual(reasons, tc.Reasons) {
+			t.Errorf("diffDecls: %s, want reasons %q, got %q", tc.Name, tc.Reasons, reasons)
+			return
+		}
+		var (
+			oldFset = token.NewFileSet()
+			newFset = token.NewFileSet()
+		)
+		d := &typesDiffer{differ: differ{oldFset: oldFset, newFset: newFset, constValues: true}}
+		d.packageDiff(checkSource(t, oldFset, tc.Old), checkSource(t, newFset, tc.New))
+		reasons = nil
+		for _, f := range d.result().Findings {
+			reasons = append(reasons, f.Reason)
+		}
+		if !reflect.DeepEqual(reasons, tc.Reasons) {
+			t.Errorf("typesDiff: %s, want reasons %q, got %q", tc.Name, tc.Reasons, reasons)
+			return
+		}
+	}
+	// Calls other than conversions and len, such as unsafe.Sizeof(n), are unknown.
+	oldDecls, newDecls := newDeclSet(), newDeclSet()
+	const calls = "package p\nimport \"unsafe\"\ntype Size int\nconst n = %d\nconst (\n\tA = int64(n)\n\tB = Size(n)\n\tC = unsafe.Sizeof(n)\n\tD = real(n)\n)"
+	if err := oldDecls.parseFile("p/p.go", []byte(fmt.Sprintf(calls, 8))); err != nil {
+		t.Errorf("parseFile: %s", err)
+		return
+	}
+	if err := newDecls.parseFile("p/p.go", []byte(fmt.Sprintf(calls, 16))); err != nil {
+		t.Errorf("parseFile: %s", err)
+		return
+	}
+	reasons := findingReasons(diffDecls(oldDecls, newDecls, &detectOptions{ConstValues: true}))
+	if want := []string{"value of const A changed from 8 to 16", "value of const B changed from 8 to 16"}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("diffDecls: want reasons %q, got %q", want, reasons)
+		return
+	}
+	// Without the option, values are not compared.
+	pkg := diffSources(t, mapSource{"p/p.go": "package p\nconst A = 1"}, mapSource{"p/p.go": "package p\nconst A = 2"})
+	if len(pkg.Findings) != 0 {
+		t.Errorf("diff: want no findings without comparing values, got %v", pkg.Findings)
+		return
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	dir := t.TempDir()
+	pol, err := loadPolicy(filepath.Join(dir, policyFile))
+	if err != nil || !reflect.DeepEqual(pol, defaultPolicy) {
+		t.Errorf("loadPolicy: want the default policy without a file, got %v, %v", pol, err)
+		return
+	}
+	var (
+		oldSrc = mapSource{"p/p.go": "package p\ntype T struct{ X int `json:\"x\"` }\ntype I interface{ M() }"}
+		newSrc = mapSource{"p/p.go": "package p\ntype T struct{ X int `json:\"x,omitempty\"` }\ntype I interface{ M(); N() }"}
+	)
+	rep := newReport()
+	rep.add(diffSources(t, oldSrc, newSrc))
+	pol.apply(rep)
+	if rep.Change != breakingChange {
+		t.Errorf("apply: want the default policy to keep %s, got %s", breakingChange, rep.Change)
+		return
+	}
+	file := filepath.Join(dir, policyFile)
+	content := "upgrade:\n  policy:\n    tag-changed: patch\n    interface-method-added: minor\n"
+	if err = os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pol, err = loadPolicy(file); err != nil {
+		t.Errorf("loadPolicy: %s", err)
+		return
+	}
+	pol.apply(rep)
+	if rep.Change != somethingNew || rep.Packages[0].Change != somethingNew {
+		t.Errorf("apply: want %s, got %s", somethingNew, rep.Change)
+		return
+	}
+	for _, f := range rep.Packages[0].Findings {
+		if want := map[string]change{kindTagChanged: justPatch, kindMethodAdded: somethingNew}[f.Kind]; f.Change != want {
+			t.Errorf("apply: want %s for %s, got %s", want, f.Kind, f.Change)
+			return
+		}
+	}
+	for _, content := range []string{"upgrade:\n  policy:\n    tag-edited: patch\n", "upgrade:\n  policy:\n    tag-changed: tiny\n"} {
+		if err = os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadPolicy(file); err == nil {
+			t.Errorf("loadPolicy: want an error for %q", content)
+			return
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	type testcase struct {
+		Name     string
+		Old      string
+		New      string
+		Findings []string
+	}
+	var testcases = []testcase{
+		{
+			Name:     "experimental func",
+			Old:      "package p\n// F does things.\n//\n// Experimental: may change.\nfunc F() {}",
+			New:      "package p\nfunc F(int) {}",
+			Findings: []string{"signature of func F changed from func() to func(int) (new, experimental)"},
+		},
+		{
+			Name: "unstable type and its members",
+			Old:  "package p\n//goturbo:unstable\ntype T struct{ X int }\nfunc (t *T) M() {}",
+			New:  "package p\ntype T struct{ Y int }",
+			Findings: []string{
+				"added field T.Y (none, unstable)",
+				"removed field T.X (none, unstable)",
+				"removed method (*T).M (none, unstable)",
+			},
+		},
+		{
+			Name:     "marked experimental while broken",
+			Old:      "package p\nfunc F() {}",
+			New:      "package p\n// Experimental: may change.\nfunc F(int) {}",
+			Findings: []string{"signature of func F changed from func() to func(int) (breaking)"},
+		},
+		{
+			Name: "experimental field",
+			Old:  "package p\ntype T struct {\n\t// Experimental: may change.\n\tX int\n\tY int\n}",
+			New:  "package p\ntype T struct{ Y string }",
+			Findings: []string{
+				"field T.Y changed type from int to string (breaking)",
+				"removed field T.X (new, experimental)",
+			},
+		},
+		{
+			Name: "deprecated",
+			Old:  "package p\nconst (\n\tA = 1\n\tB = 2\n)\ntype T struct{ X int }",
+			New:  "package p\nconst (\n\t// Deprecated: use B.\n\tA = 1\n\tB = 2\n)\ntype T struct {\n\t// Deprecated: use nothing.\n\tX int\n}",
+			Findings: []string{
+				"deprecated const A (new)",
+				"deprecated field T.X (new)",
+			},
+		},
+	}
+	findingStrings := func(findings []*finding) []string {
+		var strs []string
+		for _, f := range findings {
+			f.OldPos, f.NewPos = token.Position{}, token.Position{}
+			strs = append(strs, f.String())
+		}
+		return strs
+	}
+	for _, tc := range testcases {
+		oldDecls, newDecls := newDeclSet(), newDeclSet()
+		if err := oldDecls.parseFile("p/p.go", []byte(tc.Old)); err != nil {
+			t.Errorf("parseFile: %s", err)
+			return
+		}
+		if err := newDecls.parseFile("p/p.go", []byte(tc.New)); err != nil {
+			t.Errorf("parseFile: %s", err)
+			return
+		}
+		if findings := findingStrings(diffDecls(oldDecls, newDecls, nil).Findings); !reflect.DeepEqual(findings, tc.Findings) {
+			t.Errorf("diffDecls: %s, want %q, got %q", tc.Name, tc.Findings, findings)
+			return
+		}
+		var (
+			oldFset = token.NewFileSet()
+			newFset = token.NewFileSet()
+		)
+		d := &typesDiffer{differ: differ{
+			oldFset:        oldFset,
+			newFset:        newFset,
+			oldAnnotations: oldDecls.Annotations,
+			newAnnotations: newDecls.Annotations,
+		}}
+		d.packageDiff(checkSource(t, oldFset, tc.Old), checkSource(t, newFset, tc.New))
+		d.deprecationDiff()
+		findings := findingStrings(d.result().Findings)
+		// Methods are named by their types once type-checked.
+		want := strings.Join(tc.Findings, "\n")
+		want = strings.ReplaceAll(want, "removed method (*T).M", "removed method T.M")
+		if got := strings.Join(findings, "\n"); got != want {
+			t.Errorf("typesDiff: %s, want %q, got %q", tc.Name, want, got)
+			return
+		}
+	}
+	// A policy cannot raise the level of the findings of experimental symbols.
+	pkg := diffSources(t,
+		mapSource{"p/p.go": "package p\n// Experimental: may change.\ntype T struct{ X int `json:\"x\"` }"},
+		mapSource{"p/p.go": "package p\n// Experimental: may change.\ntype T struct{ X int }"})
+	policy{kindTagRemoved: breakingChange}.applyPackage(pkg)
+	if pkg.Change != somethingNew {
+		t.Errorf("applyPackage: want %s for an experimental type, got %s", somethingNew, pkg.Change)
+		return
+	}
+	// Annotations are kept in snapshots.
+	decls := newDeclSet()
+	if err := decls.parseFile("p/p.go", []byte("package p\n//goturbo:unstable\nfunc F() {}\n// Deprecated: use F.\n//\n// Experimental: may change.\nvar V int")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, &apiSnapshot{Version: SemanticVersion{Major: 1}, Dir: "p", Decls: decls}, "p"); err != nil {
+		t.Fatal(err)
+	}
+	snapshotDecls := newDeclSet()
+	if err := snapshotDecls.parseFile("p/api.go", buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []string{"F", "V"} {
+		if want, got := decls.Annotations[symbol], snapshotDecls.Annotations[symbol]; want.Stability != got.Stability || want.Deprecated != got.Deprecated {
+			t.Errorf("writeSnapshot: want the annotation of %s to be kept, got %+v", symbol, got)
+			return
+		}
+	}
+}
+
+func TestPromoted(t *testing.T) {
+	type testcase struct {
+		Name string
+		// Other is an unchanged file of the package, only p.go changes from Old to New.
+		Other   string
+		Old     string
+		New     string
+		Reasons []string
+	}
+	var testcases = []testcase{
+		{
+			Name:    "field of an unexported embedded type",
+			Other:   "package p\ntype T struct {\n\tbase\n\tY int\n}",
+			Old:     "package p\ntype base struct{ X, Y int }",
+			New:     "package p\ntype base struct{ Y int }",
+			Reasons: []string{"removed promoted field T.X"},
+		},
+		{
+			Name:  "method set",
+			Other: "package p\ntype T struct{ base }\ntype P struct{ *base }",
+			Old:   "package p\ntype base struct{}\nfunc (b base) M(x int) {}\nfunc (b base) N() {}",
+			New:   "package p\ntype base struct{}\nfunc (b *base) M(y int) {}\nfunc (b base) N() error { return nil }",
+			Reasons: []string{
+				"promoted method T.M is no longer in the method set of T, its receiver changed to a pointer",
+				"signature of promoted method T.N changed from func() to func() error",
+				"signature of promoted method P.N changed from func() to func() error",
+				"method base.M receiver changed to *base",
+				"signature of method base.N changed from func() to func() error",
+			},
+		},
+		{
+			Name:    "ambiguous",
+			Other:   "package p\ntype T struct {\n\tA\n\tB\n}\ntype A struct{ X int }",
+			Old:     "package p\ntype B struct{ Y int }",
+			New:     "package p\ntype B struct{ X, Y int }",
+			Reasons: []string{"removed promoted field T.X", "added field B.X"},
+		},
+		{
+			Name:    "hidden",
+			Other:   "package p\ntype T struct {\n\tbase\n\tX string\n}",
+			Old:     "package p\ntype base struct{ X int }",
+			New:     "package p\ntype base struct{}",
+			Reasons: nil,
+		},
+		{
+			Name:    "embedded interface",
+			Other:   "package p\ntype I interface {\n\tj\n\tM()\n}",
+			Old:     "package p\ntype j interface{ M() }",
+			New:     "package p\ntype j interface {\n\tM()\n\tN()\n}",
+			Reasons: []string{"added method I.N of an embedded interface"},
+		},
+	}
+	// unchanged files which do not parse, or are never built, are left out of the context
+	const (
+		template = "//go:build ignore\n\npackage main\n\nfunc main() { {{.Body}} }"
+		broken   = "package p\n\nfunc ("
+	)
+	for _, tc := range testcases {
+		var (
+			oldSrc = mapSource{"p/p.go": tc.Old, "p/other.go": tc.Other, "p/gen.go": template, "p/broken.go": broken}
+			newSrc = mapSource{"p/p.go": tc.New, "p/other.go": tc.Other, "p/gen.go": template, "p/broken.go": broken}
+		)
+		pkg, err := diff(&changedDir{Olds: []string{"p/p.go"}, News: []string{"p/p.go"}}, oldSrc, newSrc, nil)
+		if err != nil {
+			t.Errorf("diff: %s", err)
+			return
+		}
+		var reasons []string
+		for _, f := range pkg.Findings {
+			reasons = append(reasons, f.Reason)
+		}
+		if !reflect.DeepEqual(reasons, tc.Reasons) {
+			t.Errorf("diff: %s, want reasons %q, got %q", tc.Name, tc.Reasons, reasons)
+			return
+		}
+	}
+	// Type checking sees the fields of embedded types of other packages as well.
+	var (
+		oldFset = token.NewFileSet()
+		newFset = token.NewFileSet()
+	)
+	d := &typesDiffer{differ: differ{oldFset: oldFset, newFset: newFset}}
+	d.packageDiff(
+		checkSource(t, oldFset, "package p\ntype T struct{ *base }\ntype base struct{ X int; Y bool }"),
+		checkSource(t, newFset, "package p\ntype T struct{ *base }\ntype base struct{ X string; Z bool }"))
+	var reasons []string
+	for _, f := range d.result().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	want := []string{
+		"promoted field T.X changed type from int to string",
+		"removed promoted field T.Y",
+		"added promoted field T.Z",
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("typesDiff: want reasons %q, got %q", want, reasons)
+		return
+	}
+	// Snapshots keep the unexported types embedded in exported ones.
+	decls := newDeclSet()
+	if err := decls.parseFile("p/p.go", []byte("package p\ntype T struct{ base }\ntype base struct{ inner }\ntype inner struct{ X int }\ntype other struct{}")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, &apiSnapshot{Version: SemanticVersion{Major: 1}, Dir: "p", Decls: decls}, "p"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := buf.String(); !strings.Contains(snapshot, "type inner struct") || strings.Contains(snapshot, "type other") {
+		t.Errorf("writeSnapshot: want the embedded types only, got\n%s", snapshot)
+		return
+	}
+}
+
+func TestAPIDiff(t *testing.T) {
+	const (
+		oldSrc = `package p
+
+// T has a private field.
+type T struct {
+	X int
+	y string
+	Z []string ` + "`json:\"z\"`" + `
+}
+
+const Max = 10
+
+type Color int
+
+const (
+	Red Color = iota
+	Green
+	Blue
+)
+
+var Name = "old"
+
+var Limit = 10
+
+func A() {}
+
+func B(
+	x int,
+	y string,
+) error {
+	return nil
+}
+`
+		newSrc = `package p
+
+type T struct {
+	X int
+	z bool
+	Z []string ` + "`json:\"z\"`" + `
+}
+
+const Max = 100
+
+type Color int
+
+const (
+	Red Color = iota
+	Blue
+	Green
+)
+
+var Name = "new"
+
+var Limit int64 = 10
+
+func B(x int, y string, z bool) error { return nil }
+
+func (t *T) C() {}
+`
+	)
+	oldDecls, newDecls := newDeclSet(), newDeclSet()
+	if err := oldDecls.parseFile("p/p.go", []byte(oldSrc)); err != nil {
+		t.Errorf("parseFile: %s", err)
+		return
+	}
+	if err := newDecls.parseFile("p/p.go", []byte(newSrc)); err != nil {
+		t.Errorf("parseFile: %s", err)
+		return
+	}
+	want := []*declDiff{
+		{Symbol: "(*T).C", Change: declAdded, New: "func (t *T) C()"},
+		{Symbol: "A", Change: declRemoved, Old: "func A()"},
+		{Symbol: "B", Change: declChanged, Old: "func B(x int, y string) error", New: "func B(x int, y string, z bool) error"},
+		{Symbol: "Blue", Change: declChanged, Old: "const Blue Color = 2", New: "const Blue Color = 1"},
+		{Symbol: "Green", Change: declChanged, Old: "const Green Color = 1", New: "const Green Color = 2"},
+		{Symbol: "Limit", Change: declChanged, Old: "var Limit int", New: "var Limit int64"},
+		{Symbol: "Max", Change: declChanged, Old: "const Max = 10", New: "const Max = 100"},
+	}
+	decls := diffDeclTexts(oldDecls, newDecls)
+	if !reflect.DeepEqual(decls, want) {
+		for _, decl := range decls {
+			t.Logf("%+v", decl)
+		}
+		t.Errorf("diffDeclTexts: unexpected declarations")
+		return
+	}
+	// the unexported fields are only left out of the formatted declarations
+	if fields := oldDecls.Types["T"].Type.(*ast.StructType).Fields.List; len(fields) != 3 {
+		t.Errorf("diffDeclTexts: want the 3 fields of T kept, got %d", len(fields))
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeAPIDiff(&buf, []*packageAPIDiff{{Dir: "p", Decls: decls}}); err != nil {
+		t.Errorf("writeAPIDiff: %s", err)
+		return
+	}
+	const wantText = `p
+  +                                 func (t *T) C()
+  -  func A()
+  ~  func B(x int, y string) error  func B(x int, y string, z bool) error
+  ~  const Blue Color = 2           const Blue Color = 1
+  ~  const Green Color = 1          const Green Color = 2
+  ~  var Limit int                  var Limit int64
+  ~  const Max = 10                 const Max = 100
+`
+	if buf.String() != wantText {
+		t.Errorf("writeAPIDiff: want\n%s\ngot\n%s", wantText, buf.String())
+		return
+	}
+}
+
+func TestAPIDiffCommand(t *testing.T) {
+	type testcase struct {
+		Name string
+		Old  string
+		New  string
+		Want []*declDiff
+	}
+	var testcases = []testcase{
+		{
+			Name: "command",
+			Old:  "package main\n\nfunc Run() {}\n\nfunc main() {}\n",
+			New:  "package main\n\nfunc Run(args []string) {}\n\nfunc main() {}\n",
+		},
+		{
+			Name: "command turned into a library",
+			Old:  "package main\n\nfunc Run() {}\n\nfunc main() {}\n",
+			New:  "package app\n\nfunc Run() {}\n",
+			Want: []*declDiff{{Symbol: "Run", Change: declAdded, New: "func Run()"}},
+		},
+		{
+			Name: "library turned into a command",
+			Old:  "package app\n\nfunc Run() {}\n",
+			New:  "package main\n\nfunc Run() {}\n\nfunc main() {}\n",
+			Want: []*declDiff{{Symbol: "Run", Change: declRemoved, Old: "func Run()"}},
+		},
+	}
+	for _, tc := range testcases {
+		chd := &changedDir{Olds: []string{"app/app.go"}, News: []string{"app/app.go"}}
+		oldDecls, newDecls, err := loadDecls(chd, mapSource{"app/app.go": tc.Old}, mapSource{"app/app.go": tc.New})
+		if err != nil {
+			t.Errorf("loadDecls: %s, %s", tc.Name, err)
+			return
+		}
+		if decls := diffDeclTexts(oldDecls, newDecls); !reflect.DeepEqual(decls, tc.Want) {
+			t.Errorf("diffDeclTexts: %s, want %+v, got %+v", tc.Name, tc.Want, decls)
+			return
+		}
+	}
+}
+
+func TestInferFromContext(t *testing.T) {
+	type testcase struct {
+		Name string
+		// Other is an unchanged file of the package, only p.go changes from Old to New.
+		Other   string
+		Old     string
+		New     string
+		Reasons []string
+		Decls   []*declDiff
+	}
+	var testcases = []testcase{
+		{
+			Name:    "func declared in another file",
+			Other:   "package p\ntype Client struct{}\ntype Server struct{}\nfunc NewClient() *Client { return nil }\nfunc NewServer() *Server { return nil }",
+			Old:     "package p\nvar Default = NewClient()",
+			New:     "package p\nvar Default = NewServer()",
+			Reasons: []string{"var Default changed type from *Client to *Server"},
+			Decls:   []*declDiff{{Symbol: "Default", Change: declChanged, Old: "var Default *Client", New: "var Default *Server"}},
+		},
+		{
+			Name:    "const declared in another file",
+			Other:   "package p\nconst Base = 10",
+			Old:     "package p\nconst Max = Base",
+			New:     "package p\nconst Max = Base + 1",
+			Reasons: []string{"value of const Max changed from 10 to 11"},
+			Decls:   []*declDiff{{Symbol: "Max", Change: declChanged, Old: "const Max = Base", New: "const Max = Base + 1"}},
+		},
+	}
+	for _, tc := range testcases {
+		var (
+			chd    = &changedDir{Olds: []string{"p/p.go"}, News: []string{"p/p.go"}}
+			oldSrc = mapSource{"p/p.go": tc.Old, "p/other.go": tc.Other}
+			newSrc = mapSource{"p/p.go": tc.New, "p/other.go": tc.Other}
+		)
+		oldDecls, newDecls, err := loadDecls(chd, oldSrc, newSrc)
+		if err != nil {
+			t.Errorf("loadDecls: %s, %s", tc.Name, err)
+			return
+		}
+		if reasons := findingReasons(diffDecls(oldDecls, newDecls, &detectOptions{ConstValues: true})); !reflect.DeepEqual(reasons, tc.Reasons) {
+			t.Errorf("diffDecls: %s, want %q, got %q", tc.Name, tc.Reasons, reasons)
+			return
+		}
+		if decls := diffDeclTexts(oldDecls, newDecls); !reflect.DeepEqual(decls, tc.Decls) {
+			t.Errorf("diffDeclTexts: %s, want %+v, got %+v", tc.Name, tc.Decls, decls)
+			return
+		}
+	}
+}
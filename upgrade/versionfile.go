@@ -0,0 +1,457 @@
+package upgrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// versionFile is a file carrying the version, given to --file as its path, optionally
+// followed by a colon and a key selecting the version in the file. The meaning of the
+// key depends on the type of the file:
+//
+//   - .go files: the name of a const or var, or a selector as in --selector, every
+//     semantic version is updated by default (unless --var or --selector is given);
+//   - .json files: a dot-separated path, such as "version" (the default) or
+//     "packages.0.version", where numbers are indexes into arrays;
+//   - .yaml and .yml files: a dot-separated path of keys, "version" by default;
+//   - any other file: only the lines containing the key are updated. Without a key, every
+//     semantic version is updated in a file named VERSION, while the other files, such as
+//     a Dockerfile mentioning the versions of other software, must hold a single version.
+type versionFile struct {
+	Path string
+	Key  string
+}
+
+// parseVersionFile splits spec at its last colon, unless spec is an existing file or what
+// follows the colon is a path, as in the Windows path C:\repo\VERSION.
+func parseVersionFile(spec string) versionFile {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 || strings.ContainsAny(spec[i+1:], `/\`) {
+		return versionFile{Path: spec}
+	}
+	if info, err := os.Stat(spec); err == nil && !info.IsDir() {
+		return versionFile{Path: spec}
+	}
+	return versionFile{Path: spec[:i], Key: spec[i+1:]}
+}
+
+// versionEdit locates a version in the content of a version file.
+type versionEdit struct {
+	// Start and End are the byte offsets of the version.
+	Start int
+	End   int
+	// Version is the version as it is written in the file.
+	Version string
+	// GoString tells that the version is a Go string literal, which has to be quoted.
+	GoString bool
+}
+
+// inferUpdate updates the versions found in files, and returns the first version found
+// (or old if it is valid) along with the version it is updated to. Each version is bumped
+// from its own value, unless old is valid, in which case all of them are replaced by the
+// version following old.
+func inferUpdate(files []string, old SemanticVersion, chg change) (current SemanticVersion, next SemanticVersion, err error) {
+	var (
+		contents = make([][]byte, len(files))
+		edits    = make([][]versionEdit, len(files))
+		versions = make([][]SemanticVersion, len(files))
+	)
+	current = old
+	for i, spec := range files {
+		vf := parseVersionFile(spec)
+		if contents[i], err = os.ReadFile(vf.Path); err != nil {
+			return current, next, err
+		}
+		if edits[i], err = vf.find(contents[i]); err != nil {
+			return current, next, fmt.Errorf("%s: %w", vf.Path, err)
+		}
+		for _, edit := range edits[i] {
+			sv, err := parse(edit.Version)
+			if err != nil {
+				return current, next, fmt.Errorf("%s: %q is not a semantic version: %w", vf.Path, edit.Version, err)
+			}
+			if old.Valid() {
+				sv = old
+			}
+			if !current.Valid() {
+				current = sv
+			}
+			versions[i] = append(versions[i], sv)
+		}
+	}
+	next = nextVersion(current, chg)
+	for i, spec := range files {
+		content := replaceVersions(contents[i], edits[i], func(j int) SemanticVersion { return nextVersion(versions[i][j], chg) })
+		if err = os.WriteFile(parseVersionFile(spec).Path, content, 0644); err != nil {
+			return current, next, err
+		}
+	}
+	return current, next, nil
+}
+
+// replaceVersions replaces the versions located by edits in content, the i-th of which
+// is replaced by next(i), written in the same style as the version it replaces.
+func replaceVersions(content []byte, edits []versionEdit, next func(i int) SemanticVersion) []byte {
+	// Edit backwards, so that the offsets of the remaining edits stay valid.
+	for i := len(edits) - 1; i >= 0; i-- {
+		edit := edits[i]
+		version := next(i).String()
+		if !strings.HasPrefix(edit.Version, "v") {
+			version = strings.TrimPrefix(version, "v")
+		}
+		if edit.GoString {
+			version = strconv.Quote(version)
+		}
+		content = slices.Concat(content[:edit.Start], []byte(version), content[edit.End:])
+	}
+	return content
+}
+
+// find locates the versions to update in content, ordered by their offsets; it is an
+// error if there is none.
+func (vf versionFile) find(content []byte) (edits []versionEdit, err error) {
+	switch ext := strings.ToLower(filepath.Ext(vf.Path)); ext {
+	case ".go":
+		edits, err = findGoVersions(vf.Path, content, vf.Key)
+	case ".json":
+		edits, err = findJSONVersion(content, vf.keyOrDefault())
+	case ".yaml", ".yml":
+		edits, err = findYAMLVersion(content, vf.keyOrDefault())
+	default:
+		edits = findTextVersions(content, vf.Key)
+		if vf.Key == "" && filepath.Base(vf.Path) != "VERSION" {
+			err = singleVersion(edits)
+		}
+	}
+	if err == nil && len(edits) == 0 {
+		err = errors.New("no version found")
+	}
+	slices.SortFunc(edits, func(x, y versionEdit) int { return x.Start - y.Start })
+	return edits, err
+}
+
+func (vf versionFile) keyOrDefault() string {
+	if vf.Key == "" {
+		return "version"
+	}
+	return vf.Key
+}
+
+// findGoVersions locates the versions in a Go file, which are string literals. The key is
+// either the name of a const or var, or a selector; --var and --selector apply if there
+// is no key.
+func findGoVersions(file string, content []byte, key string) ([]versionEdit, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, content, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	name, sel := varName, selector
+	if key != "" {
+		if strings.Contains(key, ".") {
+			name, sel = "", key
+		} else {
+			name, sel = key, ""
+		}
+	}
+	var lits []*ast.BasicLit
+	switch {
+	case name != "":
+		if lits = varLiterals(f, name); len(lits) == 0 {
+			return nil, fmt.Errorf("no const or var %s with a string value found", name)
+		}
+	case sel != "":
+		if lits = selectorLiterals(f, sel); len(lits) == 0 {
+			return nil, fmt.Errorf("no field %s with a string value found", sel)
+		}
+	default:
+		ast.Inspect(f, func(node ast.Node) bool {
+			if x, ok := node.(*ast.BasicLit); ok {
+				if sv, _ := parse(stringLiteral(x)); sv.Valid() {
+					lits = append(lits, x)
+				}
+				return false
+			}
+			return true
+		})
+	}
+	edits := make([]versionEdit, 0, len(lits))
+	for _, lit := range lits {
+		start := fset.Position(lit.Pos()).Offset
+		edits = append(edits, versionEdit{
+			Start:    start,
+			End:      start + len(lit.Value),
+			Version:  stringLiteral(lit),
+			GoString: true,
+		})
+	}
+	return edits, nil
+}
+
+// findJSONVersion locates the string at the dot-separated path in a JSON document.
+func findJSONVersion(content []byte, path string) ([]versionEdit, error) {
+	var (
+		decoder = json.NewDecoder(bytes.NewReader(content))
+		edits   []versionEdit
+	)
+	var walk func(current string) error
+	walk = func(current string) error {
+		tok, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case json.Delim:
+			switch tok {
+			case '{':
+				for decoder.More() {
+					key, err := decoder.Token()
+					if err != nil {
+						return err
+					}
+					if err = walk(joinPath(current, key.(string))); err != nil {
+						return err
+					}
+				}
+			case '[':
+				for i := 0; decoder.More(); i++ {
+					if err = walk(joinPath(current, strconv.Itoa(i))); err != nil {
+						return err
+					}
+				}
+			}
+			// The closing delimiter.
+			_, err = decoder.Token()
+			return err
+		case string:
+			if current == path {
+				// Versions never contain escaped characters, so the string starts right after
+				// the last quote before its closing quote.
+				end := int(decoder.InputOffset()) - 1
+				start := bytes.LastIndexByte(content[:end], '"') + 1
+				edits = append(edits, versionEdit{Start: start, End: end, Version: tok})
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(edits) == 0 {
+		return nil, fmt.Errorf("no string found at %q", path)
+	}
+	return edits, nil
+}
+
+// findYAMLVersion locates the scalar at the dot-separated path of keys in a YAML document.
+func findYAMLVersion(content []byte, path string) ([]versionEdit, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	node := &doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, key := range strings.Split(path, ".") {
+		var child *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					child = node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && 0 <= i && i < len(node.Content) {
+				child = node.Content[i]
+			}
+		}
+		if child == nil {
+			return nil, fmt.Errorf("no value found at %q", path)
+		}
+		node = child
+	}
+	if node.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("the value at %q is not a scalar", path)
+	}
+	// Lines and columns are counted from 1, and columns count characters.
+	start := 0
+	for line := 1; line < node.Line; line++ {
+		start += bytes.IndexByte(content[start:], '\n') + 1
+	}
+	for column := 1; column < node.Column; column++ {
+		_, size := utf8.DecodeRune(content[start:])
+		start += size
+	}
+	if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		start++
+	}
+	end := start + len(node.Value)
+	if end > len(content) || string(content[start:end]) != node.Value {
+		return nil, fmt.Errorf("unable to locate the value at %q", path)
+	}
+	return []versionEdit{{Start: start, End: end, Version: node.Value}}, nil
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// textVersion matches semantic versions in plain text, with or without the "v" prefix.
+var textVersion = regexp.MustCompile(`v?\d+\.\d+\.\d+(?:-[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?`)
+
+// findTextVersions locates the semantic versions in the lines of a plain text file that
+// contain key, or in all lines if key is empty. Numbers that are part of a longer dotted
+// sequence, such as an IP address, are not versions.
+func findTextVersions(content []byte, key string) []versionEdit {
+	var (
+		edits []versionEdit
+		start int
+	)
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		if bytes.Contains(line, []byte(key)) {
+			for _, match := range textVersion.FindAllIndex(line, -1) {
+				if isVersionBoundary(line, match[0]-1) && isVersionBoundary(line, match[1]) {
+					edits = append(edits, versionEdit{
+						Start:   start + match[0],
+						End:     start + match[1],
+						Version: string(line[match[0]:match[1]]),
+					})
+				}
+			}
+		}
+		start += len(line)
+	}
+	return edits
+}
+
+// singleVersion returns an error if edits locate different versions, which happens in
+// files mentioning the versions of other software, when no key tells them apart.
+func singleVersion(edits []versionEdit) error {
+	for _, edit := range edits {
+		if strings.TrimPrefix(edit.Version, "v") != strings.TrimPrefix(edits[0].Version, "v") {
+			return fmt.Errorf("found both %s and %s, give a key to select the version, as in path:key", edits[0].Version, edit.Version)
+		}
+	}
+	return nil
+}
+
+// isVersionBoundary reports whether the byte at i in line may surround a version.
+func isVersionBoundary(line []byte, i int) bool {
+	if i < 0 || i >= len(line) {
+		return true
+	}
+	ch := line[i]
+	return !('0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '.' || ch == '_')
+}
+
+// stringLiteral returns the value of lit if it is a string literal, or an empty string.
+func stringLiteral(lit *ast.BasicLit) string {
+	if lit.Kind != token.STRING {
+		return ""
+	}
+	value, _ := strconv.Unquote(lit.Value)
+	return value
+}
+
+// varLiterals returns the string literals assigned to the package-level consts or vars
+// named name in f.
+func varLiterals(f *ast.File, name string) []*ast.BasicLit {
+	var lits []*ast.BasicLit
+	for _, decl := range f.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || (genDecl.Tok != token.CONST && genDecl.Tok != token.VAR) {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			valueSpec := spec.(*ast.ValueSpec)
+			for i, ident := range valueSpec.Names {
+				if ident.Name != name || i >= len(valueSpec.Values) {
+					continue
+				}
+				if lit, ok := valueSpec.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					lits = append(lits, lit)
+				}
+			}
+		}
+	}
+	return lits
+}
+
+// selectorLiterals returns the string literals of the field selected by sel in composite
+// literals in f. sel is the name of the field prefixed with either the type of the
+// composite literal, such as "GoTurbo.Version" or "cobra.Command.Version", or the name
+// of the const or var it is assigned to.
+func selectorLiterals(f *ast.File, sel string) []*ast.BasicLit {
+	i := strings.LastIndex(sel, ".")
+	if i < 0 {
+		return nil
+	}
+	owner, field := sel[:i], sel[i+1:]
+	var (
+		lits []*ast.BasicLit
+		seen = make(map[*ast.BasicLit]bool)
+	)
+	addField := func(compositeLit *ast.CompositeLit) {
+		for _, elt := range compositeLit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			key, ok := kv.Key.(*ast.Ident)
+			if !ok || key.Name != field {
+				continue
+			}
+			if lit, ok := kv.Value.(*ast.BasicLit); ok && lit.Kind == token.STRING && !seen[lit] {
+				seen[lit] = true
+				lits = append(lits, lit)
+			}
+		}
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.ValueSpec:
+			for i, ident := range x.Names {
+				if ident.Name == owner && i < len(x.Values) {
+					if compositeLit, ok := ast.Unparen(unaddr(x.Values[i])).(*ast.CompositeLit); ok {
+						addField(compositeLit)
+					}
+				}
+			}
+		case *ast.CompositeLit:
+			if x.Type != nil {
+				if typeName := formatExpr(x.Type); typeName == owner || strings.HasSuffix(typeName, "."+owner) {
+					addField(x)
+				}
+			}
+		}
+		return true
+	})
+	return lits
+}
+
+// unaddr strips the & operator from expr.
+func unaddr(expr ast.Expr) ast.Expr {
+	if unary, ok := expr.(*ast.UnaryExpr); ok && unary.Op == token.AND {
+		return unary.X
+	}
+	return expr
+}